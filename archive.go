@@ -0,0 +1,164 @@
+package linksame
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isArchive reports whether the file name has the extension of an archive
+// that can be scanned.
+func isArchive(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportArchiveCopies prints the files that also exist as members of the
+// archives.  Only archive members that are the same size as a file found in
+// the walk are hashed.  Archives are only read, and their members are never
+// linked to.
+func reportArchiveCopies(archives []string, sizeFileMap map[int64][]string, opts *Options) {
+	// Map size and hash of archive member to archive:member names.
+	members := map[contentKey][]string{}
+	for _, archive := range archives {
+		err := scanArchive(archive, func(name string, size int64, r io.Reader) error {
+			if _, ok := sizeFileMap[size]; !ok || size > treeHashThreshold {
+				return nil
+			}
+			if !opts.extSelected(path.Base(name)) {
+				return nil
+			}
+			if opts.Pattern != "" {
+				if ok, _ := filepath.Match(opts.Pattern, path.Base(name)); !ok {
+					return nil
+				}
+			}
+			h := newHash()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			key := contentKey{size, string(h.Sum(nil))}
+			members[key] = append(members[key], archive+":"+name)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(opts.errOut(), "cannot scan archive:", err)
+		}
+	}
+	printCopies(members, sizeFileMap, "also exist in archives", opts)
+}
+
+// printCopies prints the files that have the same size and hash as the
+// copies, which are files that are not linked such as archive members.  The
+// copies map a size and hash to the names of the copies.
+func printCopies(copies map[contentKey][]string, sizeFileMap map[int64][]string, desc string, opts *Options) {
+	if len(copies) == 0 {
+		return
+	}
+	sizes := map[int64]struct{}{}
+	for key := range copies {
+		sizes[key.size] = struct{}{}
+	}
+
+	// Hash files of the same sizes as the copies and find matches.
+	found := map[string][]string{}
+	for size := range sizes {
+		for _, f := range sizeFileMap[size] {
+			if f == "" || isArchive(f) || isCompressed(f) {
+				continue
+			}
+			h, err := opts.cachedHashFile(f, false)
+			if err != nil {
+				continue
+			}
+			if names, ok := copies[contentKey{size, h}]; ok {
+				found[f] = names
+			}
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+
+	files := make([]string, 0, len(found))
+	for f := range found {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	fmt.Fprintln(opts.out())
+	fmt.Fprintln(opts.out(), len(files), "files", desc+":")
+	for _, f := range files {
+		fmt.Fprintln(opts.out(), " ", f)
+		for _, name := range found[f] {
+			fmt.Fprintln(opts.out(), "    in", name)
+		}
+	}
+}
+
+// scanArchive calls fn for each regular file in the archive.
+func scanArchive(archive string, fn func(name string, size int64, r io.Reader) error) error {
+	if strings.HasSuffix(archive, ".zip") {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if !zf.Mode().IsRegular() {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(zf.Name, int64(zf.UncompressedSize64), r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(archive, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(hdr.Name, hdr.Size, tr); err != nil {
+			return err
+		}
+	}
+}
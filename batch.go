@@ -0,0 +1,59 @@
+package linksame
+
+import "os"
+
+const (
+	// batchSize is the maximum number of small files read in one batch.
+	batchSize = 64
+	// smallFileSize is the size at or below which files are read in
+	// batches.
+	smallFileSize = 64 * 1024
+)
+
+// batchReader reads many files with fewer system calls than reading each
+// file separately.
+type batchReader interface {
+	// readFiles reads each file into the corresponding buffer, and returns
+	// the number of bytes read into each, or -1 if a file could not be read.
+	// An error means that the batch reader cannot be used.
+	readFiles(files []*os.File, bufs [][]byte) ([]int, error)
+	close()
+}
+
+// hashBatch hashes small files using the batch reader.  Each buffer is one
+// byte larger than the file size, so that a file that has grown since its
+// size was found is detected.  Files that cannot be read in the batch, or
+// that have changed size, are hashed individually.  If the batch reader
+// fails, all of the files are hashed individually, and the error is returned
+// so that the batch reader is no longer used.
+func hashBatch(br batchReader, batch []candidate, results chan<- hashResult, opts *Options) error {
+	files := make([]*os.File, 0, len(batch))
+	bufs := make([][]byte, 0, len(batch))
+	opened := make([]candidate, 0, len(batch))
+	for _, c := range batch {
+		f, err := os.Open(c.path)
+		if err != nil {
+			results <- hashResult{candidate: c, err: err}
+			continue
+		}
+		files = append(files, f)
+		bufs = append(bufs, make([]byte, c.size+1))
+		opened = append(opened, c)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	n, err := br.readFiles(files, bufs)
+	for i, c := range opened {
+		files[i].Close()
+		if err != nil || int64(n[i]) != c.size {
+			h, err := opts.fileHash(c.path, false)
+			results <- hashResult{candidate: c, hash: h, err: err}
+			continue
+		}
+		h := newHash()
+		h.Write(bufs[i][:n[i]])
+		results <- hashResult{candidate: c, hash: string(h.Sum(nil))}
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gammazero/linksame/internal/synthtree"
+)
+
+// benchTree generates a synthetic tree of files, a fraction dupRatio of which
+// are duplicates, for a benchmark.  It returns the root of the tree and the
+// total size of the files.
+func benchTree(b *testing.B, files int, dupRatio float64) (string, int64) {
+	b.Helper()
+	root := b.TempDir()
+	total, err := synthtree.Generate(root, files, 64*1024, 100, dupRatio, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return root, total
+}
+
+func BenchmarkFindDuplicates(b *testing.B) {
+	for _, dup := range []float64{0.1, 0.5, 0.9} {
+		b.Run(fmt.Sprint("dup=", dup), func(b *testing.B) {
+			root, total := benchTree(b, 2000, dup)
+			b.SetBytes(total)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := FindDuplicates([]string{root}, Options{Quiet: true}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLinkSameDryRun(b *testing.B) {
+	root, total := benchTree(b, 2000, 0.5)
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := LinkSame([]string{root}, Options{Quiet: true}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngineScan(b *testing.B) {
+	root, total := benchTree(b, 2000, 0.5)
+	e := NewEngine(Options{Quiet: true})
+	if _, err := e.Scan([]string{root}); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Files are unchanged, so their kept hashes are reused.
+		if _, err := e.Scan([]string{root}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHashFile(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20, 64 << 20} {
+		b.Run(fmt.Sprint("size=", size), func(b *testing.B) {
+			name := filepath.Join(b.TempDir(), "f")
+			if err := os.WriteFile(name, make([]byte, size), 0o644); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := hashFile(name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
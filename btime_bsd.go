@@ -0,0 +1,27 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package linksame
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// haveBirthTime is true where the time files were created can be read.
+const haveBirthTime = true
+
+// birthTime returns the time the file was created, or false if it cannot be
+// found.
+func birthTime(file string) (time.Time, bool) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, false
+	}
+	bt := info.Sys().(*syscall.Stat_t).Birthtimespec
+	if bt.Sec == 0 && bt.Nsec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(bt.Sec), int64(bt.Nsec)), true
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// haveBirthTime is true where the time files were created can be read.
+const haveBirthTime = true
+
+// Flags and mask bits of statx.
+const (
+	atFdcwd    = -0x64
+	statxBtime = 0x800
+)
+
+// statx is struct statx.  Only the fields up to the birth time are used.
+type statx struct {
+	mask       uint32
+	blksize    uint32
+	attributes uint64
+	nlink      uint32
+	uid        uint32
+	gid        uint32
+	mode       uint16
+	_          uint16
+	ino        uint64
+	size       uint64
+	blocks     uint64
+	attrMask   uint64
+	atime      statxTimestamp
+	btime      statxTimestamp
+	_          [160]byte
+}
+
+// statxTimestamp is struct statx_timestamp.
+type statxTimestamp struct {
+	sec  int64
+	nsec uint32
+	_    int32
+}
+
+// birthTime returns the time the file was created, or false if the file
+// system does not record it.
+func birthTime(file string) (time.Time, bool) {
+	p, err := syscall.BytePtrFromString(file)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var stx statx
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(sysStatx, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		0, statxBtime, uintptr(unsafe.Pointer(&stx)), 0)
+	if errno != 0 || stx.mask&statxBtime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.btime.sec, int64(stx.btime.nsec)), true
+}
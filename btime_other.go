@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package linksame
+
+import "time"
+
+// haveBirthTime is false, since the time files were created cannot be read
+// on this platform.
+const haveBirthTime = false
+
+// birthTime returns false, since finding the time files were created is not
+// supported on this platform.
+func birthTime(file string) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,73 @@
+package linksame
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Capabilities describes what this build can do on the platform it runs on,
+// so that programs that run it can adapt the options they give it.
+type Capabilities struct {
+	// Version is the version of the module the program was built from, or
+	// "(devel)" if it was not built from a released version.
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	// Hash is the hash used to identify file contents.
+	Hash string `json:"hash"`
+	// Reflink is true if files can be reflinked, on file systems that
+	// support it.
+	Reflink bool `json:"reflink"`
+	// Xattr is true if hashes can be cached in extended attributes, on file
+	// systems that support them.
+	Xattr bool `json:"xattr"`
+	// IOUring is true if small files are read in batches with io_uring,
+	// which the kernel must allow.
+	IOUring bool `json:"io_uring"`
+	// SharedExtents is true if files that already share their data by
+	// reflink can be found.
+	SharedExtents bool `json:"shared_extents"`
+	// BirthTime is true if the time files were created can be read, for the
+	// oldest-created and newest-created keep policies.
+	BirthTime bool `json:"birth_time"`
+	// SparseHoles is true if the holes in sparse files can be found, rather
+	// than judging files sparse by the storage allocated to them.
+	SparseHoles bool `json:"sparse_holes"`
+	// WindowsLinks is true if hardlinks and symlinks can be made on Windows.
+	// Windows is not supported, so this is always false.
+	WindowsLinks bool `json:"windows_links"`
+	// KeepPolicies, Strategies, Scopes, and TargetStyles are the names
+	// accepted by ParseKeepPolicy, ParseStrategy, ParseScope, and
+	// ParseTargetStyle.
+	KeepPolicies []string `json:"keep_policies"`
+	Strategies   []string `json:"strategies"`
+	Scopes       []string `json:"scopes"`
+	TargetStyles []string `json:"target_styles"`
+}
+
+// GetCapabilities returns what this build can do on the platform it runs on.
+func GetCapabilities() Capabilities {
+	c := Capabilities{
+		Version:       "(devel)",
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Hash:          hashName,
+		Reflink:       haveReflink,
+		Xattr:         haveXattr,
+		SharedExtents: haveExtents,
+		BirthTime:     haveBirthTime,
+		SparseHoles:   haveHoles,
+		KeepPolicies:  keepNames,
+		Strategies:    strategyNames,
+		Scopes:        scopeNames,
+		TargetStyles:  targetStyleNames,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		c.Version = info.Main.Version
+	}
+	if br := newBatchReader(); br != nil {
+		br.close()
+		c.IOUring = true
+	}
+	return c
+}
@@ -0,0 +1,131 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Comparison is the result of comparing the files in two directory trees.
+// Files are named by their paths relative to the trees.
+type Comparison struct {
+	// Identical are the files that are in both trees with the same
+	// contents.
+	Identical []string `json:"identical"`
+	// Differing are the files that are in both trees with different
+	// contents.
+	Differing []string `json:"differing"`
+	// OnlyLeft and OnlyRight are the files that are only in the first
+	// tree, and only in the second.
+	OnlyLeft  []string `json:"only_left"`
+	OnlyRight []string `json:"only_right"`
+}
+
+// Compare compares the regular files at the same relative paths in the left
+// and right directory trees, by their size and hash.  Files that are hardlinks
+// to the same file are identical without being read.  Symlinks, and files at
+// paths that are not regular files in both trees, are not compared.  The
+// files in each list of the comparison are sorted.
+//
+// Only opts.Pattern, Extensions, NotExtensions, and XattrCache are used.
+// The identical files can be linked by passing the pairs of them to
+// LinkGroups.
+func Compare(left, right string, opts Options) (*Comparison, error) {
+	leftFiles, err := compareFiles(left, &opts)
+	if err != nil {
+		return nil, err
+	}
+	rightFiles, err := compareFiles(right, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Comparison
+	for rel, leftInfo := range leftFiles {
+		rightInfo, ok := rightFiles[rel]
+		if !ok {
+			c.OnlyLeft = append(c.OnlyLeft, rel)
+			continue
+		}
+		same, err := sameContents(filepath.Join(left, rel), leftInfo,
+			filepath.Join(right, rel), rightInfo, &opts)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			c.Identical = append(c.Identical, rel)
+		} else {
+			c.Differing = append(c.Differing, rel)
+		}
+	}
+	for rel := range rightFiles {
+		if _, ok := leftFiles[rel]; !ok {
+			c.OnlyRight = append(c.OnlyRight, rel)
+		}
+	}
+	sort.Strings(c.Identical)
+	sort.Strings(c.Differing)
+	sort.Strings(c.OnlyLeft)
+	sort.Strings(c.OnlyRight)
+	return &c, nil
+}
+
+// compareFiles returns the regular files selected by opts in the tree at
+// root, keyed by their paths relative to root.
+func compareFiles(root string, opts *Options) (map[string]os.FileInfo, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	files := map[string]os.FileInfo{}
+	err = walkTree(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintln(opts.errOut(), err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if opts.Pattern != "" {
+			if ok, err := filepath.Match(opts.Pattern, info.Name()); err != nil || !ok {
+				return err
+			}
+		}
+		if !opts.extSelected(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// sameContents reports whether two files have the same contents.
+func sameContents(file1 string, info1 os.FileInfo, file2 string, info2 os.FileInfo, opts *Options) (bool, error) {
+	if info1.Size() != info2.Size() {
+		return false, nil
+	}
+	if os.SameFile(info1, info2) || info1.Size() == 0 {
+		return true, nil
+	}
+	hash1, err := opts.cachedHashFile(file1, false)
+	if err != nil {
+		return false, err
+	}
+	hash2, err := opts.cachedHashFile(file2, false)
+	if err != nil {
+		return false, err
+	}
+	return hash1 == hash2, nil
+}
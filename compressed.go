@@ -0,0 +1,64 @@
+package linksame
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// isCompressed reports whether the file name has the extension of a
+// compressed file that can be decompressed.
+func isCompressed(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".bz2")
+}
+
+// reportCompressedCopies prints the files that are identical to the
+// decompressed contents of the compressed files.  Compressed files are only
+// read, and are never linked.
+func reportCompressedCopies(compressed []string, sizeFileMap map[int64][]string, opts *Options) {
+	copies := map[contentKey][]string{}
+	for _, name := range compressed {
+		h, size, err := hashDecompressed(name)
+		if err != nil {
+			fmt.Fprintln(opts.errOut(), "cannot decompress file:", err)
+			continue
+		}
+		if _, ok := sizeFileMap[size]; !ok || size > treeHashThreshold {
+			continue
+		}
+		key := contentKey{size, h}
+		copies[key] = append(copies[key], name)
+	}
+	printCopies(copies, sizeFileMap, "are compressed duplicates", opts)
+}
+
+// hashDecompressed returns the hash and size of the decompressed contents of
+// a compressed file.
+func hashDecompressed(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader
+	if strings.HasSuffix(name, ".bz2") {
+		r = bzip2.NewReader(f)
+	} else {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", 0, fmt.Errorf("%s: %w", name, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	h := newHash()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return string(h.Sum(nil)), size, nil
+}
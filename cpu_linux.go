@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// hasSHA2Instructions reports whether the CPU provides SHA-256 instructions:
+// SHA-NI on x86, or the SHA2 crypto extension on ARM.
+func hasSHA2Instructions() bool {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var flag string
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		flag = "sha_ni"
+	case "arm64", "arm":
+		flag = "sha2"
+	default:
+		return false
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+		key, val := strings.TrimSpace(line[:i]), line[i+1:]
+		if key != "flags" && key != "Features" {
+			continue
+		}
+		for _, f := range strings.Fields(val) {
+			if f == flag {
+				return true
+			}
+		}
+		// All CPUs are assumed to have the same features.
+		return false
+	}
+	return false
+}
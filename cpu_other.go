@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+import "runtime"
+
+// hasSHA2Instructions reports whether the CPU provides SHA-256 instructions.
+// Without a way to query the CPU, only platforms where these are always
+// present are reported.
+func hasSHA2Instructions() bool {
+	return runtime.GOOS == "darwin" && runtime.GOARCH == "arm64"
+}
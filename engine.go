@@ -0,0 +1,323 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Engine finds and links identical files with the same options, call after
+// call.  It keeps the files that it has found, the hashes of the files that
+// it has read, and the file systems of the devices that it has seen, so that
+// a program that looks for duplicates often only reads the files that are new
+// or changed since its last call, instead of starting from scratch as
+// LinkSame does.
+//
+// A kept hash is used while the file's size and modification time are the
+// same as when it was read, as with XattrCache.  A file modified in place
+// without changing these is not read again; use Verify, or set
+// Options.Verify, when this may happen.  Hashes are kept for the life of the
+// Engine.
+//
+// The methods of an Engine may be called from several goroutines, and run
+// one at a time.
+type Engine struct {
+	mu   sync.Mutex
+	opts Options
+}
+
+// NewEngine returns an Engine that uses the given options.  WriteLinks is
+// ignored: Apply writes links, and the other methods do not.
+func NewEngine(opts Options) *Engine {
+	opts.KeepHashes()
+	opts.devices = map[uint64]string{}
+	opts.index = &fileIndex{sizes: map[string]int64{}, paths: map[int64]map[string]bool{}}
+	return &Engine{opts: opts}
+}
+
+// KeepHashes makes runs with the options, and with copies of them made after
+// it is called, keep the hashes of the files that they read, and reuse them
+// in later runs while the files are unchanged, as an Engine does.  This lets
+// a dry run followed by a run that writes links read each file once.
+func (o *Options) KeepHashes() {
+	o.memo = &hashMemo{hashes: map[fileID]memoHash{}}
+}
+
+// Scan returns the groups of identical files in the directory trees, as
+// FindDuplicates does.  Files whose hashes are known from an earlier call,
+// and that have not changed since, are not read again.  The files found are
+// kept for Rescan.
+func (e *Engine) Scan(roots []string) ([]*DuplicateGroup, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return FindDuplicates(roots, e.opts)
+}
+
+// Rescan returns the groups of identical files that include a file in the
+// directory trees at paths, which are compared with the files found in
+// earlier calls to Scan and Rescan without walking the rest of their trees.
+// This is for programs that know where new files were added.  Files found
+// earlier, outside of paths, are only checked if they are the size of a file
+// in paths, and are only read again if they have changed.  Files removed
+// from outside of paths are not noticed until they are checked or are in
+// the trees of a later Scan.
+func (e *Engine) Rescan(paths []string) ([]*DuplicateGroup, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	paths, err := normalizeRoots(paths, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	abs := make([]string, len(paths))
+	for i := range paths {
+		abs[i] = absPath(paths[i])
+	}
+	opts := e.opts
+	opts.rescan = true
+	return findGroups(paths, &opts, func(g *DuplicateGroup) bool {
+		for _, f := range g.Files {
+			if withinRoots(absPath(f.Path), abs) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Plan returns a summary of what Apply would do with the groups, without
+// modifying any files.
+func (e *Engine) Plan(groups []*DuplicateGroup) (Summary, error) {
+	return e.link(groups, false)
+}
+
+// Apply replaces the files in each group with links to a single file in the
+// group, as LinkGroups does, and returns a summary of the results.
+func (e *Engine) Apply(groups []*DuplicateGroup) (Summary, error) {
+	return e.link(groups, true)
+}
+
+// link links the files in the groups, or only reports what would be linked
+// unless writeLinks is true.
+func (e *Engine) link(groups []*DuplicateGroup, writeLinks bool) (Summary, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	paths := make([][]string, len(groups))
+	for i, g := range groups {
+		paths[i] = g.Paths()
+	}
+	var sum Summary
+	opts := e.opts
+	opts.WriteLinks = writeLinks
+	opts.Summary = &sum
+	err := LinkGroups(paths, opts)
+	return sum, err
+}
+
+// Verify reads the files in each group again, and returns the groups with
+// only the files that are still identical to the first file of their group
+// that still has the group's hash.  Groups left with fewer than two files are
+// dropped.  Files that no longer exist are dropped, and the kept hashes of
+// files that changed are forgotten.
+func (e *Engine) Verify(groups []*DuplicateGroup) ([]*DuplicateGroup, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var verified []*DuplicateGroup
+	for _, g := range groups {
+		var same []string
+		var first os.FileInfo
+		for _, path := range g.Paths() {
+			info, err := os.Stat(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			if first == nil {
+				if g.Hash != "" {
+					h, err := e.opts.hashLike(path, g.Hash)
+					if err != nil {
+						return nil, err
+					}
+					if h != g.Hash {
+						e.opts.memo.forget(fileIDOf(info))
+						continue
+					}
+				}
+				first = info
+				same = append(same, path)
+				continue
+			}
+			ok, err := sameContents(same[0], first, path, info, &e.opts)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				e.opts.memo.forget(fileIDOf(info))
+				continue
+			}
+			same = append(same, path)
+		}
+		if len(same) > 1 {
+			verified = append(verified, newDuplicateGroup(g.Hash, first.Size(), same, e.opts.errOut()))
+		}
+	}
+	return verified, nil
+}
+
+// fileIndex holds the files found by an Engine, by size, so that files found
+// later can be compared with them.  Paths are absolute.
+type fileIndex struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+	paths map[int64]map[string]bool
+}
+
+// indexedFile is a file in a fileIndex.
+type indexedFile struct {
+	path string
+	size int64
+}
+
+// absPath returns the absolute path of the file, or the path as it is if
+// there is none.
+func absPath(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// add records the file of the given size.
+func (x *fileIndex) add(path string, size int64) {
+	if x == nil {
+		return
+	}
+	path = absPath(path)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.sizes[path]; ok {
+		if old == size {
+			return
+		}
+		delete(x.paths[old], path)
+	}
+	x.sizes[path] = size
+	if x.paths[size] == nil {
+		x.paths[size] = map[string]bool{}
+	}
+	x.paths[size][path] = true
+}
+
+// remove forgets the file.
+func (x *fileIndex) remove(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if size, ok := x.sizes[path]; ok {
+		delete(x.sizes, path)
+		delete(x.paths[size], path)
+	}
+}
+
+// removeUnder forgets the files in the directory trees at roots, which are
+// about to be walked again.
+func (x *fileIndex) removeUnder(roots []string) {
+	abs := make([]string, len(roots))
+	for i := range roots {
+		abs[i] = absPath(roots[i])
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for path, size := range x.sizes {
+		if withinRoots(path, abs) {
+			delete(x.sizes, path)
+			delete(x.paths[size], path)
+		}
+	}
+}
+
+// sameSize returns the files of the given sizes.
+func (x *fileIndex) sameSize(sizes map[int64]bool) []indexedFile {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var files []indexedFile
+	for size := range sizes {
+		for path := range x.paths[size] {
+			files = append(files, indexedFile{path, size})
+		}
+	}
+	return files
+}
+
+// hashLike hashes the file again, the same way as the file whose hash is
+// like, so that the two hashes can be compared.  Hashes cached in extended
+// attributes are not used, except with SlowStorage.
+func (o *Options) hashLike(file, like string) (string, error) {
+	if strings.HasPrefix(like, manifestPrefix) {
+		newHash, ok := hashForDigest(like[len(manifestPrefix):])
+		if !ok {
+			return "", fmt.Errorf("unrecognized digest length %d", len(like)-len(manifestPrefix))
+		}
+		h, err := sumFile(file, newHash)
+		return manifestPrefix + h, err
+	}
+	if o.SlowStorage {
+		return o.fileHash(file, false)
+	}
+	return hashFile(file)
+}
+
+// hashMemo holds the hashes of the files read by an Engine, for later calls.
+type hashMemo struct {
+	mu     sync.Mutex
+	hashes map[fileID]memoHash
+}
+
+// memoHash is the hash of a file, and the size and modification time of the
+// file when it was read.
+type memoHash struct {
+	size    int64
+	modTime int64
+	hash    string
+}
+
+// lookup returns the kept hash of the candidate file, if the file has not
+// changed since it was read.  Candidates whose tails are to be hashed are not
+// looked up, so that their tails are compared with those of other files that
+// may be identical to them.  A file modified after it was found, but before
+// it was read, has its hash kept with its earlier modification time, so the
+// hash is not used again.
+func (m *hashMemo) lookup(c candidate) (string, bool) {
+	if m == nil || c.tailOnly {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hashes[c.id]
+	if !ok || h.size != c.size || h.modTime != c.modTime {
+		return "", false
+	}
+	return h.hash, true
+}
+
+// keep records the hash of the file read for the candidate.
+func (m *hashMemo) keep(c candidate, hash string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.hashes[c.id] = memoHash{size: c.size, modTime: c.modTime, hash: hash}
+	m.mu.Unlock()
+}
+
+// forget drops the kept hash of the file.
+func (m *hashMemo) forget(id fileID) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.hashes, id)
+	m.mu.Unlock()
+}
@@ -0,0 +1,56 @@
+package linksame
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// escalation is an operation that needs privileges the user lacks, as a
+// shell command that replaces file while linking the group with the given ID.
+type escalation struct {
+	file, group, command string
+}
+
+// escalationCommand returns the shell command that replaces file f with a
+// link to baseFile, using the strategy.  Files are replaced as LinkSame would
+// replace them, with a symlink if a hardlink across devices is needed.
+func (o *Options) escalationCommand(f, baseFile string, strategy Strategy, crossDevice bool) (string, error) {
+	switch {
+	case strategy == StrategySymlink || strategy == StrategyHardlink && crossDevice:
+		source, err := o.symlinkSource(f, baseFile)
+		if errors.Is(err, errTargetTooLong) {
+			return "", err
+		}
+		return "ln -sf -- " + shellQuote(source) + " " + shellQuote(f), nil
+	case strategy == StrategyReflink:
+		return "cp --reflink=always --remove-destination -- " + shellQuote(baseFile) +
+			" " + shellQuote(f), nil
+	default:
+		return "ln -f -- " + shellQuote(baseFile) + " " + shellQuote(f), nil
+	}
+}
+
+// shellQuote quotes s for use as a single word in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeEscalations writes the operations that need privileges as a shell
+// script, sorted by the file replaced.
+func (s *stats) writeEscalations(w io.Writer) error {
+	sort.Slice(s.escalations, func(i, j int) bool {
+		return s.escalations[i].file < s.escalations[j].file
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#!/bin/sh")
+	fmt.Fprintln(bw, "# Files that linksame could not replace without privileges.")
+	fmt.Fprintln(bw, "# Review, and run as root, such as with sudo.")
+	for _, e := range s.escalations {
+		fmt.Fprintf(bw, "%s  # group %s\n", e.command, e.group)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// haveExtents is true where the extents of files can be read, to find files
+// that already share their data.
+const haveExtents = true
+
+// fsIocFiemap is the FS_IOC_FIEMAP ioctl, _IOWR('f', 11, struct fiemap).
+const fsIocFiemap = 0xc020660b
+
+// Flags of FIEMAP requests and extents.
+const (
+	fiemapFlagSync      = 0x1
+	fiemapExtentLast    = 0x1
+	fiemapExtentUnknown = 0x2
+	fiemapExtentDelaloc = 0x4
+	fiemapExtentShared  = 0x2000
+)
+
+// fiemapBatch is the number of extents requested at once, and maxExtents is
+// the most extents of a file that are compared.  Files with more are not
+// considered to share their data.
+const (
+	fiemapBatch = 256
+	maxExtents  = 1 << 16
+)
+
+// fiemap is struct fiemap, followed by room for its extents.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapBatch]fiemapExtent
+}
+
+// fiemapExtent is struct fiemap_extent.
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// extent is where a range of a file's data is stored.
+type extent struct {
+	logical, physical, length uint64
+}
+
+// fileExtents returns the extents of the file, or false if they cannot be
+// found or any extent is not shared with another file.
+func fileExtents(file string) ([]extent, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var extents []extent
+	var fm fiemap
+	var start uint64
+	for len(extents) < maxExtents {
+		fm = fiemap{
+			start:       start,
+			length:      ^uint64(0) - start,
+			flags:       fiemapFlagSync,
+			extentCount: fiemapBatch,
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap,
+			uintptr(unsafe.Pointer(&fm)))
+		if errno != 0 || fm.mappedExtents == 0 {
+			return nil, false
+		}
+		for _, e := range fm.extents[:fm.mappedExtents] {
+			if e.flags&fiemapExtentShared == 0 ||
+				e.flags&(fiemapExtentUnknown|fiemapExtentDelaloc) != 0 {
+				return nil, false
+			}
+			extents = append(extents, extent{e.logical, e.physical, e.length})
+			if e.flags&fiemapExtentLast != 0 {
+				return extents, true
+			}
+			start = e.logical + e.length
+		}
+	}
+	return nil, false
+}
+
+// sharedExtents reports whether the file shares all of its data with the
+// file whose extents are baseExtents, as files reflinked to each other do.
+func sharedExtents(baseExtents []extent, file string) bool {
+	if len(baseExtents) == 0 {
+		return false
+	}
+	extents, ok := fileExtents(file)
+	if !ok || len(extents) != len(baseExtents) {
+		return false
+	}
+	for i := range extents {
+		if extents[i] != baseExtents[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// haveExtents is false, since the extents of files cannot be read on this
+// platform.
+const haveExtents = false
+
+// extent is where a range of a file's data is stored.
+type extent struct {
+	logical, physical, length uint64
+}
+
+// fileExtents returns false, since finding the extents of files is not
+// supported on this platform.
+func fileExtents(file string) ([]extent, bool) {
+	return nil, false
+}
+
+// sharedExtents returns false, since finding whether files share data is not
+// supported on this platform.
+func sharedExtents(baseExtents []extent, file string) bool {
+	return false
+}
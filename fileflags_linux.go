@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// fsIocGetFlags is FS_IOC_GETFLAGS, _IOR('f', 1, long).
+	fsIocGetFlags = 0x80006601 | uintptr(unsafe.Sizeof(uintptr(0)))<<16
+
+	fsImmutableFl = 0x00000010 // FS_IMMUTABLE_FL
+	fsAppendFl    = 0x00000020 // FS_APPEND_FL
+)
+
+// isImmutable reports whether a file has the immutable or append-only
+// attribute set.  Such a file cannot be removed or hardlinked to.
+func isImmutable(file string) bool {
+	f, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var attr uintptr
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags,
+		uintptr(unsafe.Pointer(&attr)))
+	if errno != 0 {
+		return false
+	}
+	return attr&(fsImmutableFl|fsAppendFl) != 0
+}
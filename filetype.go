@@ -0,0 +1,128 @@
+package linksame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is the number of bytes read from the start of a file to detect its
+// content type.
+const sniffLen = 512
+
+// elfTypes maps the e_type field of an ELF header to a content type.
+var elfTypes = map[uint16]string{
+	1: "application/x-object",
+	2: "application/x-executable",
+	3: "application/x-sharedlib",
+	4: "application/x-core",
+}
+
+// contentType returns the MIME type of the file, without parameters, detected
+// from its first bytes.  Files of unknown type are application/octet-stream.
+func contentType(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return sniffContentType(buf[:n]), nil
+}
+
+// sniffContentType returns the MIME type, without parameters, of data that
+// starts with the given bytes.
+func sniffContentType(data []byte) string {
+	// ELF files are not known to http.DetectContentType.
+	if len(data) >= 18 && bytes.HasPrefix(data, []byte("\x7fELF")) {
+		var order binary.ByteOrder = binary.LittleEndian
+		if data[5] == 2 {
+			order = binary.BigEndian
+		}
+		if t, ok := elfTypes[order.Uint16(data[16:18])]; ok {
+			return t
+		}
+	}
+	t := http.DetectContentType(data)
+	if i := strings.IndexByte(t, ';'); i >= 0 {
+		t = t[:i]
+	}
+	return t
+}
+
+// typeSelected reports whether the file has one of the content types in
+// opts.Types, when these are specified.
+func (o *Options) typeSelected(file string) (bool, error) {
+	if len(o.Types) == 0 {
+		return true, nil
+	}
+	t, err := contentType(file)
+	if err != nil {
+		return false, err
+	}
+	return matchType(o.Types, t), nil
+}
+
+// matchType reports whether the content type t is one of types.  A type
+// without a subtype, such as "image", matches all of its subtypes.
+func matchType(types []string, t string) bool {
+	for _, want := range types {
+		if want == t || !strings.Contains(want, "/") && strings.HasPrefix(t, want+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// TempFilePatterns are patterns of the names of temporary files of editors
+// and download managers, which are not linked unless IncludeTempFiles is set.
+// Linking these confuses the programs that expect to replace or remove them.
+var TempFilePatterns = []string{
+	"*~", ".#*", "#*#", "*.swp", "*.swo", "*.tmp", "*.partial", "*.part", "*.crdownload",
+}
+
+// isTempFile reports whether the file name matches one of TempFilePatterns.
+func isTempFile(name string) bool {
+	for _, pattern := range TempFilePatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extSelected reports whether the file name ends in one of opts.Extensions,
+// when these are specified, and not in any of opts.NotExtensions, and is not
+// the name of a temporary file, unless opts.IncludeTempFiles is set.
+func (o *Options) extSelected(name string) bool {
+	if !o.IncludeTempFiles && isTempFile(name) {
+		return false
+	}
+	if len(o.Extensions) == 0 && len(o.NotExtensions) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	if len(o.Extensions) != 0 && !hasExt(name, o.Extensions) {
+		return false
+	}
+	return !hasExt(name, o.NotExtensions)
+}
+
+// hasExt reports whether the lower case name ends in one of the extensions.
+func hasExt(name string, exts []string) bool {
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if ext != "" && len(name) > len(ext)+1 && strings.HasSuffix(name, "."+ext) {
+			return true
+		}
+	}
+	return false
+}
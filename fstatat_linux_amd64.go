@@ -0,0 +1,8 @@
+package linksame
+
+import "syscall"
+
+const sysFstatat = syscall.SYS_NEWFSTATAT
+
+// sysStatx is the statx system call, which is not in package syscall.
+const sysStatx = 332
@@ -0,0 +1,164 @@
+package linksame
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// DuplicateGroup is a set of files that have identical contents.
+type DuplicateGroup struct {
+	// Hash is the hash of the file contents.  It is empty if the files were
+	// not hashed, such as for groups given to LinkGroups.
+	Hash string
+	// Size is the size of each file.
+	Size int64
+	// Files are the identical files.
+	Files []GroupFile
+}
+
+// GroupFile is a file in a DuplicateGroup.
+type GroupFile struct {
+	// Path is the path of the file.
+	Path string
+	// Info is the file information, from when the group was made.
+	Info os.FileInfo
+	// Device is the ID of the device containing the file.
+	Device uint64
+	// Inode is the inode number of the file.  Files with the same Device and
+	// Inode are hardlinks to the same file.
+	Inode uint64
+	// Links is the number of hardlinks to the file, including any outside of
+	// the group.
+	Links uint64
+}
+
+// newDuplicateGroup creates a DuplicateGroup of the files at the given paths.
+// Files that cannot be read are not included.  If hash is not empty, files
+// that are not of the given size, which have changed since they were hashed,
+// are not included either.  Files left out are reported to errOut.
+func newDuplicateGroup(hash string, size int64, paths []string, errOut io.Writer) *DuplicateGroup {
+	g := &DuplicateGroup{
+		Hash:  hash,
+		Size:  size,
+		Files: make([]GroupFile, 0, len(paths)),
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			continue
+		}
+		if hash != "" && info.Size() != size {
+			fmt.Fprintln(errOut, p, "changed size since it was hashed")
+			continue
+		}
+		sysStat := info.Sys().(*syscall.Stat_t)
+		g.Files = append(g.Files, GroupFile{
+			Path:   p,
+			Info:   info,
+			Device: deviceID(info),
+			Inode:  uint64(sysStat.Ino),
+			Links:  uint64(sysStat.Nlink),
+		})
+	}
+	return g
+}
+
+// Paths returns the paths of the files in the group.
+func (g *DuplicateGroup) Paths() []string {
+	paths := make([]string, len(g.Files))
+	for i := range g.Files {
+		paths[i] = g.Files[i].Path
+	}
+	return paths
+}
+
+// ID returns an identifier of the group, derived from the size and hash of
+// its files.  The same group has the same ID in verbose messages, reports,
+// and the journal, and in every run that finds it using the same hash.  A
+// group that was not hashed is identified by its size and the paths of its
+// files.
+func (g *DuplicateGroup) ID() string {
+	h := sha256.New()
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(g.Size))
+	h.Write(size[:])
+	if g.Hash != "" {
+		h.Write([]byte(g.Hash))
+	} else {
+		paths := g.Paths()
+		sort.Strings(paths)
+		for _, p := range paths {
+			h.Write([]byte(p))
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+// subset returns a group of the same files, with only the given paths.
+func (g *DuplicateGroup) subset(paths []string) *DuplicateGroup {
+	keep := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		keep[p] = struct{}{}
+	}
+	sub := &DuplicateGroup{Hash: g.Hash, Size: g.Size}
+	for _, f := range g.Files {
+		if _, ok := keep[f.Path]; ok {
+			sub.Files = append(sub.Files, f)
+		}
+	}
+	return sub
+}
+
+// Clusters returns the files in the group grouped by the inode they are
+// links to.  Files that are already hardlinked to each other are in the same
+// cluster.  Clusters are ordered largest first.
+func (g *DuplicateGroup) Clusters() [][]GroupFile {
+	index := map[fileID]int{}
+	var clusters [][]GroupFile
+	for _, f := range g.Files {
+		id := fileID{f.Device, f.Inode}
+		i, ok := index[id]
+		if !ok {
+			i = len(clusters)
+			index[id] = i
+			clusters = append(clusters, nil)
+		}
+		clusters[i] = append(clusters[i], f)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i]) > len(clusters[j])
+	})
+	return clusters
+}
+
+// Devices returns the IDs of the devices containing files in the group.
+func (g *DuplicateGroup) Devices() []uint64 {
+	var devs []uint64
+	seen := map[uint64]struct{}{}
+	for _, f := range g.Files {
+		if _, ok := seen[f.Device]; !ok {
+			seen[f.Device] = struct{}{}
+			devs = append(devs, f.Device)
+		}
+	}
+	return devs
+}
+
+// FeasibleStrategies returns the strategies that can link all files in the
+// group.  Symlinks can always be used.  Hardlinks and reflinks can only be
+// used if all files are on the same device, and reflinks also require file
+// system support which is not checked.
+func (g *DuplicateGroup) FeasibleStrategies() []Strategy {
+	if len(g.Devices()) > 1 {
+		return []Strategy{StrategySymlink, StrategyReportOnly}
+	}
+	return []Strategy{StrategyHardlink, StrategySymlink, StrategyReflink, StrategyReportOnly}
+}
@@ -0,0 +1,267 @@
+package linksame
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// newHash creates the hash used to identify file contents, SHA-256, so that
+// hashes are the same on every host, and hashName describes the
+// implementation used.
+var (
+	newHash  = sha256.New
+	hashName = selectHash()
+)
+
+// selectHash describes the SHA-256 implementation that is used.  The
+// standard library uses the CPU's instructions for SHA-256, where present,
+// and otherwise hashes in software.
+func selectHash() string {
+	if hasSHA2Instructions() {
+		return "sha256 (hardware accelerated)"
+	}
+	return "sha256 (software)"
+}
+
+// hashFile calculates a hash of the specified file.
+func hashFile(file string) (string, error) {
+	return hashFileWith(file, newHash)
+}
+
+// contentKey identifies the contents of a file by its size and hash.  Files
+// are only identical if both are the same, so keying by both keeps files of
+// different sizes from being grouped, whatever hash is used.
+type contentKey struct {
+	size int64
+	hash string
+}
+
+// hashXattr is the extended attribute used to cache the hash of a file.
+const hashXattr = "user.linksame.hash"
+
+// cachedHashFile calculates a hash of the specified file, or with
+// XattrCache, reads the hash cached in an extended attribute of the file.
+// The cached hash is only used if the file size and modification time are
+// the same as when it was cached, and it was produced by the same hash.  When
+// the hash is calculated, it is cached in the file's extended attribute.
+//
+// A SHA-1 digest cached by an older version, recognized by its length, is
+// still checked: the file is compared with it using SHA-1 as the file is
+// hashed again, and a file whose contents no longer match, though its size
+// and modification time do, is reported.  The SHA-1 digest is then replaced,
+// since it cannot be compared with the hashes of other files.
+//
+// If network is true, the file is on a network file system, and is read as
+// described for hashNetworkFile.
+func (o *Options) cachedHashFile(file string, network bool) (string, error) {
+	calc := hashFile
+	if network {
+		calc = hashNetworkFile
+	}
+	if !o.XattrCache {
+		return calc(file)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	// Cached value is size (8 bytes), mtime (8 bytes), digest.
+	val, err := getXattr(file, hashXattr)
+	if err == nil && len(val) > 16 {
+		size := int64(binary.BigEndian.Uint64(val))
+		mtime := int64(binary.BigEndian.Uint64(val[8:]))
+		digest := string(val[16:])
+		if size == info.Size() && mtime == info.ModTime().UnixNano() {
+			if len(digest) == newHash().Size() {
+				return digest, nil
+			}
+			if same, err := checkDigest(file, digest); err == nil && !same {
+				fmt.Fprintln(o.errOut(), "WARNING:", file,
+					"no longer matches its cached SHA-1 hash, though its size and modification time do")
+			}
+		}
+	}
+
+	h, err := calc(file)
+	if err != nil {
+		return "", err
+	}
+	val = make([]byte, 16, 16+len(h))
+	binary.BigEndian.PutUint64(val, uint64(info.Size()))
+	binary.BigEndian.PutUint64(val[8:], uint64(info.ModTime().UnixNano()))
+	val = append(val, h...)
+	// Ignore error, since file system may not support extended attributes
+	// or may be read-only.
+	setXattr(file, hashXattr, val)
+	return h, nil
+}
+
+// hashNetworkFile calculates a hash of a file on a network file system.  The
+// file is read with larger reads and fewer concurrent streams than a local
+// file, and reading is retried, with increasing delays, after transient
+// errors.
+func hashNetworkFile(file string) (string, error) {
+	delay := netRetryDelay
+	for i := 0; ; i++ {
+		h, err := hashFileOn(file, newHash, true)
+		if err == nil || i == netRetries || !isTransient(err) {
+			return h, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// hashFileWith calculates a hash of the specified file using the given hash.
+func hashFileWith(file string, newHash func() hash.Hash) (string, error) {
+	return hashFileOn(file, newHash, false)
+}
+
+// hashFileOn calculates a hash of the specified file using the given hash,
+// reading the file as suited to a local or network file system.  Local files
+// are opened without updating their access time, where possible.
+func hashFileOn(file string, newHash func() hash.Hash, network bool) (string, error) {
+	var f *os.File
+	var err error
+	if !network && openNoAtime != 0 {
+		// Fails if not the owner of the file, so fall back to a plain open.
+		f, err = os.OpenFile(file, os.O_RDONLY|openNoAtime, 0)
+	}
+	if f == nil {
+		f, err = os.Open(file)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	streams, bufSize := runtime.NumCPU(), 32*1024
+	if network {
+		streams, bufSize = netStreams, netBufferSize
+	}
+	if info.Size() > treeHashThreshold {
+		return treeHash(f, info.Size(), newHash, streams, bufSize)
+	}
+
+	h := newHash()
+	// Hide WriteTo, so that the buffer is used.
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{f}, make([]byte, bufSize)); err != nil {
+		return "", err
+	}
+
+	return string(h.Sum(nil)), nil
+}
+
+const (
+	// treeHashThreshold is the file size above which a file is hashed in
+	// chunks concurrently, instead of hashing the whole file in one stream.
+	treeHashThreshold = 1 << 30
+	// treeHashChunkSize is the size of each chunk hashed concurrently.
+	treeHashChunkSize = 128 << 20
+)
+
+// treeHash hashes chunks of a file concurrently, and then hashes the
+// concatenation of the chunk hashes to produce the hash of the file.  This
+// keeps a single huge file from serializing an otherwise parallel run.
+//
+// The result is not the same as hashing the file in a single stream, but
+// since all files of the same size are hashed the same way, identical files
+// still have the same hash.  Up to workers chunks are read at once, using
+// reads of bufSize bytes.
+func treeHash(f *os.File, size int64, newHash func() hash.Hash, workers, bufSize int) (string, error) {
+	chunks := int((size + treeHashChunkSize - 1) / treeHashChunkSize)
+	sums := make([][]byte, chunks)
+	errs := make([]error, chunks)
+
+	if workers > chunks {
+		workers = chunks
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufSize)
+			for i := range next {
+				h := newHash()
+				r := io.NewSectionReader(f, int64(i)*treeHashChunkSize, treeHashChunkSize)
+				if _, err := io.CopyBuffer(h, r, buf); err != nil {
+					errs[i] = err
+					continue
+				}
+				sums[i] = h.Sum(nil)
+			}
+		}()
+	}
+	for i := 0; i < chunks; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	h := newHash()
+	for i := range sums {
+		if errs[i] != nil {
+			return "", errs[i]
+		}
+		h.Write(sums[i])
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// hashForDigest returns the hash that produced a digest cached or listed by
+// this or an older version, determined by the length of the digest.  Older
+// versions used SHA-1.
+func hashForDigest(digest string) (func() hash.Hash, bool) {
+	switch len(digest) {
+	case sha256.Size:
+		return sha256.New, true
+	case sha1.Size:
+		return sha1.New, true
+	}
+	return nil, false
+}
+
+// checkDigest reports whether the file contents match a digest cached or
+// listed by this or an older version, using whichever hash produced it.  The
+// whole file is hashed in one stream, as older versions did for files of any
+// size.
+func checkDigest(file, digest string) (bool, error) {
+	newHash, ok := hashForDigest(digest)
+	if !ok {
+		return false, fmt.Errorf("unrecognized digest length %d", len(digest))
+	}
+	h, err := sumFile(file, newHash)
+	if err != nil {
+		return false, err
+	}
+	return h == digest, nil
+}
+
+// sumFile returns the hash of the file, using the given hash, as the sum
+// commands such as sha256sum calculate it.
+func sumFile(file string, newHash func() hash.Hash) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
@@ -0,0 +1,108 @@
+package linksame
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Run is a run that wrote links, as recorded in a journal.
+type Run struct {
+	Start time.Time `json:"start"`
+	User  string    `json:"user,omitempty"`
+	Host  string    `json:"host,omitempty"`
+	Roots []string  `json:"roots,omitempty"`
+	// Summary is the summary of the run, or nil if the end of the run was
+	// not recorded because it was interrupted.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Saved returns the bytes freed by the run, less the space taken by the
+// symlinks it created.
+func (r *Run) Saved() int64 {
+	if r.Summary == nil {
+		return 0
+	}
+	return r.Summary.Linked.Bytes - r.Summary.SymlinkOverhead
+}
+
+// JournalHistory reads the runs recorded in the journal read from r, oldest
+// first.  The journal is verified as VerifyJournal does, and an error is
+// returned if it has been tampered with.
+func JournalHistory(r io.Reader) ([]Run, error) {
+	var runs []Run
+	_, _, err := readJournal(r, func(line []byte) error {
+		var e struct {
+			Time    time.Time `json:"time"`
+			Event   string    `json:"event"`
+			User    string    `json:"user"`
+			Host    string    `json:"host"`
+			Roots   []string  `json:"roots"`
+			Summary *Summary  `json:"summary"`
+		}
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		switch e.Event {
+		case journalStart:
+			runs = append(runs, Run{
+				Start: e.Time,
+				User:  e.User,
+				Host:  e.Host,
+				Roots: e.Roots,
+			})
+		case journalEnd:
+			// The end of a run follows its start, since runs that share a
+			// journal cannot write to it at the same time.
+			if len(runs) != 0 && runs[len(runs)-1].Summary == nil {
+				runs[len(runs)-1].Summary = e.Summary
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// WriteHistory writes the runs as an aligned table, with the space saved by
+// each run and the total saved by it and the runs before it.  Sizes are
+// written as selected by f.
+func WriteHistory(w io.Writer, runs []Run, f SizeFormat) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Started\tHost\tRoots\tLinked\tSaved\tCumulative\t")
+	var total int64
+	for i := range runs {
+		r := &runs[i]
+		total += r.Saved()
+		linked := "interrupted"
+		if r.Summary != nil {
+			linked = fmt.Sprint(r.Summary.Linked.Files, " files")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			r.Start.Local().Format("2006-01-02 15:04"), r.Host,
+			strings.Join(r.Roots, " "), linked, f.Format(r.Saved()), f.Format(total))
+	}
+	tw.Flush()
+
+	// Remove the padding after the last column of each row.
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, len(runs), "runs saved", f.Format(total))
+	return err
+}
@@ -0,0 +1,144 @@
+package linksame
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReadReportGroups reads the JSON report written by lnsame -json, and returns
+// the groups of identical files it lists, for use with LinkGroups.  The files
+// are not found again, so the groups can be linked without a rescan.
+func ReadReportGroups(r io.Reader) ([][]string, error) {
+	groups, _, err := ReadReportGroupIDs(r)
+	return groups, err
+}
+
+// ReadReportGroupIDs reads the JSON report written by lnsame -json as
+// ReadReportGroups does, and also returns the ID of each group, as returned
+// by DuplicateGroup.ID when the report was written.
+func ReadReportGroupIDs(r io.Reader) ([][]string, []string, error) {
+	var report struct {
+		Groups []GroupReport `json:"groups"`
+	}
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, nil, fmt.Errorf("cannot read report: %w", err)
+	}
+	groups := make([][]string, 0, len(report.Groups))
+	ids := make([]string, 0, len(report.Groups))
+	for _, g := range report.Groups {
+		if len(g.Paths) > 1 {
+			groups = append(groups, g.Paths)
+			ids = append(ids, g.ID)
+		}
+	}
+	return groups, ids, nil
+}
+
+// ReadRmlintGroups reads the JSON output of rmlint (rmlint -o json) and
+// returns the groups of duplicate files it lists, for use with LinkGroups.
+func ReadRmlintGroups(r io.Reader) ([][]string, error) {
+	groups, _, err := ReadRmlintGroupIDs(r)
+	return groups, err
+}
+
+// ReadRmlintGroupIDs reads the JSON output of rmlint as ReadRmlintGroups
+// does, and also returns the ID of each group, which is the checksum that
+// rmlint lists for its files.
+func ReadRmlintGroupIDs(r io.Reader) ([][]string, []string, error) {
+	var entries []struct {
+		Type     string `json:"type"`
+		Path     string `json:"path"`
+		Checksum string `json:"checksum"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, nil, fmt.Errorf("cannot read rmlint output: %w", err)
+	}
+
+	type key struct {
+		checksum string
+		size     int64
+	}
+	groupMap := map[key][]string{}
+	var keys []key
+	for _, e := range entries {
+		if e.Type != "duplicate_file" || e.Path == "" {
+			continue
+		}
+		k := key{e.Checksum, e.Size}
+		if _, ok := groupMap[k]; !ok {
+			keys = append(keys, k)
+		}
+		groupMap[k] = append(groupMap[k], e.Path)
+	}
+	groups := make([][]string, 0, len(keys))
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		groups = append(groups, groupMap[k])
+		ids = append(ids, k.checksum)
+	}
+	return groups, ids, nil
+}
+
+// ReadRdfindGroups reads the results file written by rdfind (results.txt)
+// and returns the groups of duplicate files it lists, for use with
+// LinkGroups.
+func ReadRdfindGroups(r io.Reader) ([][]string, error) {
+	groups, _, err := ReadRdfindGroupIDs(r)
+	return groups, err
+}
+
+// ReadRdfindGroupIDs reads the results file written by rdfind as
+// ReadRdfindGroups does, and also returns the ID of each group, which is the
+// id that rdfind gives the first file of the group.
+func ReadRdfindGroupIDs(r io.Reader) ([][]string, []string, error) {
+	// Each line is: duptype id depth size device inode priority name
+	// The first occurrence of a file has a positive id, and its duplicates
+	// have the negative of that id.
+	groupMap := map[int64][]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 8)
+		if len(fields) != 8 {
+			return nil, nil, fmt.Errorf("rdfind results line %d: expected 8 fields", lineNum)
+		}
+		id, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rdfind results line %d: %w", lineNum, err)
+		}
+		if id < 0 {
+			id = -id
+		}
+		groupMap[id] = append(groupMap[id], fields[7])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int64, 0, len(groupMap))
+	for id := range groupMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	groups := make([][]string, 0, len(ids))
+	groupIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if len(groupMap[id]) > 1 {
+			groups = append(groups, groupMap[id])
+			groupIDs = append(groupIDs, strconv.FormatInt(id, 10))
+		}
+	}
+	return groups, groupIDs, nil
+}
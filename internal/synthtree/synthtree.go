@@ -0,0 +1,44 @@
+// Package synthtree generates synthetic directory trees with duplicate files,
+// for measuring how fast duplicates are found.
+package synthtree
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// Generate creates files in directories under root, perDir files in each,
+// where each file is a duplicate of a previous file with probability
+// dupRatio.  Files that are not duplicates are from 1 to maxSize bytes of
+// random data.  The same seed generates the same tree.  It returns the total
+// size of the files.
+func Generate(root string, files, maxSize, perDir int, dupRatio float64, seed int64) (int64, error) {
+	rng := rand.New(rand.NewSource(seed))
+	var unique [][]byte
+	var total int64
+	var dir string
+	for i := 0; i < files; i++ {
+		if i%perDir == 0 {
+			dir = filepath.Join(root, fmt.Sprintf("d%d", i/perDir))
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				return 0, err
+			}
+		}
+		var data []byte
+		if len(unique) != 0 && rng.Float64() < dupRatio {
+			data = unique[rng.Intn(len(unique))]
+		} else {
+			data = make([]byte, 1+rng.Intn(maxSize))
+			rng.Read(data)
+			unique = append(unique, data)
+		}
+		name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			return 0, err
+		}
+		total += int64(len(data))
+	}
+	return total, nil
+}
@@ -0,0 +1,319 @@
+package linksame
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Journal is an append-only record of runs that modify files, and of each
+// modification made, for use as an audit trail.
+//
+// Each line of the journal is a JSON object.  Every line holds the SHA-256
+// hash of the line before it, so that changing, removing, or reordering any
+// line, other than the last, breaks the chain and is detected by
+// VerifyJournal.  To also detect changes to the last line, record the hash
+// returned by VerifyJournal elsewhere.
+//
+// Replacing a file is recorded twice: an intent record, with the state of
+// the file, is on storage before the file is touched, and a completion
+// record, with any error, follows once the file is replaced or left in
+// place.  A file whose intent record has no completion record may have been
+// replaced by a run that was interrupted.
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	prev string
+	err  error
+}
+
+// journalEntry is one line of the journal.
+type journalEntry struct {
+	Seq   int64     `json:"seq"`
+	Time  time.Time `json:"time"`
+	Prev  string    `json:"prev"`
+	Event string    `json:"event"`
+
+	// Run start.
+	User    string   `json:"user,omitempty"`
+	UID     string   `json:"uid,omitempty"`
+	Host    string   `json:"host,omitempty"`
+	PID     int      `json:"pid,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Roots   []string `json:"roots,omitempty"`
+	Options *Options `json:"options,omitempty"`
+
+	// File modification.  Phase is journalIntent or journalDone for a
+	// modification recorded before and after it is made, and Intent is the
+	// sequence number of the intent record that a completion record
+	// completes.
+	Group  string     `json:"group,omitempty"`
+	Path   string     `json:"path,omitempty"`
+	Target string     `json:"target,omitempty"`
+	Phase  string     `json:"phase,omitempty"`
+	Intent int64      `json:"intent,omitempty"`
+	Before *fileState `json:"before,omitempty"`
+	Error  string     `json:"error,omitempty"`
+
+	// Run end.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// fileState is the state of a file before it was modified.
+type fileState struct {
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	UID     uint32    `json:"uid"`
+	GID     uint32    `json:"gid"`
+	Dev     uint64    `json:"dev"`
+	Ino     uint64    `json:"ino"`
+	Nlink   uint64    `json:"nlink"`
+	Hash    string    `json:"hash,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// Journal events.
+const (
+	journalStart    = "start"
+	journalEnd      = "end"
+	journalLink     = "hardlink"
+	journalSymlink  = "symlink"
+	journalReflink  = "reflink"
+	journalRollback = "rollback"
+	journalRewrite  = "rewrite-symlink"
+	journalMetadata = "set-metadata"
+)
+
+// Phases of a modification recorded before and after it is made.
+const (
+	journalIntent = "intent"
+	journalDone   = "done"
+)
+
+// OpenJournal opens the journal file, creating it if it does not exist, for
+// appending.  The existing contents are verified first, and the journal is
+// not opened if they have been tampered with.
+func OpenJournal(name string) (*Journal, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	seq, prev, err := verifyJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("journal %s: %w", name, err)
+	}
+	return &Journal{file: f, seq: seq, prev: prev}, nil
+}
+
+// Close closes the journal file, and returns any error that occurred while
+// writing to the journal.
+func (j *Journal) Close() error {
+	err := j.file.Close()
+	if j.err != nil {
+		return j.err
+	}
+	return err
+}
+
+// VerifyJournal checks that the hash chain of the journal read from r is
+// intact.  It returns the hash of the last line, which may be recorded
+// elsewhere to detect later changes to the last line.
+func VerifyJournal(r io.Reader) (string, error) {
+	_, prev, err := verifyJournal(r)
+	return prev, err
+}
+
+func verifyJournal(r io.Reader) (int64, string, error) {
+	return readJournal(r, nil)
+}
+
+// readJournal reads the journal from r, checking that its hash chain is
+// intact, and calls fn, if not nil, with each line.  It returns the sequence
+// number and hash of the last line.
+func readJournal(r io.Reader, fn func(line []byte) error) (int64, string, error) {
+	var seq int64
+	var prev string
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 {
+			if line[len(line)-1] != '\n' {
+				return 0, "", fmt.Errorf("line %d is incomplete", seq+1)
+			}
+			var e struct {
+				Seq  int64  `json:"seq"`
+				Prev string `json:"prev"`
+			}
+			if err := json.Unmarshal(line, &e); err != nil {
+				return 0, "", fmt.Errorf("line %d: %w", seq+1, err)
+			}
+			if e.Seq != seq+1 || e.Prev != prev {
+				return 0, "", fmt.Errorf("line %d does not follow the line before it", seq+1)
+			}
+			seq = e.Seq
+			prev = lineHash(line)
+			if fn != nil {
+				if err := fn(line); err != nil {
+					return 0, "", fmt.Errorf("line %d: %w", seq, err)
+				}
+			}
+		}
+		if err == io.EOF {
+			return seq, prev, nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+	}
+}
+
+// lineHash returns the hash of a journal line, including its newline.
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// record appends an entry to the journal, and returns its sequence number.
+// After an error, nothing more is written, record returns 0, and failed
+// returns the error.
+func (j *Journal) record(e *journalEntry) int64 {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return 0
+	}
+	e.Seq = j.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = j.prev
+	line, err := json.Marshal(e)
+	if err != nil {
+		j.err = err
+		return 0
+	}
+	line = append(line, '\n')
+	if _, err = j.file.Write(line); err == nil {
+		// Each entry must be on storage before the modification it records
+		// is followed by others.
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.err = fmt.Errorf("cannot write journal: %w", err)
+		return 0
+	}
+	j.seq = e.Seq
+	j.prev = lineHash(line)
+	return e.Seq
+}
+
+// failed returns the error that stopped writing to the journal, if any.
+// Callers check it before modifying a file, after recording their intent to,
+// and do not modify the file if the journal has failed, so that no
+// modification is made without an intent record on storage.
+func (j *Journal) failed() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// start records the start of a run, if the run writes links.
+func (j *Journal) start(roots []string, opts *Options) {
+	if j == nil || !opts.WriteLinks {
+		return
+	}
+	e := &journalEntry{
+		Event:   journalStart,
+		UID:     fmt.Sprint(os.Getuid()),
+		PID:     os.Getpid(),
+		Command: os.Args,
+		Roots:   roots,
+		Options: opts,
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	e.Host, _ = os.Hostname()
+	j.record(e)
+}
+
+// end records the end of a run and its summary, if the run wrote links.
+func (j *Journal) end(sum *Summary) {
+	if sum.DryRun {
+		return
+	}
+	j.record(&journalEntry{Event: journalEnd, Summary: sum})
+}
+
+// intend records that file is about to be modified, while linking the group
+// with the given ID, if any, and returns the sequence number of the record,
+// to be passed to done.  The before state is the state of the file now.  The
+// file must not be modified if failed returns an error afterward.
+func (j *Journal) intend(event, group, file, target string, before *fileState) int64 {
+	return j.record(&journalEntry{Event: event, Group: group, Path: file, Target: target,
+		Phase: journalIntent, Before: before})
+}
+
+// done records the completion of the modification whose intent was recorded
+// with the given sequence number, as event, which may differ from the event
+// intended, such as when a hardlink falls back to a symlink.  If err is not
+// nil, the file was left as it was.
+func (j *Journal) done(intent int64, event, group, file, target string, err error) {
+	if j == nil || intent == 0 {
+		return
+	}
+	e := &journalEntry{Event: event, Group: group, Path: file, Target: target,
+		Phase: journalDone, Intent: intent}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.record(e)
+}
+
+// modified records a modification of file, while linking the group with the
+// given ID, if any, in a single record written after it is made.  This is
+// used for modifications that are made even when the journal has failed,
+// such as rolling back.  The before state must be taken before the file was
+// modified.
+func (j *Journal) modified(event, group, file, target string, before *fileState, err error) {
+	if j == nil {
+		return
+	}
+	e := &journalEntry{Event: event, Group: group, Path: file, Target: target, Before: before}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.record(e)
+}
+
+// stateOf returns the state of a file, described by info, for the journal.
+// The hash is that of the file contents, if known.
+func stateOf(info os.FileInfo, hash string) *fileState {
+	st := info.Sys().(*syscall.Stat_t)
+	return &fileState{
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime().UTC(),
+		UID:     st.Uid,
+		GID:     st.Gid,
+		Dev:     uint64(st.Dev),
+		Ino:     uint64(st.Ino),
+		Nlink:   uint64(st.Nlink),
+		Hash:    hex.EncodeToString([]byte(hash)),
+	}
+}
@@ -0,0 +1,118 @@
+package linksame
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeJournal writes a journal of a run that replaced two files, and returns
+// its name.
+func writeJournal(t *testing.T) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{WriteLinks: true}
+	j.start([]string{"/root"}, opts)
+	for _, file := range []string{"/root/a", "/root/b"} {
+		intent := j.intend(journalLink, "group", file, "/root/c", &fileState{Size: 1})
+		j.done(intent, journalLink, "group", file, "/root/c", nil)
+	}
+	j.end(&Summary{Linked: FileCount{2, 2}})
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestVerifyJournal(t *testing.T) {
+	name := writeJournal(t)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := VerifyJournal(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) != 6 {
+		t.Fatalf("journal has %d lines, want 6", len(lines))
+	}
+	if head != lineHash([]byte(lines[len(lines)-1])) {
+		t.Error("VerifyJournal did not return the hash of the last line")
+	}
+
+	// Reopening continues the chain.
+	j, err := OpenJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.end(&Summary{})
+	j.Close()
+	data, _ = os.ReadFile(name)
+	if _, err = VerifyJournal(bytes.NewReader(data)); err != nil {
+		t.Error("appended journal:", err)
+	}
+
+	tampered := map[string]string{
+		"changed":   strings.Join(lines[:2], "") + strings.Replace(lines[2], "/root/a", "/root/x", 1) + strings.Join(lines[3:], ""),
+		"removed":   strings.Join(lines[:2], "") + strings.Join(lines[3:], ""),
+		"reordered": lines[0] + lines[2] + lines[1] + strings.Join(lines[3:], ""),
+		"cut short": strings.Join(lines, "")[:len(strings.Join(lines, ""))-1],
+	}
+	for desc, journal := range tampered {
+		if _, err := VerifyJournal(strings.NewReader(journal)); err == nil {
+			t.Errorf("%s journal verified", desc)
+		}
+	}
+
+	// A journal that has been tampered with is not opened.
+	if err = os.WriteFile(name, []byte(tampered["removed"]), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenJournal(name); err == nil {
+		t.Error("opened a journal that was tampered with")
+	}
+}
+
+func TestJournalIntent(t *testing.T) {
+	name := writeJournal(t)
+	var phases []string
+	_, _, err := readJournal(mustOpen(t, name), func(line []byte) error {
+		switch {
+		case bytes.Contains(line, []byte(`"phase":"intent"`)):
+			if !bytes.Contains(line, []byte(`"before":`)) {
+				return errors.New("intent record without the state of the file")
+			}
+			phases = append(phases, journalIntent)
+		case bytes.Contains(line, []byte(`"phase":"done"`)):
+			phases = append(phases, journalDone)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{journalIntent, journalDone, journalIntent, journalDone}
+	if strings.Join(phases, " ") != strings.Join(want, " ") {
+		t.Errorf("phases %v, want %v", phases, want)
+	}
+}
+
+func mustOpen(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
@@ -0,0 +1,177 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// KeepPolicy selects which file, of a set of identical files, is kept as the
+// file that the others are linked to.
+type KeepPolicy int
+
+const (
+	// KeepDefault uses KeepCluster when creating hardlinks, and
+	// KeepLongestName when creating symlinks.
+	KeepDefault KeepPolicy = iota
+	// KeepLongestName keeps the file with the longest name.  This only
+	// matters for symlinks, but since a failed hardlink can result in a
+	// symlink, it is used for hardlinks as well.
+	KeepLongestName
+	// KeepCluster keeps a file that is already hardlinked to the most other
+	// files in the set, so that the fewest files are replaced.  Of the files
+	// in that cluster, the one with the longest name is kept.
+	KeepCluster
+	// KeepOldestCreated keeps the file created first.  Where the file system
+	// does not record when files were created, the file modified first is
+	// kept instead.
+	KeepOldestCreated
+	// KeepNewestCreated keeps the file created last, or else the file
+	// modified last, as KeepOldestCreated does.
+	KeepNewestCreated
+)
+
+var keepNames = []string{"default", "name", "cluster", "oldest-created", "newest-created"}
+
+func (k KeepPolicy) String() string {
+	if k < 0 || int(k) >= len(keepNames) {
+		return fmt.Sprintf("KeepPolicy(%d)", int(k))
+	}
+	return keepNames[k]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k KeepPolicy) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// ParseKeepPolicy returns the KeepPolicy with the given name: "name",
+// "cluster", "oldest-created", or "newest-created".
+func ParseKeepPolicy(name string) (KeepPolicy, error) {
+	for i := range keepNames {
+		if name == keepNames[i] {
+			return KeepPolicy(i), nil
+		}
+	}
+	return KeepDefault, fmt.Errorf("unknown keep policy %q", name)
+}
+
+// sortByKeep orders files so that the file to keep is first.
+func sortByKeep(files []string, opts *Options) {
+	// Sort files by longest name, or longest path if names are the same.
+	sort.Slice(files, func(i, j int) bool {
+		return betterBase(files[i], files[j], opts.PreferShallow)
+	})
+
+	keep := opts.Keep
+	if keep == KeepDefault {
+		if opts.Symlink {
+			keep = KeepLongestName
+		} else {
+			keep = KeepCluster
+		}
+	}
+	switch keep {
+	case KeepOldestCreated, KeepNewestCreated:
+		sortByCreated(files, keep == KeepNewestCreated)
+	case KeepCluster:
+		sortByCluster(files)
+	}
+	keepInDirs(files, opts.KeepDirs)
+}
+
+// keepInDirs moves the first file within the first of dirs that has one to
+// the front of files.
+func keepInDirs(files []string, dirs []string) {
+	for _, dir := range dirs {
+		canonDir := []string{canonicalPath(dir)}
+		for i, f := range files {
+			if withinRoots(canonicalPath(f), canonDir) {
+				copy(files[1:i+1], files[:i])
+				files[0] = f
+				return
+			}
+		}
+	}
+}
+
+// sortByCluster moves the file that is already hardlinked to the most other
+// files in the set to the front of files.
+func sortByCluster(files []string) {
+	// Count the files that are links to each inode, and find the first
+	// file, in name order, of the inode with the most.
+	counts := make(map[fileID]int, len(files))
+	keys := make([]fileID, len(files))
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		keys[i] = fileIDOf(info)
+		counts[keys[i]]++
+	}
+	best := 0
+	for i := range files {
+		if counts[keys[i]] > counts[keys[best]] {
+			best = i
+		}
+	}
+	if best != 0 {
+		f := files[best]
+		copy(files[1:best+1], files[:best])
+		files[0] = f
+	}
+}
+
+// betterBase reports whether path p is preferred over path q as the base
+// file that other files are linked to.  The path with the longest base name is
+// preferred.  If the base names are the same length, the path with the
+// longest path is preferred, or the shortest path if shallow is true.  If the
+// paths are also the same length, the lexicographically first is preferred
+// so that the choice is deterministic.
+func betterBase(p, q string, shallow bool) bool {
+	pBaseLen := len(path.Base(p))
+	qBaseLen := len(path.Base(q))
+	if pBaseLen != qBaseLen {
+		return pBaseLen > qBaseLen
+	}
+	// Base names are the same length, so look at path.
+	if len(p) != len(q) {
+		if shallow {
+			return len(p) < len(q)
+		}
+		return len(p) > len(q)
+	}
+	return p < q
+}
+
+// sortByCreated orders files by the time they were created, oldest first, or
+// newest first if newest is true.  Files created at the same time keep their
+// order.  Files that cannot be stat'ed are last.
+func sortByCreated(files []string, newest bool) {
+	times := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		t, ok := birthTime(f)
+		if !ok {
+			info, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			t = info.ModTime()
+		}
+		times[f] = t
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ti, iok := times[files[i]]
+		tj, jok := times[files[j]]
+		if iok != jok {
+			return iok
+		}
+		if newest {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// pathMax is the size of the longest path, including its terminating null
+// byte, that system calls accept on most other platforms.
+const pathMax = 1024
@@ -28,24 +28,366 @@ will be changed so that there is only one instance of the file:
 package linksame
 
 import (
-	"crypto/sha1"
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// Options configures how identical files are found and linked.
+type Options struct {
+	// Pattern, if not empty, limits the search to files with names matching
+	// the pattern.
+	Pattern string
+	// Extensions, if not empty, limits the search to files with names ending
+	// in one of these extensions, such as "jpg" or "tar.gz".  NotExtensions
+	// excludes files with names ending in any of its extensions.  Extensions
+	// are matched without regard to case, and may be given with or without
+	// the leading dot.
+	Extensions    []string
+	NotExtensions []string
+	// WriteLinks creates links in the file system.  If false, only report
+	// what would have been done.
+	WriteLinks bool
+	// Symlink creates symlinks instead of hardlinks.  Symlinks are also used
+	// if hardlinks fail.
+	Symlink bool
+	// Absolute creates absolute instead of relative symlinks.
+	Absolute bool
+	// Safe only links files that have the same permission and ownership.
+	Safe bool
+	// Quiet suppresses output about links created and size saved.
+	Quiet bool
+	// Verbose prints output about individual link creation.
+	Verbose bool
+	// XattrCache caches the hash of each file, along with its size and
+	// modification time, in a user extended attribute of the file.  Later
+	// runs do not need to hash files that have not changed.  This is done
+	// even when not writing links.
+	XattrCache bool
+	// AllowPrivileged permits linking setuid, setgid, and capability-bearing
+	// files.  By default these are skipped, since linking them can give
+	// elevated privileges to files at other locations.
+	AllowPrivileged bool
+	// Sync flushes each directory to stable storage after a file in it is
+	// replaced by a link, and flushes the contents of restored files, so that
+	// a power loss cannot leave a directory missing entries.
+	Sync bool
+	// Transactional makes linking each set of identical files all or
+	// nothing.  Each file is moved aside, instead of being removed, until all
+	// files in the set are linked.  If any file fails, the files already
+	// linked are restored from the moved files.
+	Transactional bool
+	// RewriteSymlinks rewrites existing symlinks to files within the roots
+	// to be absolute or relative, as specified by Absolute, when creating
+	// symlinks.  Such symlinks are always counted as already linked.
+	RewriteSymlinks bool
+	// Keep selects which file, of a set of identical files, is kept as the
+	// file that the others are linked to.
+	Keep KeepPolicy
+	// PreferShallow keeps the file with the shortest path, instead of the
+	// longest, when files have names of the same length.
+	PreferShallow bool
+	// KeepDirs, if not empty, keeps a file within the first of these
+	// directories that has one of a set of identical files, whatever the
+	// Keep policy, so that the files elsewhere are linked to it.
+	KeepDirs []string
+	// Strategies maps directories, such as mount points, to the strategy for
+	// replacing duplicate files within them.  The strategy for the most
+	// specific directory containing a file is used.  Files not in any of
+	// these directories use StrategyDefault.
+	Strategies map[string]Strategy
+	// NameStrategies maps file patterns to the strategy for replacing
+	// duplicate files that match them, such as "*.iso" to only report
+	// duplicate disk images while linking other files.  Patterns containing
+	// a path separator are matched against the absolute path of each file,
+	// and others are matched against the file name.  A matching pattern
+	// takes precedence over Strategies.  If more than one pattern matches,
+	// the longest is used.
+	NameStrategies map[string]Strategy
+	// MaxSymlinkTarget, if not zero, is the length of the longest symlink
+	// target to create.  If zero, this is the longest path the system
+	// accepts.  With TargetAuto, when a relative target would be longer, an
+	// absolute target is used instead, and the reverse when Absolute is set.
+	// Files whose targets are too long are not replaced.
+	MaxSymlinkTarget int
+	// SymlinkAnchor, if not empty, is a directory that relative symlink
+	// targets pass through: a target climbs from the symlink's directory up
+	// to the anchor, and descends from there to the file linked to, instead
+	// of taking the shortest route.  Such symlinks keep working when the
+	// directory containing them is moved elsewhere at the same depth below
+	// the anchor, as well as when the whole anchor is moved.  Symlinks to
+	// files outside of the anchor are relative to their directory as usual.
+	SymlinkAnchor string
+	// AnchorAtRoot uses the root containing each symlink as its anchor, as
+	// for SymlinkAnchor.
+	AnchorAtRoot bool
+	// TargetStyle selects the form of the targets of symlinks created.  The
+	// default, TargetAuto, uses Absolute to select relative or absolute
+	// targets.  Other styles ignore Absolute, and are used even when a target
+	// would be shorter in another form.
+	TargetStyle TargetStyle
+	// SymlinkMetadata selects how the mode and ownership of a file that other
+	// files are replaced with symlinks to is set, so that the replaced paths
+	// are not accessible differently than before.  The default, MetadataKeep,
+	// leaves these unchanged.
+	SymlinkMetadata MetadataPolicy
+	// ScanArchives reads tar and zip archives found in the roots, and
+	// reports files that are identical to files in the archives.  Files in
+	// archives are never linked.
+	ScanArchives bool
+	// Mapping, if not nil, receives a mapping of each duplicate file to the
+	// file it is, or would be, linked to.  Each line is the duplicate path and
+	// the kept path separated by a tab, sorted by duplicate path.  Paths that
+	// contain tabs or newlines are written as Go quoted strings.  This lets
+	// packaging tools recreate the same links at install time.
+	Mapping io.Writer `json:"-"`
+	// Escalate, if not nil, receives a shell script of the operations that
+	// need privileges the user lacks, such as replacing files in directories
+	// that are not writable, instead of skipping these files or failing to
+	// replace them.  This lets the bulk of the work be done unprivileged, and
+	// only the script be run as root.  The script does not verify that files
+	// are unchanged since they were hashed, so it is to be run soon after.
+	Escalate io.Writer `json:"-"`
+	// Decompress reports files that are identical to the decompressed
+	// contents of gzip and bzip2 compressed files found in the roots.
+	// Compressed files are never linked.
+	Decompress bool
+	// Verify compares the contents of each file byte-for-byte with the file
+	// it is to be linked to before removing it.  This guards against hash
+	// collisions and against files that changed after being hashed.
+	Verify bool
+	// Jobs is the number of files hashed at once.  If zero, this is the
+	// number of CPUs.
+	Jobs int
+	// AutoJobs adjusts the number of files hashed at once while running,
+	// based on observed throughput and latency, instead of using Jobs.
+	AutoJobs bool
+	// NoFallback leaves a file in place when a hardlink to it cannot be
+	// created, instead of replacing it with a symlink.  Symlinks differ from
+	// hardlinks in that they dangle if the file linked to is removed, and
+	// they do not share link counts.
+	NoFallback bool
+	// Summary, if not nil, receives a summary of the results instead of the
+	// summary being printed.
+	Summary *Summary `json:"-"`
+	// Journal, if not nil, records each run that writes links, and each
+	// file modified, in a tamper-evident journal.  Files are not modified
+	// after writing to the journal fails.
+	Journal *Journal `json:"-"`
+	// Policies limit what may be modified.  Every policy is enforced.
+	Policies []*Policy
+	// Scope limits which sets of identical files are linked, by where the
+	// files are.
+	Scope Scope
+	// Owners, if not empty, limits the search to files owned by these user
+	// IDs.
+	Owners []uint32
+	// OwnerGroups, if not empty, limits the search to files whose group is
+	// one of these group IDs.
+	OwnerGroups []uint32
+	// AllowCrossOwner permits linking files with different owners on file
+	// systems with disk quotas.  By default these are skipped, since linking
+	// them moves the storage charged from one user to another.
+	AllowCrossOwner bool
+	// Types, if not empty, limits the search to files with these content
+	// types, detected from the first bytes of each file rather than from
+	// the file name.  A type without a subtype, such as "image" or "video",
+	// includes all of its subtypes.  ELF files are detected as
+	// application/x-executable, application/x-sharedlib, or
+	// application/x-object.
+	Types []string
+	// MinFreeSpace, if not zero, is the least free space, in bytes, to leave
+	// on a file system.  Before replacing each file, the free space on its
+	// file system is checked, and the run stops if it is below this.  A run
+	// also stops if a file system or disk quota becomes full.
+	MinFreeSpace int64
+	// PauseLowSpace, if not zero, is how long to pause, waiting for free
+	// space to recover, when it is below MinFreeSpace, before stopping.
+	// This suits file systems that other processes are writing to.
+	PauseLowSpace time.Duration
+	// SlowStorage minimizes reads, for storage where reading is slow or
+	// costly, such as object storage mounted with s3fs or rclone.  Only the
+	// first PrefixSize bytes of each file are hashed, the hashes are always
+	// cached in extended attributes, and files are read as on network file
+	// systems.  Files with the same size and prefix are not necessarily
+	// identical, so the results are provisional: links are only written if
+	// Verify is also set, which reads files in full before linking them.
+	SlowStorage bool
+	// PrefixSize is the number of bytes hashed at the start of each file with
+	// SlowStorage.  If zero, 64 KiB are hashed.
+	PrefixSize int64
+	// IncludeSnapshots scans snapshot directories, such as .zfs/snapshot,
+	// .snapshot, and @GMT- directories, which are otherwise skipped.  Files in
+	// snapshots are still never linked, since snapshots are read-only and
+	// linking to them is meaningless, but sets of identical files that only
+	// have duplicates because of snapshots are reported.
+	IncludeSnapshots bool
+	// SkipSparse does not link sparse files, which have holes that take no
+	// storage.  A sparse file has the same contents as one with the holes
+	// written out as zeros, so the two may be linked, changing the storage
+	// the contents take by more or less than their size.
+	SkipSparse bool
+	// LinkReflinked links files that already share all of their data by
+	// reflink, as on btrfs or XFS.  By default these are skipped, since they
+	// already take no more storage than links would, and linking them loses
+	// their separate metadata.
+	LinkReflinked bool
+	// TailFirst are patterns of file names, such as *.log or *.log.*, of
+	// files that are compared by their last bytes before being hashed whole.
+	// Files that differ mostly at the end, such as rotated logs that were
+	// appended to, are then not read whole to find that they differ.
+	TailFirst []string
+	// SampleFirst, if not zero, compares files at least this large by a
+	// sample of chunks, spread from their start to their end, before hashing
+	// them whole.  Large files of the same size that differ, such as the
+	// asset packs of different versions of a game, are then mostly not read
+	// to find that they differ.
+	SampleFirst int64
+	// MinSize, if not zero, is the size of the smallest files linked.
+	// Smaller files are not considered, so that a run spends its time on the
+	// files that save the most.
+	MinSize int64
+	// TagMessages prefixes each message printed while linking with the
+	// ID of the set of identical files being linked, and the number of the
+	// linker linking it, such as [3f2a9c81d0e4 w3].  Sets are linked
+	// concurrently, so this tells which messages belong together.
+	TagMessages bool
+	// GracePeriod, if not zero, leaves files modified less than this long
+	// before the run started for a later run.  Files still being written,
+	// such as downloads in progress or editors' temporary copies, are then
+	// not linked while they may yet change or be removed.
+	GracePeriod time.Duration
+	// IncludeTempFiles links the temporary files of editors and download
+	// managers, with names matching TempFilePatterns, which are otherwise
+	// skipped.
+	IncludeTempFiles bool
+	// TrustManifests takes the hash of a file from a SHA256SUMS manifest, as
+	// written by sha256sum, in its directory or a directory above it,
+	// instead of reading the file, if the file was not modified after the
+	// manifest.  A sample of the files in each manifest is hashed first, and
+	// a manifest with any that do not match is not trusted.  Files hashed
+	// from manifests are only found identical to others hashed from
+	// manifests.  This is not used with SlowStorage.
+	TrustManifests bool
+	// Store, if not empty, is the directory of a Nix store, such as
+	// /nix/store, that is optimized as nix-store --optimise does.  Files are
+	// only replaced with hardlinks, never symlinks, files that differ in mode
+	// or ownership are not linked, and the mode of linked files is not set.
+	// Store paths that nix-store does not report as valid, such as those
+	// being built, are skipped.
+	Store string
+	// Maildir links only the message files in the cur and new directories
+	// of Maildir folders, and only with hardlinks, so that mail clients can
+	// still rename them to change their flags.  Messages flagged as drafts,
+	// which mail clients may rewrite, or as trashed, which are soon removed,
+	// are skipped.
+	Maildir bool
+	// Sidecars keeps photos and videos together with their sidecar files,
+	// named with one of SidecarExtensions.  A file with sidecars is not
+	// replaced with a symlink to a file in another directory, which would
+	// separate it from them, and the sidecars of files replaced with links
+	// are reported, since they are left as they are.
+	Sidecars bool
+	// LinkSidecars, with Sidecars, links the sidecars of each file replaced
+	// with a link to the identical sidecars of the file kept, instead of
+	// reporting them.  Sidecars are then only linked along with their
+	// files, and are not otherwise considered.
+	LinkSidecars bool
+	// ReportResources adds the resources used by the run, such as CPU time,
+	// data read, and peak memory, to its summary.
+	ReportResources bool
+	// Strict makes a run that skips any file, replaces any file with a
+	// symlink because a hardlink could not be made, or has any error, return
+	// an error wrapping ErrStrict that summarizes these, after linking the
+	// files it can.  Then nothing left unlinked goes unnoticed by automation
+	// that only checks whether runs succeed.
+	Strict bool
+	// MaxChanges, if not zero, is the most files that may be replaced in a
+	// run.  Once reached, no more files are replaced, so that a run that
+	// would change far more than expected stops for an operator to check.
+	MaxChanges int
+	// SizeFormat selects how sizes are written in output.
+	SizeFormat SizeFormat
+	// ScanCache, if not empty, is a file that caches the metadata of the
+	// files in each directory scanned.  Directories whose modification time
+	// and names are unchanged since the last run are not stat'ed again, which
+	// speeds up repeated runs on mostly unchanged trees.  Files modified in
+	// place do not change their directories, so are not noticed until their
+	// directories change; set Verify, or XattrCache, when this may happen.
+	ScanCache string
+	// VerboseLimit, if not zero, is the number of links printed individually
+	// with Verbose.  After that, links are counted by directory, a summary is
+	// printed every 10 seconds, and the directories with the most links are
+	// listed at the end.
+	VerboseLimit int
+	// ReadBudget, if not zero, is the most bytes to read to hash files.
+	// Files that would exceed it are not hashed, and so are not linked.
+	ReadBudget int64
+	// MaxLinkSize, if not zero, is the size of the largest file to link.
+	// Consolidating a huge file, such as a disk image, into one inode means
+	// a single mistaken write affects every copy.  MaxGroupSize, if not zero,
+	// is the largest total size of a set of identical files to link.  Sets
+	// of identical files over either limit are not linked, and are reported
+	// separately.
+	MaxLinkSize  int64
+	MaxGroupSize int64
+
+	strategyDirs     []strategyDir
+	strategyPatterns []strategyDir
+	roots            []string
+	budget           *policyBudget
+	changes          *changeLimit
+	manifests        *manifests
+	// invalidStorePaths holds the paths, as found by the scanner, of the
+	// store paths in Store that are not valid.
+	invalidStorePaths map[string]bool
+	usage             *resourceUsage
+	space            *spaceGuard
+	reads            *readBudget
+	vlog             *verboseLog
+	scanCache        *scanCache
+	// memo, if not nil, holds the hashes kept by an Engine, and devices
+	// maps each device it has seen to the name of its network file system.
+	memo    *hashMemo
+	devices map[uint64]string
+	// index, if not nil, records the files found by an Engine.  With rescan,
+	// the files in it of the sizes of the files found are also candidates.
+	index  *fileIndex
+	rescan bool
+	// scanStart is when the scan started, which GracePeriod is counted back
+	// from.
+	scanStart time.Time
+	// stdout and stderr, if not nil, are where messages printed while
+	// linking are written instead of standard output and standard error.
+	stdout io.Writer
+	stderr io.Writer
+	// updateFile, if not empty, is the only file that others are linked to,
+	// and updateInfo is its info.
+	updateFile string
+	updateInfo os.FileInfo
+	// readOnlyRoots are the canonical paths of roots on read-only file
+	// systems.
+	readOnlyRoots []string
+}
+
 // LinkSame replaces copies of files with links to a single file.
 //
 // Search all regular files in the specified directory trees, with names
-// matching pattern if specified.  Hardlinks are created by default; symlinks
-// are requested by setting symlinks = true.  Symlinks are used if hardlinks
-// fail.
+// matching opts.Pattern if specified.  Hardlinks are created by default;
+// symlinks are requested by setting opts.Symlink.  Symlinks are used if
+// hardlinks fail, unless opts.NoFallback is set.
 //
 // Relative (default) or absolute symlinks can be specified.  Generally,
 // relative symlinks are preferred as this permits links to maintain their
@@ -53,182 +395,597 @@ import (
 //
 // If safe mode is enabled, then links are only created for files that have
 // same permission and ownership.
+func LinkSame(roots []string, opts Options) error {
+	return linkSame("", roots, &opts)
+}
+
+// FindDuplicates returns the groups of identical files in the specified
+// directory trees, without linking them.  Options that select files, such as
+// Pattern and XattrCache, are used.  Options that control linking are
+// ignored.  With SlowStorage, the files in a group are only known to have the
+// same size and prefix.
+func FindDuplicates(roots []string, opts Options) ([]*DuplicateGroup, error) {
+	roots, err := normalizeRoots(roots, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return findGroups(roots, &opts, nil)
+}
+
+// findGroups returns the groups of identical files in the normalized roots,
+// only those for which want returns true if want is not nil.
+func findGroups(roots []string, opts *Options, want func(g *DuplicateGroup) bool) ([]*DuplicateGroup, error) {
+	opts.WriteLinks = false
+	var mu sync.Mutex
+	var groups []*DuplicateGroup
+	_, _, err := runPipeline(roots, opts, func(g *DuplicateGroup, worker int) stats {
+		if want != nil && !want(g) {
+			return stats{}
+		}
+		mu.Lock()
+		groups = append(groups, g)
+		mu.Unlock()
+		return stats{}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Files[0].Path < groups[j].Files[0].Path
+	})
+	return groups, nil
+}
+
+// LinkSameUpdate replaces copies of a file with links to a single file.
 //
-// Set quiet to suppress output about links created and size saved.  Set
-// verbose to print output about individual link creation.
-func LinkSame(roots []string, pattern string, writeLinks, symlink, absolute, safe, quiet, verbose bool) error {
-	roots, err := normalizeRoots(roots, quiet)
+// Other then the updateFile parameter, all other parameter are that same as
+// for LinkSame()
+func LinkSameUpdate(updateFile string, roots []string, opts Options) error {
+	if updateFile == "" {
+		return errors.New("Update file not specified")
+	}
+	return linkSame(updateFile, roots, &opts)
+}
+
+// linkSame is the engine for LinkSame and LinkSameUpdate.  If updateFile is
+// not empty, only files identical to it are linked.  The update file is
+// always a candidate, whether or not it is in the roots or matches the
+// options that select files, and only files of its size are hashed.
+// Symlinks, archives, and compressed files are only checked when not linking
+// to an update file.
+func linkSame(updateFile string, roots []string, opts *Options) error {
+	start := time.Now()
+	if opts.WriteLinks && opts.SlowStorage && !opts.Verify {
+		return errProvisional
+	}
+	roots, err := normalizeRoots(roots, opts.Quiet, opts.errOut())
 	if err != nil {
 		return err
 	}
-	if !quiet {
-		fmt.Println("Linking identical files in", strings.Join(roots, ", "))
+	paths := roots
+	if updateFile != "" {
+		paths = append([]string{updateFile}, roots...)
+	}
+	if err = opts.preparePolicies(paths); err != nil {
+		return err
+	}
+	if err = opts.checkTailFirst(); err != nil {
+		return err
+	}
+	if err = opts.prepareStore(roots); err != nil {
+		return err
+	}
+	opts.prepareMaildir()
+	opts.prepareStrategies()
+	opts.prepareChanges()
+	opts.prepareSpace()
+	opts.prepareVerbose()
+	opts.prepareResources()
+	opts.roots = roots
+	if updateFile != "" {
+		if err = opts.prepareUpdate(updateFile); err != nil {
+			return err
+		}
+	}
+	if !opts.Quiet {
+		if updateFile != "" {
+			fmt.Fprintln(opts.out(), "Linking", updateFile, "to identical files in",
+				strings.Join(roots, ", "))
+		} else {
+			fmt.Fprintln(opts.out(), "Linking identical files in", strings.Join(roots, ", "))
+		}
+	}
+	opts.prepareReadOnly(roots)
+	if opts.Verbose {
+		fmt.Fprintln(opts.out(), "Hashing with", hashName)
 	}
+	opts.Journal.start(roots, opts)
 
-	// Walk directories and create map that maps a size to the list of all
-	// files of that size.  Only keep lists of files with more than one file.
-	sizeFileMap := map[int64][]string{}
-	for _, rootDir := range roots {
-		err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return nil
-			}
-			if !info.Mode().IsRegular() || info.Size() == 0 {
-				return nil
+	st, scan, err := linkPipeline(roots, opts)
+	if err != nil {
+		return err
+	}
+	if updateFile == "" {
+		st.add(checkSymlinks(scan.symlinks, roots, opts))
+		if !opts.Quiet {
+			if len(scan.archives) != 0 {
+				reportArchiveCopies(scan.archives, scan.sizeFileMap, opts)
 			}
-			if pattern != "" {
-				ok, err := filepath.Match(pattern, info.Name())
-				if err != nil {
-					return err
-				}
-				if !ok {
-					return nil
-				}
+			if len(scan.compressed) != 0 {
+				reportCompressedCopies(scan.compressed, scan.sizeFileMap, opts)
 			}
-			sizeFileMap[info.Size()] = append(sizeFileMap[info.Size()], path)
-			return nil
-		})
-		if err != nil {
+		}
+	}
+	return st.finish(start, opts)
+}
+
+// prepareUpdate checks that the update file can be linked to, and records it
+// so that only files identical to it are linked.
+func (o *Options) prepareUpdate(updateFile string) error {
+	info, err := os.Stat(updateFile)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", updateFile)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", updateFile)
+	}
+	// Files identical to the update file have the same content type, so only
+	// the update file needs to be checked.
+	ok, err := o.typeSelected(updateFile)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not of a selected type", updateFile)
+	}
+	o.updateFile = updateFile
+	o.updateInfo = info
+	return nil
+}
+
+// LinkGroups replaces the files in each group with links to a single file in
+// the group, without searching for or hashing files.  This allows duplicate
+// files found by other tools to be linked by linksame.
+//
+// The caller is responsible for the files in each group being identical.
+// Files that are not the same size as the other files in their group are not
+// linked.  Setting opts.Verify compares file contents before linking.  Other
+// options are the same as for LinkSame, except for Pattern which is ignored.
+func LinkGroups(groups [][]string, opts Options) error {
+	start := time.Now()
+	opts.prepareStrategies()
+	opts.prepareChanges()
+	opts.prepareSpace()
+	opts.prepareVerbose()
+	opts.prepareResources()
+	for i, group := range groups {
+		groups[i] = sameSize(uniquePaths(group), opts.errOut())
+	}
+	var all []string
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	if err := opts.preparePolicies(all); err != nil {
+		return err
+	}
+	if opts.WriteLinks {
+		if err := probeFileLinks(all, opts.Symlink); err != nil {
 			return err
 		}
 	}
-	type stats struct {
-		links int
-		saved int64
+	opts.Journal.start(nil, &opts)
+
+	var st stats
+	for _, group := range groups {
+		st.candidates += len(group)
+		if len(group) < 2 {
+			continue
+		}
+		g := newDuplicateGroup("", 0, group, opts.errOut())
+		if len(g.Files) > 1 {
+			g.Size = g.Files[0].Info.Size()
+			st.addGroup(g)
+			st.add(linkGroup(g, &opts))
+		}
+	}
+	return st.finish(start, &opts)
+}
+
+// tooRecent reports whether the file, described by info, was modified within
+// GracePeriod before the scan started.
+func (o *Options) tooRecent(info os.FileInfo) bool {
+	return o.GracePeriod > 0 && o.scanStart.Sub(info.ModTime()) < o.GracePeriod
+}
+
+// tooLarge reports whether the files in the group are too large to link,
+// because of MaxLinkSize or MaxGroupSize.
+func (o *Options) tooLarge(g *DuplicateGroup) bool {
+	if o.MaxLinkSize != 0 && g.Size > o.MaxLinkSize {
+		return true
 	}
+	return o.MaxGroupSize != 0 && g.Size*int64(len(g.Files)) > o.MaxGroupSize
+}
 
-	// Calculate hash of files that have the same size.
-	statsChan := make(chan stats, 1)
-	var waitCount int
-	for i := range sizeFileMap {
-		if len(sizeFileMap[i]) < 2 {
+// sameSize removes files that do not exist or are not regular files of the
+// same size as the first such file in the list, reporting them to errOut.
+func sameSize(files []string, errOut io.Writer) []string {
+	size := int64(-1)
+	kept := files[:0]
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
 			continue
 		}
-		waitCount++
-		// Hash and link each list of same-sized files concurrently.
-		go func(filePaths []string) {
-			var links int
-			var saved int64
-			hashMap := createHashMap(filePaths)
-			for _, files := range hashMap {
-				if len(files) < 2 {
-					continue
-				}
-				l, s := linkFiles(files, writeLinks, symlink, absolute, safe,
-					verbose)
-				links += l
-				saved += s
-			}
-			statsChan <- stats{links, saved}
-		}(sizeFileMap[i])
+		if !info.Mode().IsRegular() {
+			fmt.Fprintln(errOut, f, "is not a file")
+			continue
+		}
+		if size == -1 {
+			size = info.Size()
+		} else if info.Size() != size {
+			fmt.Fprintln(errOut, f, "is not the same size as", kept[0])
+			continue
+		}
+		kept = append(kept, f)
 	}
+	return kept
+}
+
+// stats accumulates the results of linking files.
+type stats struct {
+	links int
+	saved int64
+	// immutable lists files skipped because they are immutable or
+	// append-only.
+	immutable []string
+	// crossDevice and crossDeviceSize are the number and total size of
+	// duplicate files on a different file system than the file they are
+	// linked to, which therefore cannot be hardlinked.
+	crossDevice     int
+	crossDeviceSize int64
+	// symlinked and symlinkedSize are the number and total size of files
+	// that are already symlinks to files within the roots.
+	symlinked     int
+	symlinkedSize int64
+	// reflinked and reflinkedSize are the number and total size of files
+	// that already share all of their data with the file they would be
+	// linked to.
+	reflinked     int
+	reflinkedSize int64
+	// rewritten is the number of existing symlinks rewritten between
+	// absolute and relative.
+	rewritten int
+	// reportOnly and reportOnlySize are the number and total size of files
+	// not replaced because of StrategyReportOnly.
+	reportOnly     int
+	reportOnlySize int64
+	// rolledBack is the number of sets of identical files that were
+	// restored after failing to link.
+	rolledBack int
+	// inodes is the number of inodes freed by replacing files with
+	// hardlinks, and freed is the storage allocated to them.
+	inodes int
+	freed  int64
+	// readOnly lists files skipped because they are in directories that are
+	// not writable.
+	readOnly []string
+	// mapping pairs each duplicate file with the file it is linked to.
+	mapping [][2]string
+	// privileged lists files skipped because they are setuid, setgid, or
+	// have file capabilities.
+	privileged []string
+	// fallback and fallbackSize are the number and total size of files
+	// replaced with symlinks because hardlinks could not be created.
+	fallback     int
+	fallbackSize int64
+	// noFallback lists files left in place because hardlinks could not be
+	// created and NoFallback is set.
+	noFallback []string
+	// candidates is the number of files considered, groups is the number of
+	// sets of identical files found, and hashedFiles and hashedBytes are the
+	// number and total size of files hashed.
+	candidates  int
+	groups      int
+	hashedFiles int
+	hashedBytes int64
+	// groupList describes each set of identical files found.
+	groupList []GroupReport
+	// verifiedBytes is the data read to verify that files are identical.
+	verifiedBytes int64
+	// fromManifest is the number of files whose hashes were taken from
+	// manifests, without reading them.
+	fromManifest int
+	// reused is the number of files whose hashes were kept by an Engine from
+	// an earlier call, without reading them again.
+	reused int
+	// errors is the number of errors that kept a file from being hashed or
+	// linked.
+	errors int
+	// forbidden lists files skipped because a policy forbids linking them.
+	forbidden []string
+	// overBudget and overBudgetSize are the number and total size of files
+	// not replaced because the policy limit on data replaced was reached.
+	overBudget     int
+	overBudgetSize int64
+	// overChanges and overChangesSize are the number and total size of
+	// files not replaced because MaxChanges was reached.
+	overChanges     int
+	overChangesSize int64
+	// symlinkOverhead is the estimated storage used by symlinks created,
+	// which is already subtracted from saved.
+	symlinkOverhead int64
+	// outOfScope is the number of files in sets of identical files that are
+	// not linked because of Scope.
+	outOfScope int
+	// crossOwner lists files skipped because they have a different owner
+	// than the file they would be linked to, on a file system with quotas.
+	crossOwner []string
+	// ownerSaved is the files replaced, and the storage saved, for each
+	// owner of replaced files on file systems with quotas.
+	ownerSaved map[uint32]FileCount
+	// reclaimSaved is the storage saved on each file system that
+	// deduplicates or compresses data, by device ID.
+	reclaimSaved map[uint64]int64
+	// denied lists, for each reason, the files that would fail to be
+	// replaced for lack of permission, when links are not written.
+	denied map[string][]string
+	// overReadBudget is the number of files not hashed because ReadBudget
+	// was reached.
+	overReadBudget int
+	// escalations are the operations that need privileges, and
+	// escalatedSize is the total size of the files they replace.
+	escalations   []escalation
+	escalatedSize int64
+	// snapshotDirs is the number of snapshot directories skipped.
+	snapshotDirs int
+	// recent is the number of files not considered because they were
+	// modified within GracePeriod.
+	recent int
+	// invalidStorePaths is the number of store paths not considered
+	// because they are not valid.
+	invalidStorePaths int
+	// maildirFlagged is the number of Maildir messages not considered
+	// because they are drafts or trashed.
+	maildirFlagged int
+	// inSnapshot lists files skipped because they are in snapshot
+	// directories, and snapshotOnly is the number of sets of identical files
+	// that only have duplicates in snapshot directories.
+	inSnapshot   []string
+	snapshotOnly int
+	// sparse lists files skipped because they are sparse.
+	sparse []string
+	// sidecarBound lists files skipped because replacing them with symlinks
+	// would separate them from their sidecars, and sidecars lists the
+	// sidecars of replaced files that were left as they are.
+	sidecarBound []string
+	sidecars     []string
+	// unsafe lists files skipped by Safe, because their permissions or
+	// ownership differ from those of the file kept.
+	unsafe []string
+	// tooLarge lists the sets of identical files not linked because of
+	// MaxLinkSize or MaxGroupSize.
+	tooLarge []*DuplicateGroup
+}
 
-	var linkCount int
-	var sizeSaved int64
-	for waitCount > 0 {
-		s := <-statsChan
-		waitCount--
-		linkCount += s.links
-		sizeSaved += s.saved
+// add adds the results in other to s.
+func (s *stats) add(other stats) {
+	s.links += other.links
+	s.saved += other.saved
+	s.immutable = append(s.immutable, other.immutable...)
+	s.privileged = append(s.privileged, other.privileged...)
+	s.readOnly = append(s.readOnly, other.readOnly...)
+	s.mapping = append(s.mapping, other.mapping...)
+	s.inodes += other.inodes
+	s.freed += other.freed
+	s.rolledBack += other.rolledBack
+	s.reportOnly += other.reportOnly
+	s.reportOnlySize += other.reportOnlySize
+	s.symlinked += other.symlinked
+	s.symlinkedSize += other.symlinkedSize
+	s.reflinked += other.reflinked
+	s.reflinkedSize += other.reflinkedSize
+	s.rewritten += other.rewritten
+	s.crossDevice += other.crossDevice
+	s.crossDeviceSize += other.crossDeviceSize
+	s.fallback += other.fallback
+	s.fallbackSize += other.fallbackSize
+	s.noFallback = append(s.noFallback, other.noFallback...)
+	s.candidates += other.candidates
+	s.groups += other.groups
+	s.groupList = append(s.groupList, other.groupList...)
+	s.hashedFiles += other.hashedFiles
+	s.hashedBytes += other.hashedBytes
+	s.verifiedBytes += other.verifiedBytes
+	s.fromManifest += other.fromManifest
+	s.reused += other.reused
+	s.errors += other.errors
+	s.forbidden = append(s.forbidden, other.forbidden...)
+	s.overBudget += other.overBudget
+	s.overBudgetSize += other.overBudgetSize
+	s.overChanges += other.overChanges
+	s.overChangesSize += other.overChangesSize
+	s.symlinkOverhead += other.symlinkOverhead
+	s.outOfScope += other.outOfScope
+	s.crossOwner = append(s.crossOwner, other.crossOwner...)
+	for uid, c := range other.ownerSaved {
+		if s.ownerSaved == nil {
+			s.ownerSaved = map[uint32]FileCount{}
+		}
+		sc := s.ownerSaved[uid]
+		sc.Files += c.Files
+		sc.Bytes += c.Bytes
+		s.ownerSaved[uid] = sc
+	}
+	for dev, saved := range other.reclaimSaved {
+		if s.reclaimSaved == nil {
+			s.reclaimSaved = map[uint64]int64{}
+		}
+		s.reclaimSaved[dev] += saved
 	}
+	s.overReadBudget += other.overReadBudget
+	s.escalations = append(s.escalations, other.escalations...)
+	s.escalatedSize += other.escalatedSize
+	s.tooLarge = append(s.tooLarge, other.tooLarge...)
+	s.snapshotDirs += other.snapshotDirs
+	s.recent += other.recent
+	s.invalidStorePaths += other.invalidStorePaths
+	s.maildirFlagged += other.maildirFlagged
+	s.inSnapshot = append(s.inSnapshot, other.inSnapshot...)
+	s.snapshotOnly += other.snapshotOnly
+	s.sparse = append(s.sparse, other.sparse...)
+	s.sidecarBound = append(s.sidecarBound, other.sidecarBound...)
+	s.sidecars = append(s.sidecars, other.sidecars...)
+	s.unsafe = append(s.unsafe, other.unsafe...)
+	for reason, files := range other.denied {
+		s.addDenied(reason, files...)
+	}
+}
+
+// addDenied records files that would fail to be replaced for lack of
+// permission, for the reason.
+func (s *stats) addDenied(reason string, files ...string) {
+	if s.denied == nil {
+		s.denied = map[string][]string{}
+	}
+	s.denied[reason] = append(s.denied[reason], files...)
+}
 
-	if !quiet {
-		fmt.Println()
-		if !writeLinks {
-			fmt.Println("If writing links (-w), would have...")
+// writeMapping writes the mapping of duplicate files to kept files.
+func (s *stats) writeMapping(w io.Writer) error {
+	sort.Slice(s.mapping, func(i, j int) bool {
+		return s.mapping[i][0] < s.mapping[j][0]
+	})
+	quote := func(p string) string {
+		if strings.ContainsAny(p, "\t\n") || strings.HasPrefix(p, `"`) {
+			return strconv.Quote(p)
 		}
-		fmt.Println("Replaced", linkCount, "files with links")
-		fmt.Println("Reduced storage by", sizeStr(sizeSaved))
+		return p
 	}
-	return nil
+	bw := bufio.NewWriter(w)
+	for _, m := range s.mapping {
+		fmt.Fprintf(bw, "%s\t%s\n", quote(m[0]), quote(m[1]))
+	}
+	return bw.Flush()
 }
 
-// LinkSameUpdate replaces copies of a file with links to a single file.
-//
-// Other then the updateFile parameter, all other parameter are that same as
-// for LinkSame()
-func LinkSameUpdate(updateFile string, roots []string, pattern string, writeLinks, symlink, absolute, safe, quiet, verbose bool) error {
-	if updateFile == "" {
-		return errors.New("Update file not specified")
+// printSkipped prints the list of files skipped for the described reason to
+// w.
+func printSkipped(w io.Writer, files []string, desc string) {
+	if len(files) == 0 {
+		return
 	}
-	roots, err := normalizeRoots(roots, quiet)
-	if err != nil {
-		return err
+	fmt.Fprintln(w, "Skipped", len(files), desc, "files:")
+	sort.Strings(files)
+	for _, f := range files {
+		fmt.Fprintln(w, " ", f)
 	}
-	updateInfo, err := os.Stat(updateFile)
-	if err != nil {
-		return err
+}
+
+// printTooLarge prints the sets of identical files that are too large to
+// link to w, largest first.
+func printTooLarge(w io.Writer, groups []*DuplicateGroup, f SizeFormat) {
+	if len(groups) == 0 {
+		return
 	}
-	if !updateInfo.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a file", updateFile)
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Files[0].Path < groups[j].Files[0].Path
+	})
+	fmt.Fprintln(w, "Skipped", len(groups), "sets of identical files over the size limit:")
+	for _, g := range groups {
+		fmt.Fprintln(w, " ", len(g.Files), "files of", f.Format(g.Size), "(group "+g.ID()+"):")
+		paths := g.Paths()
+		sort.Strings(paths)
+		for _, p := range paths {
+			fmt.Fprintln(w, "   ", p)
+		}
 	}
-	if updateInfo.Size() == 0 {
-		return fmt.Errorf("%s is empty", updateFile)
+}
+
+// printDenied prints the files, described by desc, that would fail to be
+// replaced for lack of permission to w.
+func printDenied(w io.Writer, files []string, desc string) {
+	if len(files) == 0 {
+		return
 	}
-	updateHash, err := hashFile(updateFile)
-	if err != nil {
-		return err
+	fmt.Fprintln(w, "Permission denied for", len(files), desc+":")
+	sort.Strings(files)
+	for _, f := range files {
+		fmt.Fprintln(w, " ", f)
 	}
-	if !quiet {
-		fmt.Println("Linking", updateFile, "to identical files in",
-			strings.Join(roots, ", "))
+}
+
+// probeLinks checks that links can be created in each of the given
+// directories, which are one for each file system containing files to link.
+// This finds file systems that do not support links before any files are
+// removed.  Hardlinks are not required, since symlinks are used if hardlinks
+// fail, unless symlinkOnly is true.
+func probeLinks(dirs map[uint64]string, symlinkOnly bool) error {
+	var failed []string
+	for _, dir := range dirs {
+		if err := probeDir(dir, symlinkOnly); err != nil {
+			failed = append(failed, err.Error())
+		}
 	}
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("cannot create links:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
 
-	// Walk directories and find files that are identical to the update file.
-	same := []string{updateFile}
-	for _, rootDir := range roots {
-		err = filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return nil
-			}
-			if !info.Mode().IsRegular() || info.Size() != updateInfo.Size() {
-				return nil
-			}
-			if pattern != "" {
-				ok, err := filepath.Match(pattern, info.Name())
-				if err != nil {
-					return err
-				}
-				if !ok {
-					return nil
-				}
-			}
-			h, err := hashFile(path)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return nil
-			}
-			if h != updateHash {
-				return nil
-			}
-			same = append(same, path)
-			return nil
-		})
-		if err != nil {
-			return err
+// probeFileLinks checks that links can be created on each file system
+// containing the files.
+func probeFileLinks(files []string, symlinkOnly bool) error {
+	probeDirs := map[uint64]string{}
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if syscall.Access(dir, accessWrite) != nil {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			probeDirs[deviceID(info)] = dir
 		}
 	}
-	var linkCount int
-	var sizeSaved int64
-	if len(same) > 1 {
-		linkCount, sizeSaved = linkFiles(same, writeLinks, symlink, absolute, safe,
-			verbose)
+	return probeLinks(probeDirs, symlinkOnly)
+}
+
+// probeDir checks that a hardlink or symlink can be created in a directory.
+func probeDir(dir string, symlinkOnly bool) error {
+	tmp, err := createTemp(dir, tempProbe, "")
+	if err != nil {
+		return err
 	}
+	tmp.Close()
+	defer removeTemp(tmp.Name())
 
-	if !quiet {
-		fmt.Println()
-		if !writeLinks {
-			fmt.Println("If writing links (-w), would have...")
+	var linkErr error
+	if !symlinkOnly {
+		link := tmp.Name() + ".link"
+		if linkErr = os.Link(tmp.Name(), link); linkErr == nil {
+			os.Remove(link)
+			return nil
 		}
-		fmt.Println("Replaced", linkCount, "files with links")
-		fmt.Println("Reduced storage by", sizeStr(sizeSaved))
 	}
+	link := tmp.Name() + ".symlink"
+	if err = os.Symlink(filepath.Base(tmp.Name()), link); err != nil {
+		if linkErr != nil {
+			return fmt.Errorf("%s: no hardlinks (%s) or symlinks (%s)", dir,
+				linkErr, err)
+		}
+		return err
+	}
+	os.Remove(link)
 	return nil
 }
 
-func normalizeRoots(roots []string, quiet bool) ([]string, error) {
+func normalizeRoots(roots []string, quiet bool, errOut io.Writer) ([]string, error) {
 	for i := range roots {
 		rootDir := path.Clean(roots[i])
 		rootInfo, err := os.Stat(rootDir)
@@ -247,20 +1004,30 @@ func normalizeRoots(roots []string, quiet bool) ([]string, error) {
 
 	if len(roots) > 1 {
 		// Remove any root that is the same or a subdirectory of another.
+		// Compare canonical paths so that aliases of the same directory are
+		// found.
+		canon := make([]string, len(roots))
+		for i := range roots {
+			canon[i] = canonicalPath(roots[i])
+		}
 	outerLoop:
 		for i := 0; i < len(roots); {
 			for j := range roots {
 				if j == i {
 					continue
 				}
-				if strings.HasPrefix(roots[i], roots[j]) {
+				// Of roots that are the same, keep the first.
+				if (canon[i] == canon[j] && j < i) ||
+					strings.HasPrefix(canon[i], canon[j]+string(filepath.Separator)) {
 					if !quiet {
-						fmt.Fprintln(os.Stderr, roots[i],
+						fmt.Fprintln(errOut, roots[i],
 							"already included in", roots[j])
 					}
 					// This root is a subdirectory of another, so skip it.
 					roots[i] = roots[len(roots)-1]
 					roots = roots[:len(roots)-1]
+					canon[i] = canon[len(canon)-1]
+					canon = canon[:len(canon)-1]
 					continue outerLoop
 				}
 			}
@@ -270,285 +1037,795 @@ func normalizeRoots(roots []string, quiet bool) ([]string, error) {
 	return roots, nil
 }
 
-// sizeStr returns a string representation of the rounded bytes
-func sizeStr(size int64) string {
-	const (
-		_        = iota
-		kilobyte = 1 << (10 * iota)
-		megabyte
-		gigabyte
-	)
-
-	round1 := func(num float64) float64 {
-		return float64(int((num*10.0)+0.5)) / 10.0
+// canonicalPath returns an absolute path with all symlinks resolved, which is
+// the same for all paths that refer to the same file by name.  On platforms
+// with case-insensitive file systems, the path is also case folded.  If the
+// path cannot be resolved, it is returned unchanged.
+func canonicalPath(name string) string {
+	p, err := filepath.Abs(name)
+	if err != nil {
+		return name
 	}
-
-	if size > gigabyte {
-		return fmt.Sprintf("%.1fG", round1(float64(size)/gigabyte))
+	if p, err = filepath.EvalSymlinks(p); err != nil {
+		return name
 	}
-	if size > megabyte {
-		return fmt.Sprintf("%.1fM", round1(float64(size)/megabyte))
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		p = strings.ToLower(p)
 	}
-	if size > kilobyte {
-		return fmt.Sprintf("%.1fK", round1(float64(size)/kilobyte))
+	return p
+}
+
+// uniquePaths removes paths that refer to the same file by name as a path
+// earlier in the list.  This keeps a file from appearing more than once in a
+// set of identical files, and being linked to itself.
+func uniquePaths(files []string) []string {
+	seen := make(map[string]struct{}, len(files))
+	unique := files[:0]
+	for _, f := range files {
+		c := canonicalPath(f)
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		unique = append(unique, f)
 	}
-	return fmt.Sprint(size, " bytes")
+	return unique
+}
+
+// accessWrite is the mode for access(2) to check for write permission.
+const accessWrite = 0x2 // W_OK
+
+// fileID identifies a file by its device and inode.  All hardlinks to a
+// file have the same fileID.
+type fileID struct {
+	dev, ino uint64
 }
 
-// hashFile calculates a sha1 hash of the specified file.
-func hashFile(file string) (string, error) {
-	f, err := os.Open(file)
+// fileIDOf returns the fileID of the file.
+func fileIDOf(info os.FileInfo) fileID {
+	return fileID{deviceID(info), uint64(info.Sys().(*syscall.Stat_t).Ino)}
+}
+
+// deviceID returns the ID of the device containing the file.
+func deviceID(info os.FileInfo) uint64 {
+	return uint64(info.Sys().(*syscall.Stat_t).Dev)
+}
+
+// isPrivileged reports whether a file is setuid, setgid, or has file
+// capabilities.
+func isPrivileged(file string) bool {
+	info, err := os.Stat(file)
 	if err != nil {
-		return "", err
+		return false
+	}
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return true
 	}
-	defer f.Close()
+	_, err = getXattr(file, "security.capability")
+	return err == nil
+}
 
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+// sameContent compares the contents of two files byte-for-byte.
+func sameContent(file1, file2 string) (bool, error) {
+	f1, err := os.Open(file1)
+	if err != nil {
+		return false, err
 	}
+	defer f1.Close()
+	f2, err := os.Open(file2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
 
-	return string(h.Sum(nil)), nil
+	const bufSize = 64 * 1024
+	buf1 := make([]byte, bufSize)
+	buf2 := make([]byte, bufSize)
+	for {
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
 }
 
-// createHashMap returns a map of sha1 hash to a slice of identical files.
-func createHashMap(fpaths []string) map[string][]string {
-	var sameAs []string
-	hashMap := make(map[string][]string, len(fpaths))
-	for i := range fpaths {
-		if fpaths[i] == "" {
-			continue
+// linkGroup links the files in the group, which have been determined to be
+// identical.
+func linkGroup(g *DuplicateGroup, opts *Options) stats {
+	var st stats
+	groupID := g.ID()
+	files := g.Paths()
+	// Files in snapshots are never linked.  A set of identical files that
+	// only has duplicates in snapshots is counted, since it is not a real
+	// duplicate.
+	if opts.IncludeSnapshots {
+		var snapshotFiles []string
+		files, snapshotFiles = removeSnapshots(files)
+		if len(snapshotFiles) != 0 {
+			st.inSnapshot = append(st.inSnapshot, snapshotFiles...)
+			if len(files) < 2 {
+				st.snapshotOnly++
+				if opts.Verbose {
+					fmt.Fprintln(opts.out(), "only duplicated in snapshots:", g.Files[0].Path)
+				}
+				return st
+			}
+			g = g.subset(files)
 		}
-		f1Info, err := os.Stat(fpaths[i])
-		if err != nil {
-			// Cannot stat file, so skip.
-			continue
+	}
+	if !inScope(files, opts) {
+		st.outOfScope += len(files)
+		return st
+	}
+	if opts.tooLarge(g) {
+		st.tooLarge = append(st.tooLarge, g)
+		return st
+	}
+	if opts.Scope == ScopeVersioned {
+		sets := versionedSets(files)
+		if len(sets) != 1 {
+			// Link each set of versions of the same file separately.
+			for _, set := range sets {
+				if len(set) < 2 {
+					st.outOfScope++
+					continue
+				}
+				st.add(linkGroup(g.subset(set), opts))
+			}
+			return st
 		}
+	}
 
-		// Calculate sha1 hash of file.
-		h, err := hashFile(fpaths[i])
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	// Remove immutable and append-only files, since these cannot be removed
+	// or linked to.  Unless allowed, remove privileged files.  Remove files
+	// that a policy forbids linking, and sparse files if they are skipped.
+	for i := 0; i < len(files); {
+		if isImmutable(files[i]) {
+			st.immutable = append(st.immutable, files[i])
+		} else if !opts.AllowPrivileged && isPrivileged(files[i]) {
+			st.privileged = append(st.privileged, files[i])
+		} else if opts.policyForbids(files[i]) {
+			st.forbidden = append(st.forbidden, files[i])
+		} else if opts.SkipSparse && isSparse(files[i]) {
+			st.sparse = append(st.sparse, files[i])
+		} else {
+			i++
 			continue
 		}
+		files[i] = files[len(files)-1]
+		files = files[:len(files)-1]
+	}
+	if len(files) < 2 {
+		return st
+	}
 
-		// Find hardlinks to current file, and reuse hash for these.
-		for j := i + 1; j < len(fpaths); j++ {
-			if fpaths[j] == "" {
-				continue
-			}
-			f2Info, err := os.Stat(fpaths[j])
-			if err != nil {
-				// Cannot stat file, so mark as bad.
-				fpaths[j] = ""
-				continue
-			}
-			if os.SameFile(f1Info, f2Info) {
-				sameAs = append(sameAs, fpaths[j])
-				fpaths[j] = ""
+	// Order files so that the file to keep is first.
+	sortByKeep(files, opts)
+
+	// Files in read-only directories cannot be replaced with links.  If the
+	// base file is in one, prefer a writable file as the base when creating
+	// hardlinks, since hardlinks to it cannot be made from other file
+	// systems.  When creating symlinks, keep the read-only base and symlink
+	// to it.
+	writable := map[string]bool{}
+	isWritable := func(file string) bool {
+		dir := filepath.Dir(file)
+		w, ok := writable[dir]
+		if !ok {
+			w = syscall.Access(dir, accessWrite) == nil
+			writable[dir] = w
+		}
+		return w
+	}
+	if !opts.Symlink && !isWritable(files[0]) {
+		for i := 1; i < len(files); i++ {
+			if isWritable(files[i]) {
+				w := files[i]
+				copy(files[1:i+1], files[:i])
+				files[0] = w
+				break
 			}
 		}
+	}
 
-		if len(sameAs) == 0 {
-			hashMap[h] = append(hashMap[h], fpaths[i])
-		} else {
-			// Reuse hash for additional hardlinked files.
-			hashMap[h] = append(hashMap[h], append(sameAs, fpaths[i])...)
-			sameAs = nil
+	// Count the links to each inode that are replaced.  When all of an
+	// inode's links are replaced by hardlinks, the inode is freed.
+	replaced := map[uint64]uint64{}
+	freeInode := func(info os.FileInfo) {
+		sysStat := info.Sys().(*syscall.Stat_t)
+		replaced[sysStat.Ino]++
+		if replaced[sysStat.Ino] == uint64(sysStat.Nlink) {
+			st.inodes++
+			st.freed += allocated(info)
 		}
 	}
-	return hashMap
-}
 
-// linkFiles links the files in the given list, which have been determined to
-// be identical.
-func linkFiles(files []string, writeLinks, symlink, absolute, safe, verbose bool) (int, int64) {
-	if len(files) < 2 {
-		return 0, 0
+	// In transactional mode, files are moved to backups that are removed
+	// only after all files are linked.  Rolling back restores the backups.
+	type undoEntry struct {
+		file, backup string
 	}
+	var undo []undoEntry
+	// The files and data of this group counted against MaxChanges and the
+	// policy budget, which are given back if the group is rolled back.
+	var spentChanges int
+	var spentBytes int64
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			u := undo[i]
+			// The backup is renamed over the link, so that the file is
+			// never missing.
+			err := os.Rename(u.backup, u.file)
+			if err == nil {
+				// Renaming a hardlink over the file it links to does
+				// nothing, leaving the backup to be removed.
+				removeTemp(u.backup)
+			}
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), "failed to roll back file:", err)
+				st.errors++
+			}
+			opts.Journal.modified(journalRollback, groupID, u.file, "", nil, err)
+		}
+		st.links, st.saved, st.inodes = 0, 0, 0
+		st.fallback, st.fallbackSize, st.symlinkOverhead = 0, 0, 0
+		st.ownerSaved, st.reclaimSaved = nil, nil
+		st.rolledBack++
+		opts.releaseChanges(spentChanges)
+		opts.releaseBudget(spentBytes)
+	}
+	// unspend gives back the change and data counted for a file of the given
+	// size that is not replaced, when the group is not rolled back.
+	unspend := func(size int64) {
+		opts.releaseChanges(1)
+		opts.releaseBudget(size)
+		spentChanges--
+		spentBytes -= size
+	}
+	defer func() {
+		for _, u := range undo {
+			removeTemp(u.backup)
+		}
+	}()
 
-	// Sort files and get file with longest name, or longest path if names
-	// are the same.  This only matters for symlinks, but since a failed
-	// hardlink can result in a symlink, do it anyway.
-	sort.Sort(sort.Reverse(pathSlice(files)))
-
-	var linkCount int
-	var sizeSaved int64
 	baseFile := files[0]
 	baseInfo, err := os.Stat(baseFile)
 	for err != nil {
 		// Skip files until one does not give error.
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(opts.errOut(), err)
+		st.errors++
 		files = files[1:]
 		baseFile = files[0]
 		baseInfo, err = os.Stat(baseFile)
 	}
 
+	// The files replaced by symlinks to the base file, whose metadata may be
+	// applied to it.
+	var symlinkedInfos []os.FileInfo
+
+	// The files linked, or that would be linked, to the base file, which are
+	// added to the mapping, and have their sidecars linked, once the group is
+	// not rolled back.
+	var mapping [][2]string
+	var linkedFiles []string
+
+	// The extents of the base file, found when first needed.
+	var baseExtents []extent
+	var baseExtentsFound bool
+
 	for _, f := range files[1:] {
 		fInfo, err := os.Stat(f)
 		if err != nil {
-			if verbose {
-				fmt.Fprintln(os.Stderr, err)
+			if opts.Verbose {
+				fmt.Fprintln(opts.errOut(), err)
 			}
 			// Cannot stat file, maybe removed, so skip.
 			continue
 		}
 		// If the files are already the same (hardlinked), then skip.
 		if os.SameFile(baseInfo, fInfo) {
+			if opts.Mapping != nil {
+				mapping = append(mapping, [2]string{f, baseFile})
+			}
 			continue
 		}
+		// Files of different sizes are never identical, however they were
+		// matched.
+		if fInfo.Size() != baseInfo.Size() {
+			fmt.Fprintln(opts.errOut(), f, "is not the same size as", baseFile)
+			st.errors++
+			continue
+		}
+		// Files that already share all of their data with the base file, by
+		// reflink, gain nothing by being linked.
+		if !opts.LinkReflinked {
+			if !baseExtentsFound {
+				baseExtents, _ = fileExtents(baseFile)
+				baseExtentsFound = true
+			}
+			if sharedExtents(baseExtents, f) {
+				st.reflinked++
+				st.reflinkedSize += fInfo.Size()
+				if opts.Verbose {
+					fmt.Fprintln(opts.out(), "already reflinked:", f, "<==>", baseFile)
+				}
+				continue
+			}
+		}
+		// Files that are only reported need not be writable.  Files that
+		// need privileges to replace are escalated if requested.
+		strategy := opts.strategyFor(f)
+		var escalate bool
+		if !isWritable(f) && !(opts.WriteLinks && strategy == StrategyReportOnly) {
+			if opts.Escalate == nil {
+				st.readOnly = append(st.readOnly, f)
+				continue
+			}
+			escalate = true
+		}
 
 		// If safe mode enabled, check that files have same permissions and
 		// ownership.
-		if safe {
+		if opts.Safe {
 			// Check that permissions are the same.
 			if fInfo.Mode() != baseInfo.Mode() {
+				st.unsafe = append(st.unsafe, f)
 				continue
 			}
 			// Check that ownership is the same.
 			fSysStat := fInfo.Sys().(*syscall.Stat_t)
 			baseSysStat := baseInfo.Sys().(*syscall.Stat_t)
 			if fSysStat.Uid != baseSysStat.Uid || fSysStat.Gid != baseSysStat.Gid {
+				st.unsafe = append(st.unsafe, f)
 				continue
 			}
 		}
-
-		if !writeLinks {
-			sizeSaved += baseInfo.Size()
-			linkCount++
-			if !verbose {
-				continue
-			}
-			if symlink {
-				var source string
-				if absolute {
-					source = baseFile
+		if opts.crossOwner(fInfo, baseInfo) {
+			st.crossOwner = append(st.crossOwner, f)
+			continue
+		}
+		if !escalate && (!opts.WriteLinks || opts.Escalate != nil) {
+			// Report the files that would fail to be replaced, rather than
+			// failing when links are written.
+			if reason := opts.permissionFailure(f, fInfo, baseFile, strategy); reason != "" {
+				if opts.Escalate != nil {
+					escalate = true
 				} else {
-					rp, err := filepath.Rel(path.Dir(f), path.Dir(baseFile))
-					if err != nil {
-						// Cannot make relative symlink.
-						source = baseFile
-					} else if rp == "." {
-						source = path.Base(baseFile)
-					} else {
-						source = path.Join(rp, path.Base(baseFile))
+					st.addDenied(reason, f)
+					if opts.Verbose {
+						fmt.Fprintln(opts.out(), "permission denied:", f, "("+reason+")")
 					}
+					continue
 				}
-				fmt.Println("symlink:", f, "--->", source)
-			} else {
-				fmt.Println("link:", f, "<-->", baseFile)
 			}
-			continue
 		}
 
-		if err = os.Remove(f); err != nil {
-			if verbose {
-				fmt.Fprintln(os.Stderr, "cannot remove file:", f)
+		// If verify enabled, confirm that the file contents are identical
+		// independently of the hash.
+		if opts.Verify {
+			same, err := sameContent(baseFile, f)
+			st.verifiedBytes += 2 * fInfo.Size()
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), "cannot verify file:", err)
+				st.errors++
+				continue
+			}
+			if !same {
+				fmt.Fprintln(opts.errOut(), "WARNING: hash collision or modified file:",
+					f, "differs from", baseFile)
+				st.errors++
+				continue
 			}
-			continue
 		}
 
-		createSymlink := symlink
-		if !symlink {
-			if err = os.Link(baseFile, f); err != nil {
-				createSymlink = true
-				if verbose {
-					fmt.Fprintln(os.Stderr,
-						"could not create hardlink, creating symlink")
+		crossDevice := deviceID(fInfo) != deviceID(baseInfo)
+		if crossDevice {
+			st.crossDevice++
+			st.crossDeviceSize += fInfo.Size()
+		}
+
+		if strategy == StrategyHardlink && crossDevice && opts.NoFallback {
+			st.noFallback = append(st.noFallback, f)
+			continue
+		}
+		if (strategy == StrategySymlink || strategy == StrategyHardlink && crossDevice) &&
+			opts.splitsSidecars(f, baseFile) {
+			st.sidecarBound = append(st.sidecarBound, f)
+			continue
+		}
+		if opts.WriteLinks && strategy == StrategyReportOnly {
+			st.reportOnly++
+			if opts.Mapping != nil {
+				mapping = append(mapping, [2]string{f, baseFile})
+			}
+			st.reportOnlySize += baseInfo.Size()
+			if opts.Verbose {
+				fmt.Fprintln(opts.out(), "report:", f, "<-->", baseFile)
+			}
+			continue
+		}
+		if !opts.changeAllowed() {
+			st.overChanges++
+			st.overChangesSize += fInfo.Size()
+			continue
+		}
+		if !opts.policyAllows(fInfo.Size()) {
+			opts.releaseChanges(1)
+			st.overBudget++
+			st.overBudgetSize += fInfo.Size()
+			continue
+		}
+		spentChanges++
+		spentBytes += fInfo.Size()
+		var denied bool
+		if !opts.WriteLinks || opts.Escalate != nil {
+			denied = strategy == StrategyHardlink && !crossDevice && hardlinkDenied(baseFile, baseInfo)
+			escalate = escalate || denied && opts.Escalate != nil
+		}
+		if escalate {
+			cmd, err := opts.escalationCommand(f, baseFile, strategy, crossDevice)
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), "cannot create symlink:", err)
+				st.errors++
+				continue
+			}
+			st.escalations = append(st.escalations, escalation{f, groupID, cmd})
+			st.escalatedSize += baseInfo.Size()
+			if opts.Mapping != nil {
+				mapping = append(mapping, [2]string{f, baseFile})
+			}
+			if opts.Verbose {
+				fmt.Fprintln(opts.out(), "needs privileges:", cmd)
+			}
+			continue
+		}
+		if !opts.WriteLinks {
+			if denied && opts.NoFallback {
+				st.noFallback = append(st.noFallback, f)
+				continue
+			}
+			if denied && opts.splitsSidecars(f, baseFile) {
+				st.sidecarBound = append(st.sidecarBound, f)
+				continue
+			}
+			symlinked := strategy == StrategySymlink || strategy == StrategyHardlink && (crossDevice || denied)
+			var source string
+			var overhead int64
+			if symlinked {
+				var err error
+				if source, err = opts.symlinkSource(f, baseFile); errors.Is(err, errTargetTooLong) {
+					fmt.Fprintln(opts.errOut(), "cannot create symlink:", err)
+					st.errors++
+					continue
 				}
-			} else if verbose {
-				fmt.Println("hardlink:", f, "<-->", baseFile)
-				if err = os.Chmod(f, baseInfo.Mode()); err != nil {
-					fmt.Fprintln(os.Stderr,
-						"failed to set mode on hardlink:", err)
+				overhead = symlinkOverhead(source, fInfo)
+				symlinkedInfos = append(symlinkedInfos, fInfo)
+			}
+			st.saved += baseInfo.Size() - overhead
+			st.symlinkOverhead += overhead
+			st.links++
+			st.addOwnerSaved(fInfo, baseInfo.Size()-overhead)
+			st.addReclaimSaved(fInfo, baseInfo.Size()-overhead)
+			if opts.Mapping != nil {
+				mapping = append(mapping, [2]string{f, baseFile})
+			}
+			if strategy == StrategyHardlink {
+				switch {
+				case crossDevice:
+					st.fallback++
+					st.fallbackSize += baseInfo.Size()
+					warnFallback(f, baseFile, errors.New("files are on different devices"), opts)
+				case denied:
+					st.fallback++
+					st.fallbackSize += baseInfo.Size()
+					warnFallback(f, baseFile, errHardlinkDenied, opts)
+				default:
+					freeInode(fInfo)
 				}
 			}
+			switch {
+			case symlinked:
+				opts.logLink("symlink", f, "--->", source)
+			case strategy == StrategyReflink:
+				opts.logLink("reflink", f, "<==>", baseFile)
+			default:
+				opts.logLink("link", f, "<-->", baseFile)
+			}
+			linkedFiles = append(linkedFiles, f)
+			continue
 		}
 
-		if createSymlink {
-			var source string
-			if absolute {
-				source = baseFile
+		if err = opts.checkSpace(filepath.Dir(f)); err != nil {
+			// Stop before the file system fills.
+			if opts.Transactional {
+				rollback()
+				return st
+			}
+			unspend(fInfo.Size())
+			break
+		}
+
+		// The intent to replace the file is recorded, with the state of the
+		// file, before the file is moved aside or replaced.
+		var before *fileState
+		if opts.Journal != nil {
+			before = stateOf(fInfo, g.Hash)
+		}
+		event := journalLink
+		switch strategy {
+		case StrategySymlink:
+			event = journalSymlink
+		case StrategyReflink:
+			event = journalReflink
+		}
+		intent := opts.Journal.intend(event, groupID, f, baseFile, before)
+		if err = opts.Journal.failed(); err != nil {
+			// Do not modify files when the modification cannot be recorded.
+			if opts.Transactional {
+				rollback()
+				return st
+			}
+			unspend(fInfo.Size())
+			break
+		}
+
+		// The link is created at a temporary name and renamed over the file,
+		// so that the file is only replaced by a complete link, and is left
+		// in place if the link cannot be created, such as when the file
+		// system is full.
+		tmp, err := tempName(filepath.Dir(f), tempLink, filepath.Base(f))
+		if err != nil {
+			fmt.Fprintln(opts.errOut(), "cannot create link:", err)
+			st.errors++
+			opts.Journal.done(intent, event, groupID, f, baseFile, err)
+			opts.noteSpace(err)
+			if opts.Transactional {
+				rollback()
+				return st
+			}
+			unspend(fInfo.Size())
+			continue
+		}
+		if opts.Transactional {
+			backup, err := backupFile(f)
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), "cannot move file aside:", err)
+				st.errors++
+				opts.Journal.done(intent, event, groupID, f, baseFile, err)
+				forgetTemp(tmp)
+				rollback()
+				return st
+			}
+			undo = append(undo, undoEntry{f, backup})
+		}
+
+		var linkErr error
+		createSymlink := strategy == StrategySymlink
+		switch strategy {
+		case StrategyReflink:
+			if linkErr = reflinkFile(tmp, baseFile, fInfo.Mode()); linkErr != nil {
+				fmt.Fprintln(opts.errOut(), "failed to create reflink:", linkErr)
+				st.errors++
+			} else {
+				opts.logLink("reflink", f, "<==>", baseFile)
+			}
+		case StrategyHardlink:
+			if err = os.Link(baseFile, tmp); err != nil {
+				if opts.NoFallback {
+					st.noFallback = append(st.noFallback, f)
+					linkErr = err
+					break
+				}
+				if opts.splitsSidecars(f, baseFile) {
+					st.sidecarBound = append(st.sidecarBound, f)
+					linkErr = err
+					break
+				}
+				createSymlink = true
+				st.fallback++
+				st.fallbackSize += baseInfo.Size()
+				warnFallback(f, baseFile, err, opts)
 			} else {
-				rp, err := filepath.Rel(path.Dir(f), path.Dir(baseFile))
-				if err != nil {
-					if verbose {
-						fmt.Fprintln(os.Stderr, err)
+				opts.logLink("hardlink", f, "<-->", baseFile)
+				if opts.Store == "" {
+					if err = os.Chmod(tmp, baseInfo.Mode()); err != nil {
+						fmt.Fprintln(opts.errOut(),
+							"failed to set mode on hardlink:", err)
+						st.errors++
 					}
-					// Cannot make relative symlink.
-					source = baseFile
-				} else if rp == "." {
-					source = path.Base(baseFile)
-				} else {
-					source = path.Join(rp, path.Base(baseFile))
 				}
 			}
+		}
+
+		var overhead int64
+		if linkErr == nil && createSymlink {
+			source, err := opts.symlinkSource(f, baseFile)
+			switch {
+			case errors.Is(err, errTargetTooLong):
+				fmt.Fprintln(opts.errOut(), "cannot create symlink:", err)
+				st.errors++
+				linkErr = err
+			case err != nil && opts.Verbose:
+				fmt.Fprintln(opts.errOut(), err)
+			}
 
-			if err = os.Symlink(source, f); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to create symlink for %s: %s",
-					baseFile, err)
-				// Restore file.
-				if err = copyFile(baseFile, f, fInfo.Mode()); err != nil {
-					fmt.Fprintln(os.Stderr, "failed to restore file:", err)
+			if linkErr == nil {
+				if linkErr = os.Symlink(source, tmp); linkErr != nil {
+					fmt.Fprintf(opts.errOut(), "failed to create symlink for %s: %s\n",
+						baseFile, linkErr)
+					st.errors++
+				} else {
+					opts.logLink("symlink", f, "--->", source)
+					overhead = symlinkOverhead(source, fInfo)
 				}
-				continue // skip stats update
 			}
-			if verbose {
-				fmt.Println("symlink:", f, "--->", source)
+		}
+		if linkErr == nil {
+			if linkErr = checkLink(tmp, baseFile, baseInfo, strategy == StrategyReflink); linkErr != nil {
+				fmt.Fprintln(opts.errOut(), "not replacing", f+":", linkErr)
+				st.errors++
 			}
 		}
-		sizeSaved += baseInfo.Size()
-		linkCount++
+		if linkErr == nil {
+			if linkErr = os.Rename(tmp, f); linkErr != nil {
+				fmt.Fprintln(opts.errOut(), "cannot replace file with link:", linkErr)
+				st.errors++
+			}
+		}
+		if linkErr != nil {
+			removeTemp(tmp)
+			opts.noteSpace(linkErr)
+			opts.Journal.done(intent, event, groupID, f, baseFile, linkErr)
+			if opts.Transactional {
+				rollback()
+				return st
+			}
+			// The file was not replaced, so does not count against the
+			// limits.
+			unspend(fInfo.Size())
+			continue // skip stats update
+		}
+		forgetTemp(tmp)
+		if opts.Sync {
+			if err = syncDir(path.Dir(f)); err != nil {
+				fmt.Fprintln(opts.errOut(), "failed to sync directory:", err)
+				st.errors++
+			}
+		}
+		if createSymlink {
+			event = journalSymlink
+			symlinkedInfos = append(symlinkedInfos, fInfo)
+		}
+		opts.Journal.done(intent, event, groupID, f, baseFile, nil)
+		st.saved += baseInfo.Size() - overhead
+		st.symlinkOverhead += overhead
+		st.links++
+		st.addOwnerSaved(fInfo, baseInfo.Size()-overhead)
+		st.addReclaimSaved(fInfo, baseInfo.Size()-overhead)
+		if opts.Mapping != nil {
+			mapping = append(mapping, [2]string{f, baseFile})
+		}
+		if strategy == StrategyHardlink && !createSymlink {
+			freeInode(fInfo)
+		}
+		linkedFiles = append(linkedFiles, f)
+	}
+	st.mapping = append(st.mapping, mapping...)
+	for _, f := range linkedFiles {
+		st.add(opts.linkSidecars(f, baseFile))
+	}
+	opts.normalizeBase(groupID, baseFile, baseInfo, symlinkedInfos, &st)
+	return st
+}
+
+// checkLink checks that the link created at tmp, before it replaces a file,
+// leads to baseFile, described by baseInfo.  A hardlink or symlink must be
+// the same file as baseFile, and a reflink, a copy, must be the same size.
+//
+// In a container, volumes from different host file systems may report the
+// same device number, or report device numbers that differ from those seen
+// by the host, so that files are not always where their device and inode
+// numbers say.  Checking the link before the file is removed means that a
+// file is never replaced by a link that does not lead to an identical file.
+func checkLink(tmp, baseFile string, baseInfo os.FileInfo, reflink bool) error {
+	// Follow the link at tmp, if a symlink, as the replaced file will be.
+	tmpInfo, err := os.Stat(tmp)
+	if err != nil {
+		return fmt.Errorf("cannot check link: %w", err)
+	}
+	if !tmpInfo.Mode().IsRegular() || tmpInfo.Size() != baseInfo.Size() {
+		return fmt.Errorf("link does not lead to a file the size of %s", baseFile)
+	}
+	if reflink {
+		return nil
+	}
+	// Stat the base file again, since creating a link may have changed its
+	// inode, such as by copying it up on an overlay file system.
+	baseNow, err := os.Stat(baseFile)
+	if err != nil {
+		return fmt.Errorf("cannot check link: %w", err)
+	}
+	if !os.SameFile(tmpInfo, baseNow) {
+		return fmt.Errorf("link does not lead to %s", baseFile)
+	}
+	return nil
+}
+
+// warnFallback warns that file is, or would be, replaced by a symlink to
+// baseFile because a hardlink cannot be created for the reason given by err.
+func warnFallback(file, baseFile string, err error, opts *Options) {
+	if opts.Quiet {
+		return
 	}
-	return linkCount, sizeSaved
+	source, _ := opts.symlinkSource(file, baseFile)
+	fmt.Fprintf(opts.errOut(), "WARNING: symlink fallback: %s ---> %s: %s\n", file, source, err)
 }
 
-func copyFile(dst, src string, perm os.FileMode) error {
+// reflinkFile creates dst as a reflink of src, sharing its data blocks.  The
+// data is never copied.
+func reflinkFile(dst, src string, perm os.FileMode) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
-	tmp, err := os.CreateTemp(filepath.Dir(dst), "")
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(tmp, in)
-	if err != nil {
-		tmp.Close()
-		os.Remove(tmp.Name())
+	if err = cloneFile(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
 		return err
 	}
-	if err = tmp.Close(); err != nil {
-		os.Remove(tmp.Name())
-		return err
+	return out.Close()
+}
+
+// backupFile keeps a file at a new temporary name in the same directory, and
+// returns the new name.  The backup must be removed with removeTemp, or
+// restored with os.Rename and forgetTemp.
+//
+// The backup is a hardlink to the file, so that the file stays in place
+// until its replacement is renamed over it.  Only if a hardlink cannot be
+// created is the file moved aside, leaving its name empty until replaced.
+func backupFile(file string) (string, error) {
+	dir, name := filepath.Split(file)
+	backup, err := tempName(dir, tempBackup, name)
+	if err != nil {
+		return "", err
 	}
-	if err = os.Chmod(tmp.Name(), perm); err != nil {
-		os.Remove(tmp.Name())
-		return err
+	if err = os.Link(file, backup); err == nil {
+		return backup, nil
 	}
-	if err = os.Rename(tmp.Name(), dst); err != nil {
-		os.Remove(tmp.Name())
-		return err
+	forgetTemp(backup)
+	tmp, err := createTemp(dir, tempBackup, name)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	tmp.Close()
+	if err = os.Rename(file, tmp.Name()); err != nil {
+		removeTemp(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
 }
 
-type pathSlice []string
-
-func (s pathSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s pathSlice) Len() int      { return len(s) }
-
-func (s pathSlice) Less(i, j int) bool {
-	// Sort by shortest-basename, shortest-path
-	pBaseLen := len(path.Base(s[i]))
-	qBaseLen := len(path.Base(s[j]))
-	if pBaseLen < qBaseLen {
-		return true
-	}
-	if qBaseLen < pBaseLen {
-		return false
+// syncDir flushes a directory's entries to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	// Base names are the same, so look at path.
-	return len(s[i]) < len(s[j])
+	defer d.Close()
+	return d.Sync()
 }
@@ -0,0 +1,153 @@
+package linksame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeGroup creates identical files at the paths, relative to dir, and
+// returns the group of them.
+func makeGroup(t *testing.T, dir string, paths ...string) *DuplicateGroup {
+	t.Helper()
+	for i := range paths {
+		paths[i] = filepath.Join(dir, paths[i])
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(paths[i], []byte("identical"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newDuplicateGroup("", 9, paths, io.Discard)
+}
+
+// linkOptions returns options for linking a group with linkGroup, with
+// MaxChanges and a policy budget so that what is spent can be checked.
+func linkOptions() *Options {
+	opts := &Options{
+		WriteLinks: true,
+		Quiet:      true,
+		MaxChanges: 10,
+		stdout:     io.Discard,
+		stderr:     io.Discard,
+	}
+	opts.prepareStrategies()
+	opts.prepareChanges()
+	opts.prepareSpace()
+	opts.budget = &policyBudget{limit: 1 << 20}
+	return opts
+}
+
+// checkUnspent checks that no changes or budget are counted as spent.
+func checkUnspent(t *testing.T, opts *Options) {
+	t.Helper()
+	if opts.changes.left != opts.MaxChanges {
+		t.Errorf("%d changes left, want %d", opts.changes.left, opts.MaxChanges)
+	}
+	if opts.budget.used != 0 {
+		t.Errorf("budget used %d, want 0", opts.budget.used)
+	}
+}
+
+// checkSeparate checks that none of the files are links to each other.
+func checkSeparate(t *testing.T, paths []string) {
+	t.Helper()
+	var infos []os.FileInfo
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("%s is not a regular file", p)
+		}
+		for _, other := range infos {
+			if os.SameFile(info, other) {
+				t.Errorf("%s is linked", p)
+			}
+		}
+		infos = append(infos, info)
+	}
+}
+
+func TestTransactionalRollback(t *testing.T) {
+	dir := t.TempDir()
+	// Files are replaced longest name first, and the symlink target of the
+	// deeply nested file is too long, so it cannot be replaced after the file
+	// beside the kept file is.
+	g := makeGroup(t, dir, "kept-file", "ab", "sub/dir/nested/b")
+	opts := linkOptions()
+	opts.Symlink = true
+	opts.MaxSymlinkTarget = len("kept-file")
+	opts.Transactional = true
+	opts.prepareStrategies()
+	journal := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Journal = j
+
+	st := linkGroup(g, opts)
+	j.Close()
+	if st.rolledBack != 1 {
+		t.Fatalf("rolled back %d groups, want 1", st.rolledBack)
+	}
+	if st.links != 0 || st.saved != 0 {
+		t.Errorf("rolled back group counts %d links saving %d", st.links, st.saved)
+	}
+	checkSeparate(t, g.Paths())
+	checkUnspent(t, opts)
+	leftovers, _ := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if len(leftovers) != 0 {
+		t.Error("temporary files left:", leftovers)
+	}
+	// The file beside the kept file was replaced, and then restored.
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{
+		`"event":"symlink","group":"` + g.ID() + `","path":"` + g.Paths()[1] + `","target":"` + g.Paths()[0] + `","phase":"done"`,
+		`"event":"rollback","group":"` + g.ID() + `","path":"` + g.Paths()[1] + `"`,
+	} {
+		if !bytes.Contains(data, []byte(record)) {
+			t.Errorf("journal has no record %s", record)
+		}
+	}
+
+	// Without Transactional, the file that can be replaced is, and only it
+	// is counted as spent.
+	opts = linkOptions()
+	opts.Symlink = true
+	opts.MaxSymlinkTarget = len("kept-file")
+	opts.prepareStrategies()
+	st = linkGroup(g, opts)
+	if st.links != 1 || st.rolledBack != 0 {
+		t.Errorf("replaced %d files and rolled back %d groups, want 1 and 0", st.links, st.rolledBack)
+	}
+	if opts.changes.left != opts.MaxChanges-1 || opts.budget.used != 9 {
+		t.Errorf("%d changes left and budget used %d, want %d and 9",
+			opts.changes.left, opts.budget.used, opts.MaxChanges-1)
+	}
+}
+
+func TestJournalFailureStopsLinking(t *testing.T) {
+	for _, transactional := range []bool{false, true} {
+		g := makeGroup(t, t.TempDir(), "kept-file", "a", "b")
+		opts := linkOptions()
+		opts.Transactional = transactional
+		opts.Journal = &Journal{err: errors.New("journal failed")}
+
+		st := linkGroup(g, opts)
+		if st.links != 0 {
+			t.Errorf("transactional %t: replaced %d files after the journal failed", transactional, st.links)
+		}
+		checkSeparate(t, g.Paths())
+		checkUnspent(t, opts)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gammazero/linksame"
+	"github.com/gammazero/linksame/internal/synthtree"
+)
+
+// benchCommand defines the bench command, which generates a synthetic
+// directory tree with duplicate files and measures how long it takes to find
+// them.  It returns the flags and a function that runs the command.
+func benchCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "bench [options]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var dir = fs.String("dir", "",
+		"Directory to create synthetic tree in (default temporary directory)")
+	var files = fs.Int("files", 10000, "Number of files to generate")
+	var maxSize = fs.Int("size", 64*1024, "Maximum file size in bytes")
+	var dupRatio = fs.Float64("dup", 0.5,
+		"Fraction of files that are duplicates of other files")
+	var perDir = fs.Int("perdir", 100, "Number of files in each directory")
+	var runs = fs.Int("runs", 3, "Number of times to scan the tree")
+	var seed = fs.Int64("seed", 1, "Random seed for generating the tree")
+	var keep = fs.Bool("keep", false, "Keep generated tree after benchmark")
+	return fs, func() {
+
+		if *files < 1 || *maxSize < 1 || *perDir < 1 || *dupRatio < 0 || *dupRatio > 1 {
+			fmt.Fprintln(os.Stderr, "invalid benchmark parameters")
+			os.Exit(2)
+		}
+
+		root, err := os.MkdirTemp(*dir, "lnsame-bench-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !*keep {
+			defer os.RemoveAll(root)
+		}
+
+		fmt.Println("Generating", *files, "files in", root)
+		start := time.Now()
+		total, err := synthtree.Generate(root, *files, *maxSize, *perDir, *dupRatio, *seed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Generated %d bytes in %s\n", total, time.Since(start).Round(time.Millisecond))
+
+		for i := 1; i <= *runs; i++ {
+			start = time.Now()
+			err = linksame.LinkSame([]string{root}, linksame.Options{Quiet: true})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			elapsed := time.Since(start)
+			fmt.Printf("Run %d: %s, %.0f files/s, %.1f MB/s\n", i,
+				elapsed.Round(time.Millisecond),
+				float64(*files)/elapsed.Seconds(),
+				float64(total)/elapsed.Seconds()/1e6)
+		}
+	}
+}
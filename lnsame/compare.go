@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gammazero/linksame"
+)
+
+// compareCommand defines the compare command, which reports the files that
+// are identical, that differ, and that are only in one of two directories,
+// and optionally links the identical files.  It returns the flags and a
+// function that runs the command.
+func compareCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"compare [options] dir1 dir2")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var pattern = fs.String("pattern", "",
+		"Only compare files matching pattern")
+	var exts = fs.String("ext", "",
+		"Only compare files with these comma-separated extensions")
+	var notExts = fs.String("not-ext", "",
+		"Do not compare files with these comma-separated extensions")
+	var xattrCache = fs.Bool("xattr", false,
+		"Cache file hashes in extended attributes to speed up later runs")
+	var jsonOut = fs.Bool("json", false,
+		"Write the comparison as JSON to stdout, instead of other output")
+	var verbose = fs.Bool("v", false,
+		"Verbose - also list the identical files")
+	var link = fs.Bool("link", false,
+		"Link the identical files")
+	var symlink = fs.Bool("symlink", false, "With -link, link files using only symlinks")
+	var absolute = fs.Bool("absolute", false,
+		"Use absolute instead of relative symlinks")
+	var writeLinks = fs.Bool("w", false, "With -link, write links to file system")
+	var safe = fs.Bool("safe", false,
+		"Do not link files with different permissions or ownership")
+	var quiet = fs.Bool("q", false,
+		"Quiet - suppress output messages and warnings while linking")
+	var journal = fs.String("journal", "",
+		"Append a tamper-evident record of modifications to this file")
+	var policy = fs.String("policy", "",
+		"Enforce the limits in this policy file, in addition to "+systemPolicyFile)
+	return fs, func() {
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		left, right := fs.Arg(0), fs.Arg(1)
+		c, err := linksame.Compare(left, right, linksame.Options{
+			Pattern:       *pattern,
+			Extensions:    parseList(*exts),
+			NotExtensions: parseList(*notExts),
+			XattrCache:    *xattrCache,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(c)
+		} else {
+			if *verbose {
+				for _, rel := range c.Identical {
+					fmt.Println("Files", filepath.Join(left, rel), "and", filepath.Join(right, rel), "are identical")
+				}
+			}
+			for _, rel := range c.Differing {
+				fmt.Println("Files", filepath.Join(left, rel), "and", filepath.Join(right, rel), "differ")
+			}
+			for _, rel := range c.OnlyLeft {
+				fmt.Printf("Only in %s: %s\n", left, rel)
+			}
+			for _, rel := range c.OnlyRight {
+				fmt.Printf("Only in %s: %s\n", right, rel)
+			}
+			_, err = fmt.Printf("%d identical, %d differing, %d only in %s, %d only in %s\n",
+				len(c.Identical), len(c.Differing), len(c.OnlyLeft), left, len(c.OnlyRight), right)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !*link || len(c.Identical) == 0 {
+			return
+		}
+
+		// Each pair of identical files is a group to link.
+		groups := make([][]string, len(c.Identical))
+		for i, rel := range c.Identical {
+			groups[i] = []string{filepath.Join(left, rel), filepath.Join(right, rel)}
+		}
+		opts := linksame.Options{
+			WriteLinks: *writeLinks,
+			Symlink:    *symlink,
+			Absolute:   *absolute,
+			Safe:       *safe,
+			Verify:     true,
+			Quiet:      *quiet || *jsonOut,
+			Journal:    openJournal(*journal),
+			Policies:   loadPolicies(*policy),
+		}
+		err = linksame.LinkGroups(groups, opts)
+		err = closeJournal(opts.Journal, err)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
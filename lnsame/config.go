@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// systemConfigFile is the config used when the user has none of their own.
+const systemConfigFile = "/etc/lnsame/config.json"
+
+// config holds the named profiles that the run command runs.
+type config struct {
+	Profiles map[string]profile `json:"profiles"`
+}
+
+// profile is a set of roots and options for linking identical files.
+type profile struct {
+	// Roots are the directories linked within, unless others are given on
+	// the command line.
+	Roots []string `json:"roots"`
+	// Flags maps the names of the options of the link command, without the
+	// leading dash, to their values.  A list is given as a comma-separated
+	// value.
+	Flags map[string]interface{} `json:"flags"`
+}
+
+// defaultConfigFile returns the config in the user's config directory, if it
+// exists, or else the system config.
+func defaultConfigFile() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		name := filepath.Join(dir, "lnsame", "config.json")
+		if _, err = os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return systemConfigFile
+}
+
+// loadConfig reads a config from a JSON file.  Unknown fields are an error,
+// so that a misspelled setting is not silently ignored.
+func loadConfig(name string) (*config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err = dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("config %s: %w", name, err)
+	}
+	return &c, nil
+}
+
+// flagValue returns the value of a profile flag as given on the command line.
+func flagValue(v interface{}) string {
+	if items, ok := v.([]interface{}); ok {
+		s := make([]string, len(items))
+		for i := range items {
+			s[i] = fmt.Sprint(items[i])
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// runCommand defines the run command, which links identical files with the
+// roots and options of a profile in the config.  It returns the flags and a
+// function that runs the command.
+func runCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "run [-config file] profile [options] [root ..]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options after the profile override those of the profile, and")
+		fmt.Fprintln(os.Stderr, "roots replace its roots.  With no profile, the profiles are listed.")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var configFile = fs.String("config", "",
+		"Read profiles from this file (default ~/.config/lnsame/config.json, or else "+systemConfigFile+")")
+	return fs, func() {
+		if *configFile == "" {
+			*configFile = defaultConfigFile()
+		}
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if fs.NArg() == 0 {
+			names := make([]string, 0, len(c.Profiles))
+			for name := range c.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			return
+		}
+
+		name := fs.Arg(0)
+		p, ok := c.Profiles[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "config %s: no profile %q\n", *configFile, name)
+			os.Exit(2)
+		}
+		linkFS, run := linkCommand()
+		flags := make([]string, 0, len(p.Flags))
+		for f := range p.Flags {
+			flags = append(flags, f)
+		}
+		sort.Strings(flags)
+		for _, f := range flags {
+			if linkFS.Lookup(f) == nil {
+				fmt.Fprintf(os.Stderr, "profile %s: unknown option -%s\n", name, f)
+				os.Exit(2)
+			}
+			if err = linkFS.Set(f, flagValue(p.Flags[f])); err != nil {
+				fmt.Fprintf(os.Stderr, "profile %s: -%s: %s\n", name, f, err)
+				os.Exit(2)
+			}
+		}
+		linkFS.Parse(fs.Args()[1:])
+		if linkFS.NArg() == 0 {
+			linkFS.Parse(append([]string{"--"}, p.Roots...))
+		}
+		run()
+	}
+}
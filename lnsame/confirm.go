@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gammazero/linksame"
+)
+
+// confirmChanges does a dry run of linking within roots, or of linking
+// updateFile if not empty, and if the run would replace more than percent of
+// the files considered, asks on the terminal whether to go ahead.  A run that
+// changes far more than expected is most often the result of a mistaken
+// pattern or filter.  It returns an error if the run is not confirmed, which
+// it cannot be without a terminal.
+func confirmChanges(percent float64, updateFile string, roots []string, opts linksame.Options) error {
+	var summary linksame.Summary
+	opts.WriteLinks = false
+	opts.Quiet = true
+	opts.Verbose = false
+	opts.Summary = &summary
+	var err error
+	if updateFile != "" {
+		err = linksame.LinkSameUpdate(updateFile, roots, opts)
+	} else {
+		err = linksame.LinkSame(roots, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if summary.Candidates == 0 {
+		return nil
+	}
+	planned := 100 * float64(summary.Linked.Files) / float64(summary.Candidates)
+	if planned <= percent {
+		return nil
+	}
+
+	plan := fmt.Sprintf("This run would replace %d of %d files (%.1f%%), more than -max-change-percent %g%%",
+		summary.Linked.Files, summary.Candidates, planned, percent)
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s; check the files selected, or give -yes to replace them", plan)
+	}
+	fmt.Fprint(os.Stderr, plan+".  Continue? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not confirmed")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// command is a command named by the first argument.
+type command struct {
+	name string
+	// synopsis is the usage of the command, without the program name.
+	synopsis string
+	// summary describes what the command does.
+	summary string
+	// define defines the flags of the command, and returns them and a
+	// function that runs the command after they are parsed.
+	define func() (*flag.FlagSet, func())
+}
+
+// commands returns the commands named by the first argument.
+func commands() []command {
+	return []command{
+		{"run", "run [-config file] profile [options] [root ..]",
+			"Link identical files with the roots and options of a profile in the config.", runCommand},
+		{"relink", "relink -relative|-absolute [options] [root ..]",
+			"Rewrite existing symlinks as absolute or relative.", relinkCommand},
+		{"report", "report [options] [root ..]",
+			"Report the space already saved by existing links.", reportCommand},
+		{"preview", "preview [options] [root ..]",
+			"Report likely duplicate files from their metadata, without reading them.", previewCommand},
+		{"apply", "apply -from results [options]",
+			"Link the duplicate files listed in a JSON report of lnsame, or in the output of rmlint or rdfind.", applyCommand},
+		{"compare", "compare [options] dir1 dir2",
+			"Report the files identical, differing, and unique in two directories, and optionally link the identical ones.", compareCommand},
+		{"merge", "merge -into dir1 [options] dir2",
+			"Link the files in dir2 to the identical files at the same paths in dir1, and list those that differ.", mergeCommand},
+		{"bench", "bench [options]",
+			"Generate a synthetic tree with duplicate files and measure how long it takes to find them.", benchCommand},
+		{"verify-journal", "verify-journal journal",
+			"Check that a journal has not been tampered with, and print the hash of its last entry.", verifyJournalCommand},
+		{"history", "history [options] journal",
+			"Report the space saved by each run recorded in a journal, and in total.", historyCommand},
+		{"docs", "docs -man|-markdown",
+			"Write documentation of all commands and options.", docsCommand},
+	}
+}
+
+// docsCommand defines the docs command, which writes a man page or markdown
+// reference generated from the definitions of the commands and their flags.
+// It returns the flags and a function that runs the command.
+func docsCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("docs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "docs -man|-markdown")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var man = fs.Bool("man", false, "Write a man page in roff format")
+	var markdown = fs.Bool("markdown", false, "Write a reference in markdown")
+	return fs, func() {
+		if *man == *markdown {
+			fmt.Fprintln(os.Stderr, "specify one of -man or -markdown")
+			fs.Usage()
+			os.Exit(2)
+		}
+		var err error
+		if *man {
+			err = writeMan(os.Stdout, "lnsame")
+		} else {
+			err = writeMarkdown(os.Stdout, "lnsame")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// docFlag describes a flag for documentation.
+type docFlag struct {
+	name string
+	// arg names the value of the flag, if it is not a boolean flag.
+	arg  string
+	help string
+}
+
+// docFlags returns the descriptions of the flags defined by define, in
+// lexical order.
+func docFlags(define func() (*flag.FlagSet, func())) []docFlag {
+	fs, _ := define()
+	var flags []docFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		arg, help := flag.UnquoteUsage(f)
+		switch f.DefValue {
+		case "", "false", "0", "0s":
+		default:
+			help += " (default " + f.DefValue + ")"
+		}
+		flags = append(flags, docFlag{f.Name, arg, help})
+	})
+	return flags
+}
+
+// writeMan writes a man page for the program, in roff format.
+func writeMan(w io.Writer, prog string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH %s 1\n", strings.ToUpper(prog))
+	b.WriteString(".SH NAME\n")
+	fmt.Fprintf(&b, "%s \\- %s\n", prog, roffEscape(strings.TrimSuffix(strings.ToLower(linkSummary[:1])+linkSummary[1:], ".")))
+	b.WriteString(".SH SYNOPSIS\n")
+	fmt.Fprintf(&b, ".B %s\n%s\n", prog, roffEscape("[options] [root ..]"))
+	for _, c := range commands() {
+		fmt.Fprintf(&b, ".br\n.B %s\n%s\n", prog, roffEscape(c.synopsis))
+	}
+	b.WriteString(".SH DESCRIPTION\n")
+	b.WriteString(roffEscape(strings.Join(linkDescription, "\n")) + "\n")
+	b.WriteString(".SH OPTIONS\n")
+	writeManFlags(&b, docFlags(linkCommand))
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range commands() {
+		fmt.Fprintf(&b, ".SS %s\n", roffEscape(c.name))
+		fmt.Fprintf(&b, ".B %s\n%s\n.PP\n", prog, roffEscape(c.synopsis))
+		b.WriteString(roffEscape(c.summary) + "\n")
+		writeManFlags(&b, docFlags(c.define))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeManFlags writes a tagged paragraph for each flag.
+func writeManFlags(b *strings.Builder, flags []docFlag) {
+	for _, f := range flags {
+		b.WriteString(".TP\n\\fB\\-" + roffEscape(f.name) + "\\fR")
+		if f.arg != "" {
+			b.WriteString(" \\fI" + roffEscape(f.arg) + "\\fR")
+		}
+		b.WriteString("\n" + roffEscape(f.help) + "\n")
+	}
+}
+
+// roffEscape escapes text so that roff prints it as is.
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeMarkdown writes a reference for the program in markdown.
+func writeMarkdown(w io.Writer, prog string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n\n", prog, linkSummary)
+	b.WriteString("## Synopsis\n\n```\n")
+	fmt.Fprintf(&b, "%s [options] [root ..]\n", prog)
+	for _, c := range commands() {
+		fmt.Fprintf(&b, "%s %s\n", prog, c.synopsis)
+	}
+	b.WriteString("```\n\n## Description\n\n")
+	b.WriteString(strings.Join(linkDescription, "\n") + "\n\n")
+	b.WriteString("## Options\n")
+	writeMarkdownFlags(&b, docFlags(linkCommand))
+	b.WriteString("\n## Commands\n")
+	for _, c := range commands() {
+		fmt.Fprintf(&b, "\n### %s\n\n```\n%s %s\n```\n\n%s\n", c.name, prog, c.synopsis, c.summary)
+		writeMarkdownFlags(&b, docFlags(c.define))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMarkdownFlags writes a list item for each flag, preceded by a blank
+// line.
+func writeMarkdownFlags(b *strings.Builder, flags []docFlag) {
+	if len(flags) != 0 {
+		b.WriteString("\n")
+	}
+	for _, f := range flags {
+		usage := "-" + f.name
+		if f.arg != "" {
+			usage += " " + f.arg
+		}
+		fmt.Fprintf(b, "- `%s`: %s\n", usage, f.help)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gammazero/linksame"
+)
+
+// cleanupOnInterrupt cleans up temporary files, restoring files that were
+// moved aside, and exits when the program is interrupted or terminated.
+func cleanupOnInterrupt() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Fprintln(os.Stderr, "stopping on", sig)
+		linksame.RemoveTempFiles()
+		os.Exit(130)
+	}()
+}
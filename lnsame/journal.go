@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gammazero/linksame"
+)
+
+// openJournal opens the named journal, or returns nil if name is empty.  The
+// program exits if the journal cannot be opened.
+func openJournal(name string) *linksame.Journal {
+	if name == "" {
+		return nil
+	}
+	j, err := linksame.OpenJournal(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return j
+}
+
+// closeJournal closes the journal, if not nil, and returns err or else the
+// error from closing the journal.
+func closeJournal(j *linksame.Journal, err error) error {
+	if j == nil {
+		return err
+	}
+	if cerr := j.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// verifyJournalCommand defines the verify-journal command, which checks that
+// a journal has not been tampered with.  It returns the flags and a function
+// that runs the command.
+func verifyJournalCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("verify-journal", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "verify-journal journal")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Prints the hash of the last entry, which may be recorded to")
+		fmt.Fprintln(os.Stderr, "detect later changes to that entry.")
+	}
+	return fs, func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		head, err := linksame.VerifyJournal(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fs.Arg(0)+":", err)
+			os.Exit(1)
+		}
+		fmt.Println(head)
+	}
+}
+
+// historyCommand defines the history command, which reports the space saved
+// by each run recorded in a journal, and in total.  It returns the flags and
+// a function that runs the command.
+func historyCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "history [options] journal")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Runs are recorded in the journal given to -journal when")
+		fmt.Fprintln(os.Stderr, "linking files.")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var jsonOut = fs.Bool("json", false, "Write the runs as JSON")
+	var units = fs.String("units", "short",
+		"Units of sizes in output: short (1.5M), binary (1.5 MiB), or si (1.6 MB); digits are grouped per LC_NUMERIC")
+	var exactBytes = fs.Bool("bytes", false, "Write sizes in output as exact numbers of bytes")
+	return fs, func() {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		sizeFmt, err := parseSizeFormat(*units, *exactBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		runs, err := linksame.JournalHistory(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fs.Arg(0)+":", err)
+			os.Exit(1)
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(struct {
+				Runs []linksame.Run `json:"runs"`
+			}{runs})
+		} else {
+			err = linksame.WriteHistory(os.Stdout, runs, sizeFmt)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -1,71 +1,1010 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"os/user"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/gammazero/linksame"
 )
 
+// linkSummary summarizes the command that links identical files.
+const linkSummary = "Replace identical files with links to one real file."
+
+// linkDescription describes the command that links identical files.
+var linkDescription = []string{
+	"Search recursively through the top level directory to find identical files.",
+	"For each set of identical files, keep only the file with the longest name and",
+	"replace all other copies with hardlinks or symlinks to that file.",
+}
+
+// defaultMaxLinkSize is the size of the largest file linked unless -force or
+// another -max-link-size is given.
+const defaultMaxLinkSize = "64G"
+
+// namePrefix starts a -strategy item for files matching a pattern, instead
+// of files in a directory.
+const namePrefix = "name:"
+
 func main() {
-	flag.Usage = func() {
+	cleanupOnInterrupt()
+	define, args := linkCommand, os.Args[1:]
+	if len(os.Args) > 1 {
+		for _, c := range commands() {
+			if c.name == os.Args[1] {
+				define, args = c.define, os.Args[2:]
+				break
+			}
+		}
+	}
+	fs, run := define()
+	fs.Parse(args)
+	run()
+}
+
+// linkCommand defines the command that links identical files, which is run
+// when no other command is named.  It returns the flags and a function that
+// runs the command.
+func linkCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet(path.Base(os.Args[0]), flag.ExitOnError)
+	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage:")
 		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), "[options] [root ..]")
+		for _, c := range commands() {
+			fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]), c.synopsis)
+		}
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Options:")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 	}
 
-	var symlink = flag.Bool("symlink", false, "Link files using only symlinks")
-	var absolute = flag.Bool("absolute", false,
+	var symlink = fs.Bool("symlink", false, "Link files using only symlinks")
+	var absolute = fs.Bool("absolute", false,
 		"Use absolute instead of relative symlinks")
-	var update = flag.String("update", "",
+	var update = fs.String("update", "",
 		"Only link files identical to specified update file")
-	var pattern = flag.String("pattern", "",
+	var pattern = fs.String("pattern", "",
 		"Only link files matching pattern")
-	var writeLinks = flag.Bool("w", false, "Write links to file system")
-	var safe = flag.Bool("safe", false,
+	var writeLinks = fs.Bool("w", false, "Write links to file system")
+	var safe = fs.Bool("safe", false,
 		"Do not link files with different permissions or ownership")
-	var quiet = flag.Bool("q", false,
+	var quiet = fs.Bool("q", false,
 		"Quiet - suppress output messages and warnings")
-	var verbose = flag.Bool("v", false,
+	var verbose = fs.Bool("v", false,
 		"Verbose - print individual link creation messages")
-	var help = flag.Bool("help", false, "Show help")
-	flag.Parse()
+	var units = fs.String("units", "short",
+		"Units of sizes in output: short (1.5M), binary (1.5 MiB), or si (1.6 MB); digits are grouped per LC_NUMERIC")
+	var exactBytes = fs.Bool("bytes", false, "Write sizes in output as exact numbers of bytes")
+	var verboseLimit = fs.Int("verbose-limit", 0,
+		"With -v, print this many links individually, then summarize them periodically and by directory")
+	var verify = fs.Bool("verify", false,
+		"Compare file contents byte-for-byte before linking")
+	var xattrCache = fs.Bool("xattr", false,
+		"Cache file hashes in extended attributes")
+	var scanCache = fs.String("scan-cache", "",
+		"Cache directory metadata in this file, to skip stat'ing unchanged directories on later runs")
+	var allowPrivileged = fs.Bool("allow-privileged", false,
+		"Link setuid, setgid, and capability-bearing files")
+	var sync = fs.Bool("sync", false,
+		"Flush directories to storage after each link")
+	var transactional = fs.Bool("transactional", false,
+		"Restore all files in a set of identical files if any fail to link")
+	var rewriteSymlinks = fs.Bool("rewrite-symlinks", false,
+		"Rewrite existing symlinks to be absolute or relative, with -symlink")
+	var strategies = fs.String("strategy", "",
+		"Comma-separated dir=strategy or name:pattern=strategy list, where strategy is hardlink, symlink, reflink, or report")
+	var preferShallow = fs.Bool("shallow", false,
+		"Keep the file with the shortest path when names are the same length")
+	var keep = fs.String("keep", "default",
+		"Which identical file to keep: name (longest name), cluster (most hardlinks), oldest-created, or newest-created")
+	var keepIn = fs.String("keep-in", "",
+		"Comma-separated directories in which to keep a file of each set of identical files, in order of preference, whatever -keep selects")
+	var owner = fs.String("owner", "",
+		"Only link files owned by these comma-separated users or user IDs")
+	var group = fs.String("group", "",
+		"Only link files with these comma-separated groups or group IDs")
+	var exts = fs.String("ext", "",
+		"Only link files with these comma-separated extensions, such as jpg,png")
+	var notExts = fs.String("not-ext", "",
+		"Do not link files with these comma-separated extensions")
+	var types = fs.String("type", "",
+		"Only link files with these comma-separated content types, such as image, video, or application/x-sharedlib")
+	var allowCrossOwner = fs.Bool("allow-cross-owner", false,
+		"Link files with different owners on file systems with disk quotas")
+	var scope = fs.String("scope", "any",
+		"Which identical files to link: any, dirs (only sets spanning directories), roots (only sets spanning roots), or versioned (only versions of a name in one directory)")
+	var scanArchives = fs.Bool("archives", false,
+		"Report files that also exist in tar and zip archives")
+	var mapping = fs.String("mapping", "",
+		"Write mapping of duplicate to kept files to this file")
+	var escalate = fs.String("escalate", "",
+		"Write a script of the operations that need privileges to this file, to run with sudo, instead of skipping or failing them")
+	var decompress = fs.Bool("decompress", false,
+		"Report files that are the same as decompressed .gz and .bz2 files")
+	var noFallback = fs.Bool("no-fallback", false,
+		"Leave files in place when hardlinks cannot be created, instead of using symlinks")
+	var journal = fs.String("journal", "",
+		"Append a tamper-evident record of modifications to this file")
+	var policy = fs.String("policy", "",
+		"Enforce the limits in this policy file, in addition to "+systemPolicyFile)
+	var jsonOut = fs.Bool("json", false,
+		"Write summary as JSON to stdout, instead of other output")
+	var notifyWebhook = fs.String("notify-webhook", "",
+		"Post the summary as JSON to this URL when the run completes or fails")
+	var notifyEmail = fs.String("notify-email", "",
+		"Email the summary as JSON to these comma-separated addresses when the run completes or fails")
+	var notifyFrom = fs.String("notify-from", "",
+		"Sender of -notify-email messages (default lnsame@hostname)")
+	var smtpServer = fs.String("smtp", "localhost:25",
+		"SMTP server, as host:port, that relays -notify-email messages")
+	var minFree = fs.String("min-free-space", "",
+		"Stop before free space on a file system drops below this size, such as 500M or 2G")
+	var anchor = fs.String("anchor", "",
+		"Make relative symlinks climb to this directory and descend from it to the file linked to")
+	var anchorRoot = fs.Bool("anchor-root", false,
+		"Make relative symlinks climb to their root and descend from it to the file linked to")
+	var targetStyle = fs.String("target-style", "auto",
+		"Form of symlink targets: auto (relative, or absolute with -absolute), relative, absolute, or basename (name if in the same directory, otherwise absolute)")
+	var symlinkMetadata = fs.String("symlink-metadata", "keep",
+		"Set the mode and ownership of files linked to by new symlinks: keep, strictest (permissions all replaced files allow), or common (most common among replaced files)")
+	var maxTarget = fs.Int("max-symlink-target", 0,
+		"Longest symlink target to create, in bytes (default system limit)")
+	var pauseLowSpace = fs.Duration("pause-low-space", 0,
+		"With -min-free-space, pause up to this long, such as 10m, for free space to recover before stopping")
+	var slowStorage = fs.Bool("slow-storage", false,
+		"Minimize reads on slow or costly storage, such as s3fs or rclone mounts, by hashing only the start of files; results are provisional, and -w requires -verify")
+	var prefixSize = fs.String("prefix-size", "",
+		"With -slow-storage, bytes to hash at the start of each file, such as 1M (default 64K)")
+	var readBudget = fs.String("read-budget", "",
+		"Read at most this much to hash files, such as 10G; files beyond it are not hashed")
+	var includeSnapshots = fs.Bool("include-snapshots", false,
+		"Scan snapshot directories, such as .zfs/snapshot, .snapshot, and @GMT-*, to report files only duplicated in snapshots")
+	var skipSparse = fs.Bool("skip-sparse", false,
+		"Do not link sparse files, whose holes take no storage")
+	var linkReflinked = fs.Bool("link-reflinked", false,
+		"Link files that already share all their data by reflink, which are otherwise skipped")
+	var tailFirst = fs.String("tail-first", "",
+		"Comma-separated patterns of file names, such as *.log, of files compared by their ends before being read whole")
+	var sampleFirst = fs.String("sample-first", "",
+		"Compare files at least this large, such as 64M, by a sample of chunks before reading them whole")
+	var minSize = fs.String("min-size", "",
+		"Do not link files smaller than this, such as 1M")
+	var protect = fs.String("protect", "",
+		"Comma-separated patterns of files never linked, matched as a policy's forbidden_patterns")
+	var preset = fs.String("preset", "",
+		"Use the options of a preset, except those given: "+strings.Join(presetNames(), ", "))
+	var gracePeriod = fs.Duration("grace-period", 0,
+		"Leave files modified less than this long ago, such as 10m, for a later run")
+	var includeTemp = fs.Bool("include-temp", false,
+		"Link temporary files of editors and downloads, such as *~, *.swp, and *.part, which are otherwise skipped")
+	var trustManifests = fs.Bool("trust-manifests", false,
+		"Take the hashes of files from SHA256SUMS, or older SHA1SUMS, manifests, after checking a sample, instead of reading the files")
+	var store = fs.String("store", "",
+		"Optimize this Nix store, such as /nix/store, as nix-store --optimise does: hardlink only, skipping invalid store paths")
+	var maildir = fs.Bool("maildir", false,
+		"Link only messages in Maildir folders, with hardlinks only, skipping drafts and trashed messages")
+	var sidecars = fs.Bool("sidecars", false,
+		"Do not symlink photos and videos away from their .xmp or .aae sidecars, and list the sidecars of replaced files")
+	var linkSidecars = fs.Bool("link-sidecars", false,
+		"With -sidecars, link the sidecars of replaced files to the identical sidecars of the files kept")
+	var strict = fs.Bool("strict", false,
+		"Exit with an error if any file is skipped, symlinked because it could not be hardlinked, or has an error")
+	var resources = fs.Bool("resources", false,
+		"Report the CPU time, time scanning and linking, data read, and peak memory of the run")
+	var tagMessages = fs.Bool("tag", false,
+		"Prefix messages printed while linking with the ID of the set of files and the number of the linker, such as [3f2a9c81d0e4 w3]")
+	var maxChanges = fs.Int("max-changes", 0,
+		"Stop replacing files after this many have been replaced, so that an unexpectedly large run can be checked")
+	var maxChangePercent = fs.Float64("max-change-percent", 50,
+		"With -w, ask before a run that would replace more than this percent of the files considered, found by a dry run first, whose hashes the run reuses (0 to not check)")
+	var yes = fs.Bool("yes", false,
+		"Do not ask before a run that exceeds -max-change-percent")
+	var maxLinkSize = fs.String("max-link-size", defaultMaxLinkSize,
+		"Do not link files larger than this, such as 100G, unless -force is given")
+	var maxGroupSize = fs.String("max-group-size", "",
+		"Do not link sets of identical files totaling more than this, such as 1T, unless -force is given")
+	var force = fs.Bool("force", false,
+		"Link files regardless of -max-link-size and -max-group-size")
+	var jobs = fs.String("jobs", "",
+		"Number of files to hash at once, or auto to adjust while running")
+	var pprofAddr = fs.String("pprof", "",
+		"Serve net/http/pprof profiles at this address, such as :6060")
+	var traceFile = fs.String("trace", "",
+		"Write execution trace to this file")
+	var capabilities = fs.Bool("capabilities", false,
+		"Write what this build can do on this platform as JSON, and exit")
+	var help = fs.Bool("help", false, "Show help")
+	return fs, func() {
+		if *capabilities {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(linksame.GetCapabilities()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+		if *help {
+			fmt.Fprintln(os.Stderr, path.Base(os.Args[0]), "-", linkSummary)
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Description:")
+			for _, line := range linkDescription {
+				fmt.Fprintln(os.Stderr, " ", line)
+			}
 
-	if *help {
-		fmt.Fprintln(os.Stderr, path.Base(os.Args[0]),
-			"- Replace identical files with links to one real file.")
-		fmt.Fprintln(os.Stderr)
-		fmt.Fprintln(os.Stderr, "Description:")
-		fmt.Fprintln(os.Stderr, " ",
-			"Search recursively through the top level directory to find identical files.")
-		fmt.Fprintln(os.Stderr, " ",
-			"For each set of identical files, keep only the file with the longest name and")
-		fmt.Fprintln(os.Stderr, " ",
-			"replace all other copies with hardlinks or symlinks to that file.")
+			fmt.Fprintln(os.Stderr)
+			fs.Usage()
+			os.Exit(0)
+		}
 
-		fmt.Fprintln(os.Stderr)
-		flag.Usage()
-		os.Exit(0)
+		if *preset != "" {
+			if err := applyPreset(fs, *preset); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		if *quiet || *jsonOut {
+			fs.Set("v", "false")
+		}
+
+		strategyMap, nameStrategyMap, err := parseStrategies(*strategies)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		keepPolicy, err := linksame.ParseKeepPolicy(*keep)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		scopeValue, err := linksame.ParseScope(*scope)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		targetStyleValue, err := linksame.ParseTargetStyle(*targetStyle)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		metadataPolicy, err := linksame.ParseMetadataPolicy(*symlinkMetadata)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		owners, err := parseIDs(*owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		ownerGroups, err := parseIDs(*group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		jobCount, autoJobs, err := parseJobs(*jobs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		minFreeSpace, err := parseSize(*minFree)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		prefixBytes, err := parseSize(*prefixSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		readBytes, err := parseSize(*readBudget)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		sampleBytes, err := parseSize(*sampleFirst)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		minBytes, err := parseSize(*minSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		protected := parseList(*protect)
+		for _, pattern := range protected {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "protect pattern %q: %s\n", pattern, err)
+				os.Exit(2)
+			}
+		}
+		maxLinkBytes, maxGroupBytes, err := parseSizeLimits(*maxLinkSize, *maxGroupSize, *force)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		sizeFmt, err := parseSizeFormat(*units, *exactBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		opts := linksame.Options{
+			Pattern:         *pattern,
+			WriteLinks:      *writeLinks,
+			Symlink:         *symlink,
+			Absolute:        *absolute,
+			Safe:            *safe,
+			Quiet:           *quiet,
+			Verbose:         *verbose,
+			Sync:            *sync,
+			Transactional:   *transactional,
+			RewriteSymlinks: *rewriteSymlinks,
+			Strategies:      strategyMap,
+			NameStrategies:  nameStrategyMap,
+			PreferShallow:   *preferShallow,
+			Keep:            keepPolicy,
+			KeepDirs:        parseList(*keepIn),
+			ScanArchives:    *scanArchives,
+			Decompress:      *decompress,
+			Verify:          *verify,
+			XattrCache:      *xattrCache,
+			AllowPrivileged: *allowPrivileged,
+			Jobs:            jobCount,
+			AutoJobs:        autoJobs,
+			NoFallback:      *noFallback,
+			Scope:           scopeValue,
+			Owners:          owners,
+			OwnerGroups:     ownerGroups,
+			AllowCrossOwner: *allowCrossOwner,
+			Types:           parseTypes(*types),
+			Extensions:      parseList(*exts),
+			NotExtensions:   parseList(*notExts),
+			MinFreeSpace:    minFreeSpace,
+			PauseLowSpace:   *pauseLowSpace,
+		}
+		if *jsonOut {
+			// Only the JSON is written to stdout.
+			opts.Quiet = true
+		}
+		opts.MaxSymlinkTarget = *maxTarget
+		opts.SymlinkAnchor = *anchor
+		opts.AnchorAtRoot = *anchorRoot
+		opts.TargetStyle = targetStyleValue
+		opts.SymlinkMetadata = metadataPolicy
+		opts.SlowStorage = *slowStorage
+		opts.PrefixSize = prefixBytes
+		opts.ReadBudget = readBytes
+		opts.IncludeSnapshots = *includeSnapshots
+		opts.SkipSparse = *skipSparse
+		opts.LinkReflinked = *linkReflinked
+		opts.TailFirst = parseList(*tailFirst)
+		opts.SampleFirst = sampleBytes
+		opts.MinSize = minBytes
+		opts.TagMessages = *tagMessages
+		opts.GracePeriod = *gracePeriod
+		opts.IncludeTempFiles = *includeTemp
+		opts.TrustManifests = *trustManifests
+		opts.Store = *store
+		opts.Maildir = *maildir
+		opts.ReportResources = *resources
+		opts.Strict = *strict
+		opts.Sidecars = *sidecars
+		opts.LinkSidecars = *linkSidecars
+		opts.MaxChanges = *maxChanges
+		opts.VerboseLimit = *verboseLimit
+		opts.ScanCache = *scanCache
+		opts.SizeFormat = sizeFmt
+		opts.MaxLinkSize = maxLinkBytes
+		opts.MaxGroupSize = maxGroupBytes
+		opts.Policies = loadPolicies(*policy)
+		if len(protected) != 0 {
+			opts.Policies = append(opts.Policies, &linksame.Policy{ForbiddenPatterns: protected})
+		}
+		if *writeLinks && *maxChangePercent > 0 && !*yes {
+			// Files hashed by the dry run are not read again.
+			opts.KeepHashes()
+			err = confirmChanges(*maxChangePercent, *update, fs.Args(), opts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		var summary linksame.Summary
+		opts.Summary = &summary
+		opts.Journal = openJournal(*journal)
+
+		var mappingFile *os.File
+		if *mapping != "" {
+			if mappingFile, err = os.Create(*mapping); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			opts.Mapping = mappingFile
+		}
+		var escalateFile *os.File
+		if *escalate != "" {
+			escalateFile, err = os.OpenFile(*escalate, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			opts.Escalate = escalateFile
+		}
+
+		stopProfiling, err := startProfiling(*pprofAddr, *traceFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *update != "" {
+			err = linksame.LinkSameUpdate(*update, fs.Args(), opts)
+		} else {
+			err = linksame.LinkSame(fs.Args(), opts)
+		}
+		stopProfiling()
+		err = closeJournal(opts.Journal, err)
+		if mappingFile != nil {
+			if cerr := mappingFile.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if escalateFile != nil {
+			if cerr := escalateFile.Close(); err == nil {
+				err = cerr
+			}
+		}
+		n := notifier{
+			webhook: *notifyWebhook,
+			to:      parseList(*notifyEmail),
+			from:    *notifyFrom,
+			smtp:    *smtpServer,
+		}
+		notifyErr := n.send(fs.Args(), &summary, err)
+		if notifyErr != nil {
+			fmt.Fprintln(os.Stderr, notifyErr)
+		}
+		// The summary of a run that failed only for -strict is still
+		// written, to show what went wrong.
+		var strictErr error
+		if errors.Is(err, linksame.ErrStrict) {
+			strictErr, err = err, nil
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(struct {
+				Summary *linksame.Summary      `json:"summary"`
+				Groups  []linksame.GroupReport `json:"groups"`
+			}{&summary, summary.DuplicateGroups})
+		} else if !*quiet {
+			err = summary.WriteTableFormat(os.Stdout, opts.SizeFormat)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if strictErr != nil {
+			fmt.Fprintln(os.Stderr, strictErr)
+			os.Exit(1)
+		}
+		if notifyErr != nil {
+			os.Exit(1)
+		}
 	}
+}
 
-	if *quiet {
-		flag.Set("verbose", "false")
+// parseStrategies parses a comma-separated list of dir=strategy and
+// name:pattern=strategy items, returning the strategies for directories and
+// for patterns.
+func parseStrategies(s string) (map[string]linksame.Strategy, map[string]linksame.Strategy, error) {
+	if s == "" {
+		return nil, nil, nil
 	}
+	strategies := map[string]linksame.Strategy{}
+	var nameStrategies map[string]linksame.Strategy
+	for _, item := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(item, '=')
+		if i == -1 {
+			return nil, nil, fmt.Errorf("invalid strategy %q, expected dir=strategy or name:pattern=strategy", item)
+		}
+		strategy, err := linksame.ParseStrategy(item[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasPrefix(item, namePrefix) {
+			pattern := item[len(namePrefix):i]
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				return nil, nil, fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+			if nameStrategies == nil {
+				nameStrategies = map[string]linksame.Strategy{}
+			}
+			nameStrategies[pattern] = strategy
+			continue
+		}
+		strategies[item[:i]] = strategy
+	}
+	return strategies, nameStrategies, nil
+}
 
-	var err error
-	if *update != "" {
-		err = linksame.LinkSameUpdate(*update, flag.Args(), *pattern,
-			*writeLinks, *symlink, *absolute, *safe, *quiet, *verbose)
+// parseJobs parses the number of files to hash at once, which is a positive
+// number or "auto".
+func parseJobs(s string) (int, bool, error) {
+	switch s {
+	case "":
+		return 0, false, nil
+	case "auto":
+		return 0, true, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, false, fmt.Errorf("invalid jobs %q, expected a positive number or auto", s)
+	}
+	return n, false, nil
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G, or T suffix
+// for kibibytes, mebibytes, gibibytes, or tebibytes.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	var shift uint
+	if i := strings.IndexAny(num, "KMGT"); i != -1 && i == len(num)-1 {
+		shift = 10 * uint(strings.IndexByte("KMGT", num[i])+1)
+		num = num[:i]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// parseSizeFormat parses the units of sizes in output, which are exact bytes
+// if exactBytes is true.  Digits are grouped as for the locale given by the
+// environment.
+func parseSizeFormat(units string, exactBytes bool) (linksame.SizeFormat, error) {
+	var f linksame.SizeFormat
+	if exactBytes {
+		f.Units = linksame.UnitsBytes
 	} else {
-		err = linksame.LinkSame(flag.Args(), *pattern, *writeLinks, *symlink,
-			*absolute, *safe, *quiet, *verbose)
+		var err error
+		if f.Units, err = linksame.ParseSizeUnits(units); err != nil {
+			return f, err
+		}
+	}
+	for _, name := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		if f.Locale = os.Getenv(name); f.Locale != "" {
+			break
+		}
+	}
+	return f, nil
+}
+
+// parseSizeLimits parses the largest file size and set size to link, which
+// are not limited if force is true.
+func parseSizeLimits(maxLink, maxGroup string, force bool) (int64, int64, error) {
+	if force {
+		return 0, 0, nil
 	}
+	linkBytes, err := parseSize(maxLink)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return 0, 0, err
+	}
+	groupBytes, err := parseSize(maxGroup)
+	if err != nil {
+		return 0, 0, err
+	}
+	return linkBytes, groupBytes, nil
+}
+
+// parseIDs parses a comma-separated list of names or numeric IDs, using
+// lookup to find the ID of each name.
+func parseIDs(s string, lookup func(string) (string, error)) ([]uint32, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []uint32
+	for _, item := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(item, 10, 32)
+		if err != nil {
+			idStr, lerr := lookup(item)
+			if lerr != nil {
+				return nil, lerr
+			}
+			if id, err = strconv.ParseUint(idStr, 10, 32); err != nil {
+				return nil, fmt.Errorf("%s has non-numeric ID %q", item, idStr)
+			}
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// parseTypes parses a comma-separated list of content types.
+func parseTypes(s string) []string {
+	types := parseList(s)
+	for i := range types {
+		types[i] = strings.ToLower(types[i])
+	}
+	return types
+}
+
+// parseList parses a comma-separated list, ignoring space around items.
+func parseList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	items := strings.Split(s, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// relinkCommand defines the relink command, which rewrites existing symlinks
+// as absolute or relative.  It returns the flags and a function that runs the
+// command.
+func relinkCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("relink", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"relink -relative|-absolute [options] [root ..]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var relative = fs.Bool("relative", false, "Rewrite symlinks as relative")
+	var absolute = fs.Bool("absolute", false, "Rewrite symlinks as absolute")
+	var pattern = fs.String("pattern", "",
+		"Only rewrite symlinks matching pattern")
+	var writeLinks = fs.Bool("w", false, "Write links to file system")
+	var quiet = fs.Bool("q", false,
+		"Quiet - suppress output messages and warnings")
+	var verbose = fs.Bool("v", false,
+		"Verbose - print individual symlink messages")
+	var journal = fs.String("journal", "",
+		"Append a tamper-evident record of modifications to this file")
+	var policy = fs.String("policy", "",
+		"Enforce the limits in this policy file, in addition to "+systemPolicyFile)
+	var anchor = fs.String("anchor", "",
+		"Make relative symlinks climb to this directory and descend from it to the file linked to")
+	var anchorRoot = fs.Bool("anchor-root", false,
+		"Make relative symlinks climb to their root and descend from it to the file linked to")
+	var maxTarget = fs.Int("max-symlink-target", 0,
+		"Longest symlink target to create, in bytes (default system limit)")
+	return fs, func() {
+
+		if *relative == *absolute {
+			fmt.Fprintln(os.Stderr, "specify one of -relative or -absolute")
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		opts := linksame.Options{
+			Pattern:    *pattern,
+			WriteLinks: *writeLinks,
+			Absolute:   *absolute,
+			Quiet:      *quiet,
+			Verbose:    *verbose && !*quiet,
+			Journal:    openJournal(*journal),
+			Policies:   loadPolicies(*policy),
+		}
+		opts.MaxSymlinkTarget = *maxTarget
+		opts.SymlinkAnchor = *anchor
+		opts.AnchorAtRoot = *anchorRoot
+		err := linksame.Relink(fs.Args(), opts)
+		err = closeJournal(opts.Journal, err)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// reportCommand defines the report command, which reports the space already
+// saved by existing links.  It returns the flags and a function that runs the
+// command.
+func reportCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"report [options] [root ..]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var pattern = fs.String("pattern", "",
+		"Only report files matching pattern")
+	var verbose = fs.Bool("v", false,
+		"Verbose - list each set of hardlinked files")
+	var units = fs.String("units", "short",
+		"Units of sizes in output: short (1.5M), binary (1.5 MiB), or si (1.6 MB); digits are grouped per LC_NUMERIC")
+	var exactBytes = fs.Bool("bytes", false, "Write sizes in output as exact numbers of bytes")
+	return fs, func() {
+		sizeFmt, err := parseSizeFormat(*units, *exactBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		err = linksame.Report(fs.Args(), linksame.Options{
+			Pattern:    *pattern,
+			SizeFormat: sizeFmt,
+			Verbose:    *verbose,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// previewCommand defines the preview command, which reports likely duplicate
+// files without reading them.  It returns the flags and a function that runs
+// the command.
+func previewCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"preview [options] [root ..]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var pattern = fs.String("pattern", "",
+		"Only preview files matching pattern")
+	var exts = fs.String("ext", "",
+		"Only preview files with these comma-separated extensions")
+	var notExts = fs.String("not-ext", "",
+		"Do not preview files with these comma-separated extensions")
+	var verbose = fs.Bool("v", false,
+		"Verbose - list each set of likely identical files")
+	var units = fs.String("units", "short",
+		"Units of sizes in output: short (1.5M), binary (1.5 MiB), or si (1.6 MB); digits are grouped per LC_NUMERIC")
+	var exactBytes = fs.Bool("bytes", false, "Write sizes in output as exact numbers of bytes")
+	return fs, func() {
+		sizeFmt, err := parseSizeFormat(*units, *exactBytes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		err = linksame.Preview(fs.Args(), linksame.Options{
+			Pattern:       *pattern,
+			Extensions:    parseList(*exts),
+			NotExtensions: parseList(*notExts),
+			SizeFormat:    sizeFmt,
+			Verbose:       *verbose,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// applyCommand defines the apply command, which links the duplicate files
+// listed in a JSON report of lnsame, or in the output of rmlint or rdfind.  It
+// returns the flags and a function that runs the command.
+func applyCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"apply -from results [options]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var from = fs.String("from", "",
+		"lnsame -json report or rmlint JSON output (.json), or rdfind results file")
+	var format = fs.String("format", "",
+		"Format of results: lnsame, rmlint, or rdfind (default from file extension and contents)")
+	var onlyGroups = fs.String("only-groups", "",
+		"Comma-separated IDs of the groups to link, from an lnsame report")
+	var onlyIDs = fs.String("only-ids", "",
+		"Comma-separated IDs of the groups to link, from rmlint or rdfind: rdfind ids, or rmlint checksums")
+	var symlink = fs.Bool("symlink", false, "Link files using only symlinks")
+	var absolute = fs.Bool("absolute", false,
+		"Use absolute instead of relative symlinks")
+	var writeLinks = fs.Bool("w", false, "Write links to file system")
+	var safe = fs.Bool("safe", false,
+		"Do not link files with different permissions or ownership")
+	var verify = fs.Bool("verify", true,
+		"Compare file contents byte-for-byte before linking")
+	var quiet = fs.Bool("q", false,
+		"Quiet - suppress output messages and warnings")
+	var verbose = fs.Bool("v", false,
+		"Verbose - print individual link creation messages")
+	var journal = fs.String("journal", "",
+		"Append a tamper-evident record of modifications to this file")
+	var policy = fs.String("policy", "",
+		"Enforce the limits in this policy file, in addition to "+systemPolicyFile)
+	var minFree = fs.String("min-free-space", "",
+		"Stop before free space on a file system drops below this size, such as 500M or 2G")
+	var pauseLowSpace = fs.Duration("pause-low-space", 0,
+		"With -min-free-space, pause up to this long, such as 10m, for free space to recover before stopping")
+	var maxChanges = fs.Int("max-changes", 0,
+		"Stop replacing files after this many have been replaced, so that an unexpectedly large run can be checked")
+	var maxLinkSize = fs.String("max-link-size", defaultMaxLinkSize,
+		"Do not link files larger than this, such as 100G, unless -force is given")
+	var maxGroupSize = fs.String("max-group-size", "",
+		"Do not link sets of identical files totaling more than this, such as 1T, unless -force is given")
+	var force = fs.Bool("force", false,
+		"Link files regardless of -max-link-size and -max-group-size")
+	var strict = fs.Bool("strict", false,
+		"Exit with an error if any file is skipped, symlinked because it could not be hardlinked, or has an error")
+	return fs, func() {
+
+		if *from == "" {
+			fmt.Fprintln(os.Stderr, "specify results file with -from")
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		f, err := os.Open(*from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		br := bufio.NewReader(f)
+		if *format == "" {
+			*format = "rdfind"
+			if strings.HasSuffix(*from, ".json") {
+				// A report of lnsame is an object, and the output of rmlint
+				// is an array.
+				*format = "rmlint"
+				if jsonObject(br) {
+					*format = "lnsame"
+				}
+			}
+		}
+		var groups [][]string
+		var ids []string
+		selected := *onlyIDs
+		switch *format {
+		case "lnsame":
+			groups, ids, err = linksame.ReadReportGroupIDs(br)
+			selected = *onlyGroups
+			if *onlyIDs != "" {
+				err = errors.New("-only-ids selects groups of rmlint or rdfind; use -only-groups with an lnsame report")
+			}
+		case "rmlint":
+			groups, ids, err = linksame.ReadRmlintGroupIDs(br)
+		case "rdfind":
+			groups, ids, err = linksame.ReadRdfindGroupIDs(br)
+		default:
+			err = fmt.Errorf("unknown format %q", *format)
+		}
+		if *format != "lnsame" && *onlyGroups != "" {
+			err = errors.New("-only-groups selects groups of an lnsame report; use -only-ids with rmlint or rdfind")
+		}
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if selected != "" {
+			if groups, err = selectGroups(groups, ids, parseList(selected)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+
+		minFreeSpace, err := parseSize(*minFree)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		maxLinkBytes, maxGroupBytes, err := parseSizeLimits(*maxLinkSize, *maxGroupSize, *force)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts := linksame.Options{
+			WriteLinks:    *writeLinks,
+			Symlink:       *symlink,
+			Absolute:      *absolute,
+			Safe:          *safe,
+			Verify:        *verify,
+			Quiet:         *quiet,
+			Verbose:       *verbose && !*quiet,
+			Journal:       openJournal(*journal),
+			Policies:      loadPolicies(*policy),
+			MinFreeSpace:  minFreeSpace,
+			PauseLowSpace: *pauseLowSpace,
+			MaxLinkSize:   maxLinkBytes,
+			MaxGroupSize:  maxGroupBytes,
+			MaxChanges:    *maxChanges,
+			Strict:        *strict,
+		}
+		err = linksame.LinkGroups(groups, opts)
+		err = closeJournal(opts.Journal, err)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// jsonObject reports whether the JSON read from br is an object, without
+// consuming it.
+func jsonObject(br *bufio.Reader) bool {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+		default:
+			return b[0] == '{'
+		}
+	}
+}
+
+// selectGroups returns the groups whose IDs are among the selected IDs.  It
+// is an error if any selected ID is not the ID of a group, since a mistyped
+// ID would otherwise silently leave a group unlinked.
+func selectGroups(groups [][]string, ids, selected []string) ([][]string, error) {
+	want := make(map[string]bool, len(selected))
+	for _, id := range selected {
+		want[id] = false
+	}
+	var chosen [][]string
+	for i, id := range ids {
+		if _, ok := want[id]; ok {
+			want[id] = true
+			chosen = append(chosen, groups[i])
+		}
+	}
+	var missing []string
+	for _, id := range selected {
+		if !want[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("no groups with IDs: %s", strings.Join(missing, ", "))
 	}
+	return chosen, nil
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gammazero/linksame"
+)
+
+// mergeCommand defines the merge command, which links the files in a
+// directory to the identical files at the same paths in another, and reports
+// the files that are left because they differ.  It returns the flags and a
+// function that runs the command.
+func mergeCommand() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, " ", path.Base(os.Args[0]),
+			"merge -into dir1 [options] dir2")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Files in dir2 that are identical to the files at the same paths in")
+		fmt.Fprintln(os.Stderr, "dir1 are replaced with links to those in dir1.  The files in dir2 that")
+		fmt.Fprintln(os.Stderr, "differ, or are not in dir1, are listed.")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		fs.PrintDefaults()
+	}
+	var into = fs.String("into", "",
+		"Directory whose files are kept, and linked to from the identical files in dir2")
+	var pattern = fs.String("pattern", "",
+		"Only merge files matching pattern")
+	var exts = fs.String("ext", "",
+		"Only merge files with these comma-separated extensions")
+	var notExts = fs.String("not-ext", "",
+		"Do not merge files with these comma-separated extensions")
+	var xattrCache = fs.Bool("xattr", false,
+		"Cache file hashes in extended attributes to speed up later runs")
+	var symlink = fs.Bool("symlink", false, "Link files using only symlinks")
+	var absolute = fs.Bool("absolute", false,
+		"Use absolute instead of relative symlinks")
+	var writeLinks = fs.Bool("w", false, "Write links to file system")
+	var safe = fs.Bool("safe", false,
+		"Do not link files with different permissions or ownership")
+	var quiet = fs.Bool("q", false,
+		"Quiet - suppress output messages and warnings")
+	var verbose = fs.Bool("v", false,
+		"Verbose - print individual link creation messages")
+	var journal = fs.String("journal", "",
+		"Append a tamper-evident record of modifications to this file")
+	var policy = fs.String("policy", "",
+		"Enforce the limits in this policy file, in addition to "+systemPolicyFile)
+	return fs, func() {
+		if *into == "" || fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		dir := fs.Arg(0)
+		c, err := linksame.Compare(*into, dir, linksame.Options{
+			Pattern:       *pattern,
+			Extensions:    parseList(*exts),
+			NotExtensions: parseList(*notExts),
+			XattrCache:    *xattrCache,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if len(c.Identical) != 0 {
+			groups := make([][]string, len(c.Identical))
+			for i, rel := range c.Identical {
+				groups[i] = []string{filepath.Join(*into, rel), filepath.Join(dir, rel)}
+			}
+			opts := linksame.Options{
+				WriteLinks: *writeLinks,
+				Symlink:    *symlink,
+				Absolute:   *absolute,
+				Safe:       *safe,
+				Verify:     true,
+				Quiet:      *quiet,
+				Verbose:    *verbose && !*quiet,
+				KeepDirs:   []string{*into},
+				Journal:    openJournal(*journal),
+				Policies:   loadPolicies(*policy),
+			}
+			err = linksame.LinkGroups(groups, opts)
+			err = closeJournal(opts.Journal, err)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		if !*quiet && len(c.Identical) != 0 {
+			fmt.Println()
+		}
+		for _, rel := range c.Differing {
+			fmt.Println("Files", filepath.Join(*into, rel), "and", filepath.Join(dir, rel), "differ")
+		}
+		for _, rel := range c.OnlyRight {
+			fmt.Printf("Only in %s: %s\n", dir, rel)
+		}
+		fmt.Printf("%d identical, %d differing, %d only in %s\n",
+			len(c.Identical), len(c.Differing), len(c.OnlyRight), dir)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gammazero/linksame"
+)
+
+// notifyTimeout limits how long posting to a webhook may take, so that an
+// unresponsive server does not hang a scheduled run.
+const notifyTimeout = 30 * time.Second
+
+// notifier sends the summary of a run to a webhook, by email, or both.
+type notifier struct {
+	webhook string
+	to      []string
+	from    string
+	smtp    string
+}
+
+// notification is the JSON posted to the webhook and sent by email.
+type notification struct {
+	Host    string            `json:"host"`
+	Roots   []string          `json:"roots"`
+	Failed  bool              `json:"failed"`
+	Error   string            `json:"error,omitempty"`
+	Summary *linksame.Summary `json:"summary"`
+}
+
+// send posts the summary of a run over roots, which failed if err is not nil,
+// to the webhook, if any, and emails it to the recipients, if any.  It
+// returns the first error sending the notifications.
+func (n *notifier) send(roots []string, summary *linksame.Summary, err error) error {
+	if n.webhook == "" && len(n.to) == 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	msg := notification{
+		Host:    host,
+		Roots:   roots,
+		Failed:  err != nil,
+		Summary: summary,
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	body, jerr := json.MarshalIndent(msg, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+
+	var sendErr error
+	if n.webhook != "" {
+		sendErr = n.post(body)
+	}
+	if len(n.to) != 0 {
+		if merr := n.mail(host, summary, err, body); sendErr == nil {
+			sendErr = merr
+		}
+	}
+	return sendErr
+}
+
+// post posts body to the webhook.
+func (n *notifier) post(body []byte) error {
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(n.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// mail emails body, by way of the SMTP server, with a subject telling whether
+// the run failed or how much it saved.
+func (n *notifier) mail(host string, summary *linksame.Summary, err error, body []byte) error {
+	var subject string
+	if err != nil {
+		subject = fmt.Sprint("lnsame failed on ", host, ": ", err)
+	} else {
+		subject = fmt.Sprint("lnsame on ", host, ": linked ", summary.Linked.Files,
+			" files, ", summary.Linked.Bytes, " bytes")
+		if summary.DryRun {
+			subject += " (dry run)"
+		}
+	}
+	from := n.from
+	if from == "" {
+		from = "lnsame@" + host
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(subject, "\n", " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: application/json; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+	if err := smtp.SendMail(n.smtp, nil, from, n.to, msg.Bytes()); err != nil {
+		return fmt.Errorf("notify email: %w", err)
+	}
+	return nil
+}
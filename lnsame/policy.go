@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gammazero/linksame"
+)
+
+// systemPolicyFile is a policy that is always enforced if it exists, so that
+// scheduled runs cannot be given options that avoid it.
+const systemPolicyFile = "/etc/lnsame/policy.json"
+
+// loadPolicies loads the system policy, if it exists, and the named policy,
+// if name is not empty.  The program exits if a policy cannot be loaded.
+func loadPolicies(name string) []*linksame.Policy {
+	var policies []*linksame.Policy
+	for _, file := range []string{systemPolicyFile, name} {
+		if file == "" {
+			continue
+		}
+		p, err := linksame.LoadPolicy(file)
+		if err != nil {
+			if file == systemPolicyFile && os.IsNotExist(err) {
+				continue
+			}
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		policies = append(policies, p)
+	}
+	return policies
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presets are named sets of options for uses that call for them, given with
+// -preset.  Options given on the command line, or by a profile, take
+// precedence over those of the preset.
+var presets = map[string]map[string]string{
+	// games is for game libraries, such as Steam libraries, where the same
+	// large asset packs are in several installs.  Small files are left, large
+	// files are compared by a sample before being read whole, files are only
+	// hardlinked, since games may not follow symlinks, and executables and
+	// libraries are never linked, since anti-cheat software may reject them.
+	"games": {
+		"min-size":     "1M",
+		"sample-first": "64M",
+		"symlink":      "false",
+		"no-fallback":  "true",
+		"protect":      "*.exe,*.dll,*.sys,*.so,*.so.*,*.dylib,*EasyAntiCheat*,*BattlEye*",
+	},
+	// photos is for photo libraries, where raw and JPEG images have sidecar
+	// files with their edits.  Only images are linked, and they are kept
+	// with their sidecars.
+	"photos": {
+		"ext":      "jpg,jpeg,heic,heif,png,tif,tiff,dng,cr2,cr3,nef,arw,raf,orf,rw2",
+		"sidecars": "true",
+	},
+}
+
+// presetNames returns the names of the presets, in order.
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset sets the flags of the named preset that were not set otherwise.
+func applyPreset(fs *flag.FlagSet, name string) error {
+	preset, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q: use one of %s", name, strings.Join(presetNames(), ", "))
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for flagName, value := range preset {
+		if set[flagName] {
+			continue
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return fmt.Errorf("preset %s: -%s: %w", name, flagName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime/trace"
+)
+
+// startProfiling serves net/http/pprof on pprofAddr, if not empty, and
+// writes an execution trace to traceFile, if not empty.  The returned
+// function stops tracing.
+func startProfiling(pprofAddr, traceFile string) (func(), error) {
+	if pprofAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				fmt.Fprintln(os.Stderr, "pprof server:", err)
+			}
+		}()
+	}
+	if traceFile == "" {
+		return func() {}, nil
+	}
+	f, err := os.Create(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = trace.Start(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		trace.Stop()
+		f.Close()
+	}, nil
+}
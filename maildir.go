@@ -0,0 +1,45 @@
+package linksame
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maildirSkipFlags are the Maildir flags of messages that are not linked:
+// drafts (D), which mail clients may rewrite in place, and trashed messages
+// (T), which are soon removed.
+const maildirSkipFlags = "DT"
+
+// prepareMaildir sets the options that Maildir requires.  Mail clients rename
+// message files to change their flags, which breaks symlinks to them, so
+// messages are only hardlinked.
+func (o *Options) prepareMaildir() {
+	if o.Maildir {
+		o.Symlink = false
+		o.NoFallback = true
+	}
+}
+
+// maildirMessage reports whether the file at path is a message in the cur or
+// new directory of a Maildir folder, and whether it is to be linked, as
+// messages with flags in maildirSkipFlags are not.
+func maildirMessage(path string) (message, link bool) {
+	dir := filepath.Base(filepath.Dir(path))
+	if dir != "cur" && dir != "new" {
+		return false, false
+	}
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return false, false
+	}
+	// The flags follow ":2," in the name, or "!2," where ':' is not
+	// allowed in names.
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		i = strings.LastIndex(name, "!2,")
+	}
+	if i >= 0 && strings.ContainsAny(name[i+3:], maildirSkipFlags) {
+		return true, false
+	}
+	return true, true
+}
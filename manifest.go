@@ -0,0 +1,172 @@
+package linksame
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// manifestName is the name of the hash manifests used with
+	// TrustManifests, as written by sha256sum, and oldManifestName is the
+	// name of those written by sha1sum, which are read if there is no
+	// manifestName.
+	manifestName    = "SHA256SUMS"
+	oldManifestName = "SHA1SUMS"
+	// manifestSample is the number of files in each manifest that are hashed
+	// to check the manifest before it is trusted.
+	manifestSample = 3
+	// manifestPrefix starts the hashes taken from manifests, which are not
+	// comparable with the hashes of files that are read.  It is followed by
+	// the listed digest, of SHA-256, or of SHA-1 in older manifests.
+	manifestPrefix = "manifest:"
+)
+
+// manifest holds the hashes listed in a trusted manifest.
+type manifest struct {
+	// modTime is when the manifest was written.  Files modified after it
+	// may no longer match their hashes.
+	modTime time.Time
+	// hashes maps the paths of the files listed to their hashes.
+	hashes map[string]string
+}
+
+// manifests holds the manifest of each directory, loaded when a file in the
+// directory or below it is first hashed.
+type manifests struct {
+	mu   sync.Mutex
+	dirs map[string]*manifest
+}
+
+// prepareManifests sets up the manifests to be loaded with TrustManifests.
+func (o *Options) prepareManifests() {
+	o.manifests = nil
+	if o.TrustManifests && !o.SlowStorage {
+		o.manifests = &manifests{dirs: map[string]*manifest{}}
+	}
+}
+
+// manifestHash returns the hash of the file listed in a trusted manifest in
+// its directory or a directory above it, if there is one and the file has not
+// been modified since the manifest was written.
+func (o *Options) manifestHash(file string) (string, bool) {
+	if o.manifests == nil {
+		return "", false
+	}
+	var info os.FileInfo
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		m := o.manifests.load(dir, o)
+		if m != nil {
+			if h, ok := m.hashes[file]; ok {
+				if info == nil {
+					var err error
+					if info, err = os.Stat(file); err != nil {
+						return "", false
+					}
+				}
+				if info.ModTime().After(m.modTime) {
+					return "", false
+				}
+				return manifestPrefix + h, true
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
+
+// load returns the trusted manifest in dir, reading and checking it the
+// first time, or nil if there is none.
+func (ms *manifests) load(dir string, opts *Options) *manifest {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m, ok := ms.dirs[dir]
+	if ok {
+		return m
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintln(opts.errOut(), "not trusting manifest:", err)
+		}
+		m = nil
+	}
+	ms.dirs[dir] = m
+	return m
+}
+
+// readManifest reads the manifest in dir, and hashes a sample of the files it
+// lists.  An error is returned if any of them do not match.  Each digest is
+// recognized as SHA-256 or SHA-1 by its length, so that manifests written for
+// older versions, which used SHA-1, are still used.
+func readManifest(dir string) (*manifest, error) {
+	name := filepath.Join(dir, manifestName)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		name = filepath.Join(dir, oldManifestName)
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{modTime: info.ModTime(), hashes: map[string]string{}}
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is a hex hash, two spaces or a space and an asterisk,
+		// and the name of the file relative to dir.
+		line := scanner.Text()
+		n := strings.IndexByte(line, ' ')
+		if n < 0 || len(line) < n+3 {
+			continue
+		}
+		sum, err := hex.DecodeString(line[:n])
+		sep := line[n : n+2]
+		if _, ok := hashForDigest(string(sum)); err != nil || !ok || (sep != "  " && sep != " *") {
+			continue
+		}
+		file := filepath.Join(dir, line[n+2:])
+		m.hashes[file] = string(sum)
+		files = append(files, file)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	// Check files spread through the manifest, of those that still exist
+	// and have not been modified since it was written.
+	var sample []string
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err == nil && fi.Mode().IsRegular() && !fi.ModTime().After(m.modTime) {
+			sample = append(sample, file)
+		}
+	}
+	n := len(sample)
+	if n > manifestSample {
+		n = manifestSample
+	}
+	for i := 0; i < n; i++ {
+		file := sample[i*len(sample)/n]
+		same, err := checkDigest(file, m.hashes[file])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if !same {
+			return nil, fmt.Errorf("%s: hash of %s does not match", name, file)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,88 @@
+package linksame
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// message is output written by a linker, with the tag that identifies it.
+type message struct {
+	w    io.Writer
+	tag  string
+	text []byte
+}
+
+// messageWriter writes the messages of concurrent linkers from a single
+// goroutine, so that messages are never interleaved, prefixing each line with
+// the tag of the message, if any.
+type messageWriter struct {
+	messages chan message
+	done     chan struct{}
+}
+
+// newMessageWriter starts the goroutine that writes messages.
+func newMessageWriter() *messageWriter {
+	m := &messageWriter{
+		messages: make(chan message, queueSize),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(m.done)
+		for msg := range m.messages {
+			if msg.tag == "" {
+				msg.w.Write(msg.text)
+				continue
+			}
+			text := bytes.TrimSuffix(msg.text, []byte("\n"))
+			for _, line := range bytes.Split(text, []byte("\n")) {
+				fmt.Fprintf(msg.w, "%s %s\n", msg.tag, line)
+			}
+		}
+	}()
+	return m
+}
+
+// close writes the remaining messages and stops the goroutine.  Nothing may
+// be written after close.
+func (m *messageWriter) close() {
+	close(m.messages)
+	<-m.done
+}
+
+// tagged returns writers for standard output and standard error that send
+// what is written to them as messages with the given tag, or untagged if the
+// tag is empty.
+func (m *messageWriter) tagged(tag string) (io.Writer, io.Writer) {
+	return &taggedWriter{m, os.Stdout, tag}, &taggedWriter{m, os.Stderr, tag}
+}
+
+// taggedWriter sends each write to a messageWriter, as a message to w.
+type taggedWriter struct {
+	m   *messageWriter
+	w   io.Writer
+	tag string
+}
+
+func (t *taggedWriter) Write(p []byte) (int, error) {
+	t.m.messages <- message{t.w, t.tag, append([]byte(nil), p...)}
+	return len(p), nil
+}
+
+// out returns where messages printed while linking are written.
+func (o *Options) out() io.Writer {
+	if o.stdout != nil {
+		return o.stdout
+	}
+	return os.Stdout
+}
+
+// errOut returns where errors and warnings printed while linking are
+// written.
+func (o *Options) errOut() io.Writer {
+	if o.stderr != nil {
+		return o.stderr
+	}
+	return os.Stderr
+}
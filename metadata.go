@@ -0,0 +1,137 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// MetadataPolicy selects how the mode and ownership of a file that other files
+// are replaced with symlinks to is set.  Symlinks have the access of the file
+// they link to, so the paths of the replaced files become accessible as the
+// kept file is, rather than as they were.
+type MetadataPolicy int
+
+const (
+	// MetadataKeep leaves the mode and ownership of the kept file as they
+	// are.
+	MetadataKeep MetadataPolicy = iota
+	// MetadataStrictest sets the permissions of the kept file to those that
+	// it and all the files replaced by symlinks to it allow.  Ownership is
+	// not changed.
+	MetadataStrictest
+	// MetadataCommon sets the permissions, owner, and group of the kept file
+	// each to the one most common among it and the files replaced by
+	// symlinks to it.  Ties are resolved in favor of the kept file.
+	MetadataCommon
+)
+
+var metadataPolicyNames = []string{"keep", "strictest", "common"}
+
+func (m MetadataPolicy) String() string {
+	if m < 0 || int(m) >= len(metadataPolicyNames) {
+		return fmt.Sprintf("MetadataPolicy(%d)", int(m))
+	}
+	return metadataPolicyNames[m]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m MetadataPolicy) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// ParseMetadataPolicy returns the MetadataPolicy with the given name: "keep",
+// "strictest", or "common".
+func ParseMetadataPolicy(name string) (MetadataPolicy, error) {
+	for i := range metadataPolicyNames {
+		if name == metadataPolicyNames[i] {
+			return MetadataPolicy(i), nil
+		}
+	}
+	return MetadataKeep, fmt.Errorf("unknown metadata policy %q", name)
+}
+
+// baseMetadata returns the mode, owner, and group to give baseFile, described
+// by baseInfo, after the files described by infos are replaced by symlinks to
+// it.  It returns false if these are unchanged.
+func (o *Options) baseMetadata(baseInfo os.FileInfo, infos []os.FileInfo) (os.FileMode, uint32, uint32, bool) {
+	mode := baseInfo.Mode()
+	baseStat := baseInfo.Sys().(*syscall.Stat_t)
+	uid, gid := baseStat.Uid, baseStat.Gid
+	switch o.SymlinkMetadata {
+	case MetadataStrictest:
+		perm := mode.Perm()
+		for _, info := range infos {
+			perm &= info.Mode().Perm()
+		}
+		mode = mode&^os.ModePerm | perm
+	case MetadataCommon:
+		perms := map[os.FileMode]int{mode.Perm(): 1}
+		uids := map[uint32]int{uid: 1}
+		gids := map[uint32]int{gid: 1}
+		perm := mode.Perm()
+		for _, info := range infos {
+			p := info.Mode().Perm()
+			sysStat := info.Sys().(*syscall.Stat_t)
+			perms[p]++
+			uids[sysStat.Uid]++
+			gids[sysStat.Gid]++
+			if perms[p] > perms[perm] {
+				perm = p
+			}
+			if uids[sysStat.Uid] > uids[uid] {
+				uid = sysStat.Uid
+			}
+			if gids[sysStat.Gid] > gids[gid] {
+				gid = sysStat.Gid
+			}
+		}
+		mode = mode&^os.ModePerm | perm
+	}
+	changed := mode != baseInfo.Mode() || uid != baseStat.Uid || gid != baseStat.Gid
+	return mode, uid, gid, changed
+}
+
+// normalizeBase applies o.SymlinkMetadata to baseFile, described by baseInfo,
+// after the files described by infos are replaced by symlinks to it, while
+// linking the group with the given ID.  Errors are printed and counted in st.
+func (o *Options) normalizeBase(group, baseFile string, baseInfo os.FileInfo, infos []os.FileInfo, st *stats) {
+	if o.SymlinkMetadata == MetadataKeep || len(infos) == 0 {
+		return
+	}
+	mode, uid, gid, changed := o.baseMetadata(baseInfo, infos)
+	if !changed {
+		return
+	}
+	if o.Verbose {
+		fmt.Fprintf(o.out(), "metadata: %s %s %d:%d\n", baseFile, mode, uid, gid)
+	}
+	if !o.WriteLinks {
+		return
+	}
+	var before *fileState
+	if o.Journal != nil {
+		before = stateOf(baseInfo, "")
+	}
+	target := fmt.Sprintf("%s %d:%d", mode, uid, gid)
+	intent := o.Journal.intend(journalMetadata, group, baseFile, target, before)
+	if o.Journal.failed() != nil {
+		// Do not modify files when the modification cannot be recorded.
+		return
+	}
+	baseStat := baseInfo.Sys().(*syscall.Stat_t)
+	var err error
+	if uid != baseStat.Uid || gid != baseStat.Gid {
+		err = os.Lchown(baseFile, int(uid), int(gid))
+	}
+	// Changing ownership may clear setuid and setgid bits, so the mode is
+	// set afterward.
+	if err == nil {
+		err = os.Chmod(baseFile, mode)
+	}
+	o.Journal.done(intent, journalMetadata, group, baseFile, target, err)
+	if err != nil {
+		fmt.Fprintln(o.errOut(), "cannot set metadata of linked file:", err)
+		st.errors++
+	}
+}
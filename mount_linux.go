@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountEntry is a mounted file system, from /proc/self/mountinfo.
+type mountEntry struct {
+	dev        uint64
+	mountPoint string
+	// options are the per-mount options, and superOptions are the options
+	// of the file system.
+	options      string
+	fsType       string
+	source       string
+	superOptions string
+}
+
+// readMounts returns the mounted file systems.
+func readMounts() []mountEntry {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Fields are: mount ID, parent ID, major:minor, root, mount point,
+		// mount options, optional fields, "-", type, source, super options.
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+4 {
+			continue
+		}
+		majMin := strings.SplitN(fields[2], ":", 2)
+		if len(majMin) != 2 {
+			continue
+		}
+		major, err1 := strconv.ParseUint(majMin[0], 10, 32)
+		minor, err2 := strconv.ParseUint(majMin[1], 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			dev:          mkdev(major, minor),
+			mountPoint:   unescapeMount(fields[4]),
+			options:      fields[5],
+			fsType:       fields[sep+1],
+			source:       unescapeMount(fields[sep+2]),
+			superOptions: fields[sep+3],
+		})
+	}
+	return mounts
+}
+
+// unescapeMount replaces the octal escapes of space, tab, newline, and
+// backslash in a field of mountinfo.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOption returns the value of the named option in the comma-separated
+// mount options, and whether the option is present.
+func mountOption(options, name string) (string, bool) {
+	for _, opt := range strings.Split(options, ",") {
+		key, value := opt, ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			key, value = opt[:i], opt[i+1:]
+		}
+		if key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// mkdev returns the device ID, as in stat, for the major and minor numbers.
+func mkdev(major, minor uint64) uint64 {
+	return (major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12
+}
@@ -0,0 +1,41 @@
+package linksame
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// netStreams is the number of files on network file systems that are
+	// read at once.  Network file systems are often slower with many
+	// parallel streams than with a few.
+	netStreams = 2
+	// netBufferSize is the size of reads from files on network file
+	// systems.  Larger reads mean fewer round trips to the server.
+	netBufferSize = 1 << 20
+	// netRetries is the number of times reading a file on a network file
+	// system is retried after a transient error.
+	netRetries = 5
+	// netRetryDelay is the delay before the first retry.  The delay doubles
+	// for each following retry.
+	netRetryDelay = time.Second
+)
+
+// isTransient reports whether an error reading a file on a network file
+// system may go away if the read is tried again.
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EAGAIN,
+		syscall.EINTR,
+		syscall.EIO,
+		syscall.ESTALE,
+		syscall.ETIMEDOUT,
+		syscall.ECONNRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
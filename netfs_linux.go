@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import "syscall"
+
+// openNoAtime is the flag that opens a file without updating its access time.
+const openNoAtime = syscall.O_NOATIME
+
+// networkFSTypes maps the magic numbers of network file systems, from
+// statfs, to their names.
+var networkFSTypes = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+}
+
+// networkFS returns the name of the network file system that the path is
+// on, or an empty string if it is not on a network file system.
+func networkFS(path string) string {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return ""
+	}
+	return networkFSTypes[int64(fs.Type)]
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// openNoAtime is zero, since opening without updating access time is not
+// supported on this platform.
+const openNoAtime = 0
+
+// networkFS returns an empty string, since detecting network file systems is
+// not supported on this platform.
+func networkFS(path string) string {
+	return ""
+}
@@ -0,0 +1,59 @@
+package linksame
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownerSelected reports whether the file is owned by one of opts.Owners, and
+// has one of opts.OwnerGroups as its group, when these are specified.
+func (o *Options) ownerSelected(info os.FileInfo) bool {
+	if len(o.Owners) == 0 && len(o.OwnerGroups) == 0 {
+		return true
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return containsID(o.Owners, st.Uid) && containsID(o.OwnerGroups, st.Gid)
+}
+
+// containsID reports whether id is in ids, or ids is empty.
+func containsID(ids []uint32, id uint32) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// crossOwner reports whether replacing the file described by info with a
+// link to the file described by baseInfo is refused because the files have
+// different owners on a file system with quotas.  A hardlink leaves the
+// data charged to the owner of the kept file, and keeps it charged to them
+// even after they remove their file, which quotas do not anticipate.
+func (o *Options) crossOwner(info, baseInfo os.FileInfo) bool {
+	if o.AllowCrossOwner {
+		return false
+	}
+	uid := info.Sys().(*syscall.Stat_t).Uid
+	baseUID := baseInfo.Sys().(*syscall.Stat_t).Uid
+	return uid != baseUID && quotaEnabled(deviceID(info))
+}
+
+// addOwnerSaved counts the storage saved by replacing the file described by
+// info toward its owner, if the file is on a file system with quotas.
+func (s *stats) addOwnerSaved(info os.FileInfo, saved int64) {
+	if !quotaEnabled(deviceID(info)) {
+		return
+	}
+	if s.ownerSaved == nil {
+		s.ownerSaved = map[uint32]FileCount{}
+	}
+	uid := info.Sys().(*syscall.Stat_t).Uid
+	c := s.ownerSaved[uid]
+	c.Files++
+	c.Bytes += saved
+	s.ownerSaved[uid] = c
+}
@@ -0,0 +1,64 @@
+package linksame
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// accessRead is the mode for access(2) to check for read permission.
+const accessRead = 0x4 // R_OK
+
+// errHardlinkDenied is the reason that a hardlink to a file is not permitted.
+var errHardlinkDenied = errors.New("hardlinks to files of other users are not permitted")
+
+// permissionFailure returns the reason, one of the Deny constants, that
+// replacing file f, described by fInfo, with a link to baseFile, using the
+// strategy, would fail for lack of permission.  It returns "" if nothing is
+// expected to fail.  This is used to report the failures in advance when
+// links are not written.  Files that are only reported are never replaced.
+// Files in directories that are not writable are
+// skipped as read-only before this is checked.
+func (o *Options) permissionFailure(f string, fInfo os.FileInfo, baseFile string, strategy Strategy) string {
+	if strategy == StrategyReportOnly {
+		return ""
+	}
+	euid := os.Geteuid()
+	if euid != 0 {
+		// Only the owner of a file, or of the directory, can replace a file
+		// in a sticky directory.
+		dirInfo, err := os.Stat(filepath.Dir(f))
+		if err == nil && dirInfo.Mode()&os.ModeSticky != 0 &&
+			fInfo.Sys().(*syscall.Stat_t).Uid != uint32(euid) &&
+			dirInfo.Sys().(*syscall.Stat_t).Uid != uint32(euid) {
+			return DenyStickyDir
+		}
+	}
+	if o.Verify && syscall.Access(f, accessRead) != nil {
+		return DenyUnreadable
+	}
+	if (o.Verify || strategy == StrategyReflink) && syscall.Access(baseFile, accessRead) != nil {
+		return DenyUnreadable
+	}
+	return ""
+}
+
+// hardlinkDenied reports whether creating a hardlink to baseFile, described
+// by baseInfo, is refused because the system protects hardlinks.  With
+// protected hardlinks, only the owner of a file, or a user that can read and
+// write it, can create a hardlink to it.
+func hardlinkDenied(baseFile string, baseInfo os.FileInfo) bool {
+	euid := os.Geteuid()
+	if euid == 0 || !protectedHardlinks() {
+		return false
+	}
+	if baseInfo.Sys().(*syscall.Stat_t).Uid == uint32(euid) {
+		return false
+	}
+	mode := baseInfo.Mode()
+	if mode&os.ModeSetuid != 0 || mode&os.ModeSetgid != 0 && mode&0010 != 0 {
+		return true
+	}
+	return syscall.Access(baseFile, accessRead|accessWrite) != nil
+}
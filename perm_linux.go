@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"bytes"
+	"os"
+	"sync"
+)
+
+var (
+	protectedOnce    sync.Once
+	protectedSetting bool
+)
+
+// protectedHardlinks reports whether the system restricts creating hardlinks
+// to files of other users.
+func protectedHardlinks() bool {
+	protectedOnce.Do(func() {
+		data, err := os.ReadFile("/proc/sys/fs/protected_hardlinks")
+		protectedSetting = err == nil && string(bytes.TrimSpace(data)) == "1"
+	})
+	return protectedSetting
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// protectedHardlinks returns false, since detecting whether hardlinks are
+// restricted is not supported on this platform.
+func protectedHardlinks() bool {
+	return false
+}
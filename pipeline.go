@@ -0,0 +1,682 @@
+package linksame
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// queueSize is the capacity of the queues between the stages of the pipeline.
+const queueSize = 256
+
+// candidate is a file found by the scanner that may have duplicates.
+type candidate struct {
+	path string
+	size int64
+	id   fileID
+	// network is true if the file is on a network file system.
+	network bool
+	// tailOnly is true if only the tail of the file is to be hashed, to find
+	// whether it may have duplicates.
+	tailOnly bool
+	// modTime is the modification time of the file when it was found, for
+	// kept hashes to be checked against.
+	modTime int64
+}
+
+// hashResult is the hash of a candidate file, from the hasher.
+type hashResult struct {
+	candidate
+	hash string
+	err  error
+	// manifest is true if the hash was taken from a manifest, without
+	// reading the file.
+	manifest bool
+	// reused is true if the hash was kept by an Engine from an earlier call.
+	reused bool
+}
+
+// scanResult holds what the scanner found, other than candidate files.
+type scanResult struct {
+	symlinks   []string
+	archives   []string
+	compressed []string
+	// probeDirs is a directory on each file system, to probe for link
+	// support.
+	probeDirs map[uint64]string
+	// networkFS maps each device seen to the name of its network file
+	// system, or to an empty string if it is not a network file system.
+	networkFS map[uint64]string
+	// sizes, when rescanning, holds the sizes of the files found.
+	sizes map[int64]bool
+	// errors is the number of files or directories that could not be read.
+	errors int
+	// snapshotDirs is the number of snapshot directories skipped.
+	snapshotDirs int
+	// recent is the number of files modified within GracePeriod.
+	recent int
+	// invalidStorePaths is the number of store paths skipped because they
+	// are not valid.
+	invalidStorePaths int
+	// maildirFlagged is the number of Maildir messages skipped because of
+	// their flags.
+	maildirFlagged int
+	// sizeFileMap holds the files of each size, if needed for reports.
+	sizeFileMap map[int64][]string
+}
+
+// sizeClass tracks the files of one size.
+type sizeClass struct {
+	// first is the first file of this size, which is not hashed until a
+	// second file of the same size is found.
+	first *candidate
+	// pending is the number of files being hashed.
+	pending int
+	// paths maps each file ID to the paths that are links to it.  Only one
+	// path of each file ID is hashed.
+	paths map[fileID][]string
+	// hashes maps file ID to the hash of the file.
+	hashes map[fileID]string
+	// groups maps size and hash to the paths of identical files.
+	groups map[contentKey][]string
+	// tails maps the tail hash of each file compared by its tail first to
+	// the file, which is not hashed whole until a second file with the same
+	// tail is found, and then to nil.
+	tails map[string]*candidate
+}
+
+// linkPipeline finds and links identical files in the roots.  It runs as
+// three concurrent stages connected by bounded queues: a scanner that walks
+// the directory trees, a pool of hashers, and a pool of linkers that handle
+// each group of identical files.
+//
+// Files are hashed as soon as there is more than one file of the same size,
+// so hashing overlaps the walk.  Linking does not: no size is known to be
+// complete until the walk is finished, and a file found later may be the one
+// to keep, so no files are linked until then.  Nor is memory bounded by the
+// queues, since the paths of every file found, and the hashes of those read,
+// are held until the walk is finished and their size is linked.
+func linkPipeline(roots []string, opts *Options) (stats, *scanResult, error) {
+	// The stages print their messages through a single writer, so that the
+	// messages of concurrent stages are never interleaved.
+	msgs := newMessageWriter()
+	defer msgs.close()
+	stdout, stderr := opts.stdout, opts.stderr
+	opts.stdout, opts.stderr = msgs.tagged("")
+	defer func() {
+		opts.stdout, opts.stderr = stdout, stderr
+	}()
+	if !opts.TagMessages {
+		return runPipeline(roots, opts, func(g *DuplicateGroup, worker int) stats {
+			return linkGroup(g, opts)
+		})
+	}
+	return runPipeline(roots, opts, func(g *DuplicateGroup, worker int) stats {
+		// Each group is linked with its own copy of the options, which
+		// writes its messages with the group's tag.
+		tag := fmt.Sprintf("[%s w%d]", g.ID(), worker)
+		gopts := *opts
+		gopts.stdout, gopts.stderr = msgs.tagged(tag)
+		return linkGroup(g, &gopts)
+	})
+}
+
+// runPipeline finds identical files in the roots and calls handle for each
+// group of identical files.  Groups are handled concurrently, by workers
+// numbered from 1, and handle is given the number of the worker.
+func runPipeline(roots []string, opts *Options, handle func(g *DuplicateGroup, worker int) stats) (stats, *scanResult, error) {
+	opts.prepareReads()
+	opts.prepareManifests()
+	opts.scanStart = time.Now()
+	found := make(chan candidate, queueSize)
+	scan := &scanResult{
+		probeDirs: map[uint64]string{},
+		networkFS: map[uint64]string{},
+	}
+	if opts.devices != nil {
+		scan.networkFS = opts.devices
+	}
+	if opts.index != nil {
+		// Files no longer found in the roots are forgotten.
+		opts.index.removeUnder(roots)
+		if opts.rescan {
+			scan.sizes = map[int64]bool{}
+		}
+	}
+	if opts.ScanArchives || opts.Decompress {
+		scan.sizeFileMap = map[int64][]string{}
+	}
+	opts.scanCache = nil
+	if opts.ScanCache != "" {
+		opts.scanCache = loadScanCache(opts.ScanCache)
+	}
+	var scanErr error
+	go func() {
+		scanErr = scanRoots(roots, opts, scan, found)
+		if opts.usage != nil {
+			opts.usage.scanTime = time.Since(opts.scanStart)
+		}
+		if scanErr == nil && opts.scanCache != nil {
+			if err := opts.scanCache.save(opts.ScanCache); err != nil {
+				fmt.Fprintln(opts.errOut(), err)
+				scan.errors++
+			}
+		}
+		close(found)
+	}()
+
+	workers := runtime.NumCPU()
+	jobs := make(chan candidate, queueSize)
+	results := make(chan hashResult, queueSize)
+	waitHashers := startHashers(jobs, results, opts)
+
+	// Start linkers.
+	groups := make(chan *DuplicateGroup, queueSize)
+	statsChan := make(chan stats, workers)
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			var st stats
+			for g := range groups {
+				g = newDuplicateGroup(g.Hash, g.Size, uniquePaths(g.Paths()), opts.errOut())
+				if len(g.Files) > 1 {
+					st.addGroup(g)
+					start := time.Now()
+					st.add(handle(g, worker))
+					opts.usage.addLinkTime(time.Since(start))
+				}
+			}
+			statsChan <- st
+		}(i + 1)
+	}
+
+	// Dispatch files from the scanner to the hashers, and groups of
+	// identical files to the linkers.  Jobs and groups wait in local queues
+	// until the stages can take them, so that no stage blocks another.
+	classes := map[int64]*sizeClass{}
+	var jobQueue []candidate
+	var groupQueue []*DuplicateGroup
+	var pending int
+	var counts stats
+	var err error
+	scanning, abort := true, false
+
+	finish := func(size int64, class *sizeClass) {
+		delete(classes, size)
+		if abort {
+			return
+		}
+		for key, paths := range class.groups {
+			if len(paths) < 2 {
+				continue
+			}
+			if opts.updateFile != "" && !containsPath(paths, opts.updateFile) {
+				continue
+			}
+			g := &DuplicateGroup{Hash: key.hash, Size: key.size, Files: make([]GroupFile, len(paths))}
+			for i := range paths {
+				g.Files[i].Path = paths[i]
+			}
+			groupQueue = append(groupQueue, g)
+		}
+	}
+	hash := func(class *sizeClass, c candidate) {
+		if class.paths == nil {
+			class.paths = map[fileID][]string{}
+			class.hashes = map[fileID]string{}
+			class.groups = map[contentKey][]string{}
+		}
+		paths, ok := class.paths[c.id]
+		if !ok && !opts.reserveRead(c.size) {
+			// Not hashed, so not linked.
+			counts.overReadBudget++
+			return
+		}
+		class.paths[c.id] = append(paths, c.path)
+		if !ok {
+			c.tailOnly = opts.tailFirst(c.path, c.size)
+			jobQueue = append(jobQueue, c)
+			class.pending++
+			pending++
+		} else if h, ok := class.hashes[c.id]; ok {
+			// Reuse the hash of the file this is a hardlink to.
+			key := contentKey{c.size, h}
+			class.groups[key] = append(class.groups[key], c.path)
+		}
+	}
+
+	for scanning || pending != 0 || len(jobQueue) != 0 || len(groupQueue) != 0 {
+		// Stop reading from the scanner while the job queue is full.
+		var foundIn <-chan candidate
+		if scanning && len(jobQueue) < queueSize {
+			foundIn = found
+		}
+		var jobsOut chan<- candidate
+		var nextJob candidate
+		if len(jobQueue) != 0 {
+			jobsOut = jobs
+			nextJob = jobQueue[0]
+		}
+		var groupsOut chan<- *DuplicateGroup
+		var nextGroup *DuplicateGroup
+		if len(groupQueue) != 0 {
+			groupsOut = groups
+			nextGroup = groupQueue[0]
+		}
+
+		select {
+		case c, ok := <-foundIn:
+			if !ok {
+				scanning = false
+				if err = scanErr; err == nil && opts.WriteLinks {
+					// Check that links can be made before linking any files.
+					err = probeLinks(scan.probeDirs, opts.Symlink)
+				}
+				if err != nil {
+					// Do not hash or link any more files.
+					abort = true
+					pending -= len(jobQueue)
+					jobQueue = nil
+				}
+				for size, class := range classes {
+					if abort || class.pending == 0 {
+						finish(size, class)
+					}
+				}
+				continue
+			}
+			counts.candidates++
+			opts.index.add(c.path, c.size)
+			class, ok := classes[c.size]
+			if !ok {
+				classes[c.size] = &sizeClass{first: &c}
+				continue
+			}
+			if class.first != nil {
+				hash(class, *class.first)
+				class.first = nil
+			}
+			hash(class, c)
+		case jobsOut <- nextJob:
+			jobQueue = jobQueue[1:]
+		case groupsOut <- nextGroup:
+			groupQueue = groupQueue[1:]
+		case r := <-results:
+			pending--
+			class := classes[r.size]
+			if class == nil {
+				// Class was finished by abort.
+				continue
+			}
+			class.pending--
+			if r.err != nil {
+				fmt.Fprintln(opts.errOut(), r.err)
+				counts.errors++
+			} else if r.tailOnly {
+				counts.hashedBytes += opts.tailLen(r.size)
+				if class.tails == nil {
+					class.tails = map[string]*candidate{}
+				}
+				c := r.candidate
+				c.tailOnly = false
+				first, seen := class.tails[r.hash]
+				if !seen {
+					class.tails[r.hash] = &c
+				} else {
+					// Another file has the same tail, so hash both whole.
+					if first != nil {
+						jobQueue = append(jobQueue, *first)
+						class.pending++
+						pending++
+						class.tails[r.hash] = nil
+					}
+					jobQueue = append(jobQueue, c)
+					class.pending++
+					pending++
+				}
+			} else {
+				switch {
+				case r.manifest:
+					counts.fromManifest++
+				case r.reused:
+					counts.reused++
+				default:
+					counts.hashedFiles++
+					counts.hashedBytes += opts.hashedLen(r.size)
+					opts.memo.keep(r.candidate, r.hash)
+				}
+				class.hashes[r.id] = r.hash
+				key := contentKey{r.size, r.hash}
+				class.groups[key] = append(class.groups[key], class.paths[r.id]...)
+			}
+			if !scanning && class.pending == 0 {
+				finish(r.size, class)
+			}
+		}
+	}
+	close(jobs)
+	close(groups)
+	waitHashers()
+
+	st := counts
+	st.errors += scan.errors
+	st.snapshotDirs += scan.snapshotDirs
+	st.recent += scan.recent
+	st.invalidStorePaths += scan.invalidStorePaths
+	st.maildirFlagged += scan.maildirFlagged
+	for i := 0; i < workers; i++ {
+		st.add(<-statsChan)
+	}
+	return st, scan, err
+}
+
+// startHashers starts the pool of hashers that hash the files from jobs and
+// send the results.  It returns a function that waits for the hashers to
+// finish, after jobs is closed.
+func startHashers(jobs <-chan candidate, results chan<- hashResult, opts *Options) func() {
+	hashers := runtime.NumCPU()
+	if opts.Jobs > 0 {
+		hashers = opts.Jobs
+	}
+	var t *tuner
+	if opts.AutoJobs {
+		// Allow more hashers than CPUs, since hashers may spend most of
+		// their time waiting on slow storage.
+		hashers = 4 * runtime.NumCPU()
+		var out io.Writer
+		if opts.Verbose {
+			out = opts.out()
+		}
+		t = newTuner(hashers, out)
+	}
+
+	// Only a few files on network file systems are read at once.
+	netSem := make(chan struct{}, netStreams)
+	var wg sync.WaitGroup
+	wg.Add(hashers)
+	for i := 0; i < hashers; i++ {
+		go func() {
+			defer wg.Done()
+			hashFiles(jobs, results, opts, t, netSem)
+		}()
+	}
+	return func() {
+		wg.Wait()
+		t.stop()
+	}
+}
+
+// hashFiles hashes the files from jobs and sends the results.  Where
+// supported, small files are read in batches to reduce the number of system
+// calls.  Batching is not used when caching hashes in extended attributes.
+// If t is not nil, it limits how many hashers run at once.  Files on network
+// file systems, and all files with SlowStorage, are only read while holding
+// a slot in netSem, and are not batched.
+func hashFiles(jobs <-chan candidate, results chan<- hashResult, opts *Options, t *tuner, netSem chan struct{}) {
+	var br batchReader
+	if !opts.XattrCache && !opts.SlowStorage {
+		br = newBatchReader()
+	}
+	if br != nil {
+		defer br.close()
+	}
+
+	batch := make([]candidate, 0, batchSize)
+	for {
+		t.acquire()
+		c, ok := <-jobs
+		if !ok {
+			t.release(time.Now(), 0, 0)
+			return
+		}
+		start := time.Now()
+		if h, ok := opts.manifestHash(c.path); ok {
+			c.tailOnly = false
+			results <- hashResult{candidate: c, hash: h, manifest: true}
+			t.release(start, 1, 0)
+			continue
+		}
+		if h, ok := opts.memo.lookup(c); ok {
+			results <- hashResult{candidate: c, hash: h, reused: true}
+			t.release(start, 1, 0)
+			continue
+		}
+		if c.tailOnly {
+			h, err := opts.hashTail(c.path, c.size)
+			results <- hashResult{candidate: c, hash: h, err: err}
+			t.release(start, 1, opts.tailLen(c.size))
+			continue
+		}
+		if c.network || opts.SlowStorage {
+			netSem <- struct{}{}
+			h, err := opts.fileHash(c.path, true)
+			<-netSem
+			results <- hashResult{candidate: c, hash: h, err: err}
+			t.release(start, 1, c.size)
+			continue
+		}
+		if br == nil || c.size > smallFileSize {
+			h, err := opts.fileHash(c.path, false)
+			results <- hashResult{candidate: c, hash: h, err: err}
+			t.release(start, 1, c.size)
+			continue
+		}
+		// Collect more small files that are ready, without waiting.
+		batch = append(batch[:0], c)
+		files, bytes := 1, c.size
+	collect:
+		for len(batch) < batchSize {
+			select {
+			case c, ok := <-jobs:
+				if !ok {
+					break collect
+				}
+				if h, ok := opts.manifestHash(c.path); ok {
+					c.tailOnly = false
+					results <- hashResult{candidate: c, hash: h, manifest: true}
+					continue
+				}
+				if h, ok := opts.memo.lookup(c); ok {
+					results <- hashResult{candidate: c, hash: h, reused: true}
+					continue
+				}
+				files++
+				bytes += c.size
+				if c.tailOnly {
+					h, err := opts.hashTail(c.path, c.size)
+					results <- hashResult{candidate: c, hash: h, err: err}
+					continue
+				}
+				if c.network {
+					netSem <- struct{}{}
+					h, err := opts.fileHash(c.path, true)
+					<-netSem
+					results <- hashResult{candidate: c, hash: h, err: err}
+					continue
+				}
+				if c.size > smallFileSize {
+					h, err := opts.fileHash(c.path, false)
+					results <- hashResult{candidate: c, hash: h, err: err}
+					continue
+				}
+				batch = append(batch, c)
+			default:
+				break collect
+			}
+		}
+		if err := hashBatch(br, batch, results, opts); err != nil {
+			// Hash the remaining files one at a time.
+			if opts.Verbose {
+				fmt.Fprintln(opts.errOut(), "batch reads stopped:", err)
+			}
+			br = nil
+		}
+		t.release(start, files, bytes)
+	}
+}
+
+// scanRoots walks the directory trees and sends each regular file that may
+// have duplicates to found.  Other things found are recorded in scan.
+func scanRoots(roots []string, opts *Options, scan *scanResult, found chan<- candidate) error {
+	if opts.updateFile != "" {
+		found <- scan.candidate(opts.updateFile, opts.updateInfo, opts)
+	}
+	walk := walkTree
+	if opts.scanCache != nil {
+		walk = opts.scanCache.walk
+	}
+	for _, rootDir := range roots {
+		err := walk(rootDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), err)
+				scan.errors++
+				return nil
+			}
+			if opts.leftoverTemp(path, &scan.errors) {
+				return nil
+			}
+			if opts.skipSnapshot(path, info, rootDir) {
+				scan.snapshotDirs++
+				return filepath.SkipDir
+			}
+			if opts.invalidStorePath(path) {
+				scan.invalidStorePaths++
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				scan.symlinks = append(scan.symlinks, path)
+				return nil
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 || !opts.ownerSelected(info) {
+				return nil
+			}
+			if info.Size() < opts.MinSize {
+				return nil
+			}
+			if opts.Maildir {
+				message, link := maildirMessage(path)
+				if !message {
+					return nil
+				}
+				if !link {
+					scan.maildirFlagged++
+					return nil
+				}
+			}
+			if opts.updateInfo != nil && info.Size() != opts.updateInfo.Size() {
+				return nil
+			}
+			if !opts.extSelected(info.Name()) {
+				return nil
+			}
+			// Sidecars are linked along with their files.
+			if opts.Sidecars && opts.LinkSidecars && isSidecar(info.Name()) {
+				return nil
+			}
+			if opts.Pattern != "" {
+				ok, err := filepath.Match(opts.Pattern, info.Name())
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return nil
+				}
+			}
+			// Files modified recently may still be changing, so are left
+			// for a later run.
+			if opts.tooRecent(info) {
+				scan.recent++
+				return nil
+			}
+			// Files identical to the update file have its type, which was
+			// already checked.
+			if opts.updateFile == "" {
+				if ok, err := opts.typeSelected(path); !ok {
+					if err != nil {
+						fmt.Fprintln(opts.errOut(), err)
+						scan.errors++
+					}
+					return nil
+				}
+			}
+			if scan.sizeFileMap != nil {
+				scan.sizeFileMap[info.Size()] = append(scan.sizeFileMap[info.Size()], path)
+			}
+			if opts.ScanArchives && isArchive(info.Name()) {
+				scan.archives = append(scan.archives, path)
+			}
+			if opts.Decompress && isCompressed(info.Name()) {
+				scan.compressed = append(scan.compressed, path)
+			}
+			if scan.sizes != nil {
+				scan.sizes[info.Size()] = true
+			}
+			found <- scan.candidate(path, info, opts)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if scan.sizes != nil {
+		// Files found earlier, outside of the roots, may be identical to
+		// files found in the roots that are the same size.
+		for _, f := range opts.index.sameSize(scan.sizes) {
+			info, err := os.Lstat(f.path)
+			if err != nil || !info.Mode().IsRegular() || info.Size() != f.size {
+				opts.index.remove(f.path)
+				continue
+			}
+			found <- scan.candidate(f.path, info, opts)
+		}
+	}
+	return nil
+}
+
+// candidate returns the candidate for a file found by the scanner, and
+// records the file system that it is on.
+func (scan *scanResult) candidate(path string, info os.FileInfo, opts *Options) candidate {
+	dev := deviceID(info)
+	netFS, ok := scan.networkFS[dev]
+	if !ok {
+		netFS = networkFS(path)
+		scan.networkFS[dev] = netFS
+		if netFS != "" && !opts.Quiet {
+			fmt.Fprintf(opts.errOut(), "WARNING: %s is on a network file system (%s). "+
+				"Hardlink semantics may differ from local storage, and files "+
+				"are read with fewer parallel streams.\n", filepath.Dir(path), netFS)
+		}
+	}
+	if _, ok := scan.probeDirs[dev]; !ok {
+		// Files in read-only directories are not linked, so do not
+		// probe these.
+		dir := filepath.Dir(path)
+		if syscall.Access(dir, accessWrite) == nil {
+			scan.probeDirs[dev] = dir
+		}
+	}
+	return candidate{
+		path:    path,
+		size:    info.Size(),
+		id:      fileIDOf(info),
+		network: netFS != "",
+		modTime: info.ModTime().UnixNano(),
+	}
+}
+
+// containsPath reports whether paths contains path.
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
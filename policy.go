@@ -0,0 +1,195 @@
+package linksame
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Policy limits what a run may modify, so that an unattended run cannot do
+// more than an operator approved, whatever other options it is given.
+type Policy struct {
+	// AllowedRoots, if not empty, are the only directories that files may be
+	// linked within.  A run with a root, or a file, outside of these fails
+	// before modifying anything.
+	AllowedRoots []string `json:"allowed_roots"`
+	// MaxBytes, if not zero, is the most data that may be replaced by links
+	// in a run.  Once reached, no more files are replaced.
+	MaxBytes int64 `json:"max_bytes"`
+	// ForbiddenPatterns are patterns of files that are never linked, neither
+	// replaced by a link nor linked to.  Patterns containing a path separator
+	// are matched against the absolute path of each file, and others are
+	// matched against the file name.
+	ForbiddenPatterns []string `json:"forbidden_patterns"`
+}
+
+// LoadPolicy reads a policy from a JSON file.  Unknown fields are an error,
+// so that a misspelled limit is not silently ignored.
+func LoadPolicy(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p Policy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", name, err)
+	}
+	if p.MaxBytes < 0 {
+		return nil, fmt.Errorf("policy %s: max_bytes is negative", name)
+	}
+	for _, pattern := range p.ForbiddenPatterns {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("policy %s: pattern %q: %w", name, pattern, err)
+		}
+	}
+	return &p, nil
+}
+
+// changeLimit tracks the files replaced during a run, against MaxChanges.
+type changeLimit struct {
+	mu   sync.Mutex
+	left int
+}
+
+// prepareChanges sets up the limit on files replaced.
+func (o *Options) prepareChanges() {
+	o.changes = nil
+	if o.MaxChanges > 0 {
+		o.changes = &changeLimit{left: o.MaxChanges}
+	}
+}
+
+// changeAllowed reports whether replacing another file stays within
+// MaxChanges, and if so counts it against the limit.
+func (o *Options) changeAllowed() bool {
+	c := o.changes
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.left == 0 {
+		return false
+	}
+	c.left--
+	return true
+}
+
+// releaseChanges gives back n files counted by changeAllowed that were not
+// replaced after all.
+func (o *Options) releaseChanges(n int) {
+	c := o.changes
+	if c == nil || n == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.left += n
+	c.mu.Unlock()
+}
+
+// policyBudget tracks the data replaced during a run, against the smallest
+// MaxBytes of the policies.
+type policyBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// preparePolicies checks that each of the paths, which are roots or files to
+// be linked, is within the allowed roots of every policy, and sets up the
+// limit on data replaced.
+func (o *Options) preparePolicies(paths []string) error {
+	o.budget = nil
+	var limit int64
+	for _, p := range o.Policies {
+		if p.MaxBytes != 0 && (limit == 0 || p.MaxBytes < limit) {
+			limit = p.MaxBytes
+		}
+		if len(p.AllowedRoots) == 0 {
+			continue
+		}
+		allowed := make([]string, len(p.AllowedRoots))
+		for i := range p.AllowedRoots {
+			allowed[i] = canonicalPath(p.AllowedRoots[i])
+		}
+		for _, path := range paths {
+			if !withinRoots(canonicalPath(path), allowed) {
+				return fmt.Errorf("%s is outside of the roots allowed by policy", path)
+			}
+		}
+	}
+	if limit != 0 {
+		o.budget = &policyBudget{limit: limit}
+	}
+	return nil
+}
+
+// policyForbids reports whether a policy forbids linking the file.
+func (o *Options) policyForbids(file string) bool {
+	if len(o.Policies) == 0 {
+		return false
+	}
+	if _, err := filepath.Abs(file); err != nil {
+		return true
+	}
+	for _, p := range o.Policies {
+		for _, pattern := range p.ForbiddenPatterns {
+			if matchPattern(pattern, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPattern reports whether the file matches the pattern.  Patterns
+// containing a path separator are matched against the absolute path of the
+// file, and others are matched against the file name.
+func matchPattern(pattern, file string) bool {
+	target := filepath.Base(file)
+	if strings.ContainsRune(pattern, filepath.Separator) {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return false
+		}
+		target = abs
+	}
+	ok, _ := filepath.Match(pattern, target)
+	return ok
+}
+
+// policyAllows reports whether replacing a file of the given size stays
+// within the policy limit on data replaced, and if so counts the size
+// against the limit.
+func (o *Options) policyAllows(size int64) bool {
+	b := o.budget
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// releaseBudget gives back data counted by policyAllows for files that were
+// not replaced after all.
+func (o *Options) releaseBudget(size int64) {
+	b := o.budget
+	if b == nil || size == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= size
+	b.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Preview prints the sets of files, within the specified directory trees,
+// that are likely to be identical, judging by their metadata alone.  Files
+// are likely identical when they have the same size, modification time, and
+// name.  No files are read, so this is quick even on storage where reading
+// is slow or costly, such as tape-backed or cloud storage, and shows where
+// linking may save space before paying for the reads to find out.  The sets
+// are not confirmed to be identical, and identical files that differ in name
+// or modification time are not found.
+//
+// Only opts.Pattern, Extensions, NotExtensions, Quiet, and Verbose are used.
+// If verbose, the files in each set are listed.
+func Preview(roots []string, opts Options) error {
+	roots, err := normalizeRoots(roots, opts.Quiet, opts.errOut())
+	if err != nil {
+		return err
+	}
+
+	type previewKey struct {
+		size    int64
+		modTime int64
+		name    string
+	}
+	sets := map[previewKey][]string{}
+	seen := map[fileID]struct{}{}
+	var tempErrors int
+	for _, rootDir := range roots {
+		err = walkTree(rootDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), err)
+				return nil
+			}
+			if opts.skipSnapshot(path, info, rootDir) {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			if opts.Pattern != "" {
+				if ok, err := filepath.Match(opts.Pattern, info.Name()); err != nil || !ok {
+					return err
+				}
+			}
+			if !opts.extSelected(info.Name()) || opts.leftoverTemp(path, &tempErrors) {
+				return nil
+			}
+			// Files already hardlinked together are counted once.
+			id := fileIDOf(info)
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+			key := previewKey{info.Size(), info.ModTime().UnixNano(), info.Name()}
+			sets[key] = append(sets[key], path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	type previewSet struct {
+		size  int64
+		files []string
+	}
+	var found []previewSet
+	var fileCount int
+	var saved int64
+	for key, files := range sets {
+		if len(files) < 2 {
+			continue
+		}
+		found = append(found, previewSet{key.size, files})
+		fileCount += len(files) - 1
+		saved += key.size * int64(len(files)-1)
+	}
+
+	if opts.Quiet {
+		return nil
+	}
+	fmt.Fprintln(opts.out(), "Likely duplicate files in", strings.Join(roots, ", "))
+	if opts.Verbose {
+		sort.Slice(found, func(i, j int) bool {
+			return found[i].size*int64(len(found[i].files)) >
+				found[j].size*int64(len(found[j].files))
+		})
+		for _, s := range found {
+			fmt.Fprintln(opts.out())
+			fmt.Fprintln(opts.out(), len(s.files), "likely identical", opts.SizeFormat.Format(s.size), "files:")
+			sort.Strings(s.files)
+			for _, f := range s.files {
+				fmt.Fprintln(opts.out(), " ", f)
+			}
+		}
+	}
+	fmt.Fprintln(opts.out())
+	fmt.Fprintln(opts.out(), len(found), "sets of files with the same size, modification time, and name have",
+		fileCount, "likely duplicates")
+	fmt.Fprintln(opts.out(), "Linking may save", opts.SizeFormat.Format(saved)+", if the files are identical (not verified)")
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"strings"
+	"sync"
+)
+
+// quotaOptions are the mount options that enable disk quotas.
+var quotaOptions = []string{
+	"quota", "usrquota", "grpquota", "prjquota", "usrjquota", "grpjquota",
+	"uquota", "gquota", "pquota", "uqnoenforce", "gqnoenforce", "pqnoenforce",
+	"qnoenforce",
+}
+
+var (
+	quotaOnce    sync.Once
+	quotaDevices map[uint64]bool
+)
+
+// quotaEnabled reports whether disk quotas are enabled on the file system
+// with the given device ID, according to its mount options.
+func quotaEnabled(dev uint64) bool {
+	quotaOnce.Do(func() {
+		quotaDevices = readQuotaDevices()
+	})
+	return quotaDevices[dev]
+}
+
+// readQuotaDevices returns the device IDs of mounted file systems that have
+// quotas enabled.
+func readQuotaDevices() map[uint64]bool {
+	devs := map[uint64]bool{}
+	for _, m := range readMounts() {
+		if hasQuotaOption(m.options) || hasQuotaOption(m.superOptions) {
+			devs[m.dev] = true
+		}
+	}
+	return devs
+}
+
+// hasQuotaOption reports whether the comma-separated mount options enable
+// quotas.
+func hasQuotaOption(options string) bool {
+	for _, opt := range strings.Split(options, ",") {
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			opt = opt[:i]
+		}
+		for _, q := range quotaOptions {
+			if opt == q {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// quotaEnabled returns false, since detecting disk quotas is not supported on
+// this platform.
+func quotaEnabled(dev uint64) bool {
+	return false
+}
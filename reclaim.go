@@ -0,0 +1,102 @@
+package linksame
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// fsReclaim describes how a file system already reclaims space from
+// duplicate or compressible data.
+type fsReclaim struct {
+	mountPoint string
+	fsType     string
+	dedup      bool
+	// compression is the compression algorithm, or empty if data is not
+	// compressed.
+	compression string
+	// ratio is the compression ratio of the data, or zero if unknown.
+	ratio float64
+}
+
+// FSReclaim is advice about the storage saved on a file system that already
+// deduplicates or compresses data, where replacing files with links frees
+// less storage than the size of the files.
+type FSReclaim struct {
+	MountPoint string `json:"mount_point"`
+	Type       string `json:"type"`
+	// Dedup is true if the file system deduplicates blocks.
+	Dedup bool `json:"dedup"`
+	// Compression is the compression algorithm, or empty if data is not
+	// compressed.
+	Compression string `json:"compression,omitempty"`
+	// Logical is the total size of the files replaced, less the storage used
+	// by symlinks, as counted in Summary.Linked.
+	Logical int64 `json:"logical_bytes"`
+	// Physical is the storage likely to be freed: none with dedup, since
+	// only one copy of duplicate blocks is stored, or Logical divided by the
+	// compression ratio.  It is -1 if the compression ratio is unknown.
+	Physical int64 `json:"likely_physical_bytes"`
+}
+
+// addReclaimSaved counts the storage saved by replacing the file described by
+// info toward its file system, if the file system deduplicates or compresses
+// data.
+func (s *stats) addReclaimSaved(info os.FileInfo, saved int64) {
+	dev := deviceID(info)
+	if reclaimingFS(dev) == nil {
+		return
+	}
+	if s.reclaimSaved == nil {
+		s.reclaimSaved = map[uint64]int64{}
+	}
+	s.reclaimSaved[dev] += saved
+}
+
+// reclaimAdvice returns advice for each file system that deduplicates or
+// compresses data and had files replaced, ordered by mount point.
+func reclaimAdvice(saved map[uint64]int64) []FSReclaim {
+	var advice []FSReclaim
+	for dev, logical := range saved {
+		r := reclaimingFS(dev)
+		a := FSReclaim{
+			MountPoint:  r.mountPoint,
+			Type:        r.fsType,
+			Dedup:       r.dedup,
+			Compression: r.compression,
+			Logical:     logical,
+		}
+		switch {
+		case r.dedup:
+			a.Physical = 0
+		case r.ratio >= 1:
+			a.Physical = int64(float64(logical) / r.ratio)
+		default:
+			a.Physical = -1
+		}
+		advice = append(advice, a)
+	}
+	sort.Slice(advice, func(i, j int) bool {
+		return advice[i].MountPoint < advice[j].MountPoint
+	})
+	return advice
+}
+
+// printReclaimAdvice prints advice to w about file systems where replacing
+// files frees less storage than the size of the files.
+func printReclaimAdvice(w io.Writer, advice []FSReclaim, f SizeFormat) {
+	for _, a := range advice {
+		switch {
+		case a.Dedup:
+			fmt.Fprintf(w, "Advisory: %s (%s) deduplicates blocks, so little of the %s replaced is freed\n",
+				a.MountPoint, a.Type, f.Format(a.Logical))
+		case a.Physical >= 0:
+			fmt.Fprintf(w, "Advisory: %s (%s) compresses with %s, so about %s of the %s replaced is freed\n",
+				a.MountPoint, a.Type, a.Compression, f.Format(a.Physical), f.Format(a.Logical))
+		default:
+			fmt.Fprintf(w, "Advisory: %s (%s) compresses with %s, so less than the %s replaced is freed\n",
+				a.MountPoint, a.Type, a.Compression, f.Format(a.Logical))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	reclaimOnce    sync.Once
+	reclaimDevices map[uint64]*fsReclaim
+)
+
+// reclaimingFS returns how the file system with the given device ID already
+// reclaims space from duplicate or compressible data, or nil if it does not.
+func reclaimingFS(dev uint64) *fsReclaim {
+	reclaimOnce.Do(func() {
+		reclaimDevices = readReclaimDevices()
+	})
+	return reclaimDevices[dev]
+}
+
+// readReclaimDevices returns the mounted file systems that deduplicate or
+// compress data, by device ID.  Btrfs compression is read from the mount
+// options, and ZFS dedup and compression from the properties of the
+// dataset, using the zfs command.
+func readReclaimDevices() map[uint64]*fsReclaim {
+	devs := map[uint64]*fsReclaim{}
+	for _, m := range readMounts() {
+		var r *fsReclaim
+		switch m.fsType {
+		case "btrfs":
+			r = btrfsReclaim(m)
+		case "zfs":
+			r = zfsReclaim(m)
+		}
+		if r != nil {
+			devs[m.dev] = r
+		}
+	}
+	return devs
+}
+
+// btrfsReclaim returns how a btrfs file system compresses data, according to
+// its mount options.
+func btrfsReclaim(m mountEntry) *fsReclaim {
+	for _, opt := range []string{"compress-force", "compress"} {
+		for _, options := range []string{m.superOptions, m.options} {
+			if alg, ok := mountOption(options, opt); ok && alg != "no" && alg != "none" {
+				if alg == "" {
+					alg = "zlib"
+				}
+				return &fsReclaim{mountPoint: m.mountPoint, fsType: m.fsType, compression: alg}
+			}
+		}
+	}
+	return nil
+}
+
+// zfsReclaim returns how a ZFS dataset deduplicates and compresses data,
+// according to its properties.
+func zfsReclaim(m mountEntry) *fsReclaim {
+	out, err := exec.Command("zfs", "get", "-H", "-o", "property,value",
+		"dedup,compression,compressratio", m.source).Output()
+	if err != nil {
+		return nil
+	}
+	r := &fsReclaim{mountPoint: m.mountPoint, fsType: m.fsType}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "dedup":
+			r.dedup = fields[1] != "off"
+		case "compression":
+			if fields[1] != "off" {
+				r.compression = fields[1]
+			}
+		case "compressratio":
+			r.ratio, _ = strconv.ParseFloat(strings.TrimSuffix(fields[1], "x"), 64)
+		}
+	}
+	if !r.dedup && r.compression == "" {
+		return nil
+	}
+	return r
+}
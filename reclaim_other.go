@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// reclaimingFS returns nil, since detecting file systems that deduplicate or
+// compress data is not supported on this platform.
+func reclaimingFS(dev uint64) *fsReclaim {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+import (
+	"errors"
+	"os"
+)
+
+// haveReflink is false, since reflinks are not supported on this platform.
+const haveReflink = false
+
+// cloneFile makes dst a reflink of src.  This is not supported on this
+// platform.
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}
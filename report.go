@@ -0,0 +1,107 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Report prints how much space is already saved by hardlinks and symlinks
+// within the specified directory trees.  Each set of hardlinks to the same
+// file is a cluster, and the space saved by a cluster is the size of the file
+// times the number of additional links to it found in the trees.  Symlinks
+// save the size of the file they link to, if that file is in the trees.
+//
+// Only opts.Pattern, Quiet, and Verbose are used.  If verbose, each hardlink
+// cluster is listed.
+func Report(roots []string, opts Options) error {
+	roots, err := normalizeRoots(roots, opts.Quiet, opts.errOut())
+	if err != nil {
+		return err
+	}
+
+	type cluster struct {
+		size  int64
+		files []string
+	}
+	clusters := map[fileID]*cluster{}
+	var symlinks []string
+	for _, rootDir := range roots {
+		err = walkTree(rootDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), err)
+				return nil
+			}
+			if opts.Pattern != "" {
+				if ok, err := filepath.Match(opts.Pattern, info.Name()); err != nil || !ok {
+					return err
+				}
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				symlinks = append(symlinks, path)
+				return nil
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			if info.Sys().(*syscall.Stat_t).Nlink < 2 {
+				return nil
+			}
+			key := fileIDOf(info)
+			c, ok := clusters[key]
+			if !ok {
+				c = &cluster{size: info.Size()}
+				clusters[key] = c
+			}
+			c.files = append(c.files, path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var clusterCount, linkCount int
+	var linkSaved int64
+	var found []*cluster
+	for _, c := range clusters {
+		if len(c.files) < 2 {
+			continue
+		}
+		clusterCount++
+		linkCount += len(c.files) - 1
+		linkSaved += c.size * int64(len(c.files)-1)
+		found = append(found, c)
+	}
+	opts.Symlink = false
+	opts.RewriteSymlinks = false
+	st := checkSymlinks(symlinks, roots, &opts)
+
+	if opts.Quiet {
+		return nil
+	}
+	fmt.Fprintln(opts.out(), "Existing links in", strings.Join(roots, ", "))
+	if opts.Verbose {
+		sort.Slice(found, func(i, j int) bool {
+			return found[i].size*int64(len(found[i].files)) >
+				found[j].size*int64(len(found[j].files))
+		})
+		for _, c := range found {
+			fmt.Fprintln(opts.out())
+			fmt.Fprintln(opts.out(), len(c.files), "links to", opts.SizeFormat.Format(c.size), "file:")
+			sort.Strings(c.files)
+			for _, f := range c.files {
+				fmt.Fprintln(opts.out(), " ", f)
+			}
+		}
+	}
+	fmt.Fprintln(opts.out())
+	fmt.Fprintln(opts.out(), clusterCount, "files have", linkCount, "additional hardlinks, saving",
+		opts.SizeFormat.Format(linkSaved))
+	fmt.Fprintln(opts.out(), st.symlinked, "symlinks link to files, saving", opts.SizeFormat.Format(st.symlinkedSize))
+	fmt.Fprintln(opts.out(), "Total storage saved", opts.SizeFormat.Format(linkSaved+st.symlinkedSize))
+	return nil
+}
@@ -0,0 +1,73 @@
+package linksame
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Resources is the resources used by a run, for tuning options such as Jobs
+// and the size of reads.
+type Resources struct {
+	// UserCPU and SystemCPU are the CPU time spent in the program and in
+	// the kernel on its behalf.  System time is mostly spent in the system
+	// calls that walk directories, read files, and create links.
+	UserCPU   time.Duration `json:"user_cpu_ns"`
+	SystemCPU time.Duration `json:"system_cpu_ns"`
+	// ScanTime is how long walking the directory trees took.  Hashing and
+	// linking overlap the walk.
+	ScanTime time.Duration `json:"scan_ns"`
+	// LinkTime is the time spent linking sets of identical files, summed
+	// over the linkers that link them concurrently.
+	LinkTime time.Duration `json:"link_ns"`
+	// BytesRead is the data read to hash files and to verify that they are
+	// identical.
+	BytesRead int64 `json:"bytes_read"`
+	// PeakMemory is the largest resident set size of the process.
+	PeakMemory int64 `json:"peak_memory_bytes"`
+}
+
+// resourceUsage holds the usage at the start of a run, and the time spent in
+// each phase of the run so far.
+type resourceUsage struct {
+	start    syscall.Rusage
+	scanTime time.Duration
+	// linkTime is the time spent linking, in nanoseconds, added to by each
+	// linker.
+	linkTime int64
+}
+
+// prepareResources records the resources used before the run, with
+// ReportResources.
+func (o *Options) prepareResources() {
+	o.usage = nil
+	if !o.ReportResources {
+		return
+	}
+	o.usage = &resourceUsage{}
+	syscall.Getrusage(syscall.RUSAGE_SELF, &o.usage.start)
+}
+
+// addLinkTime adds the time spent linking a set of identical files.
+func (u *resourceUsage) addLinkTime(d time.Duration) {
+	if u != nil {
+		atomic.AddInt64(&u.linkTime, int64(d))
+	}
+}
+
+// resources returns the resources used by the run, given the bytes read.
+func (u *resourceUsage) resources(bytesRead int64) *Resources {
+	if u == nil {
+		return nil
+	}
+	var end syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &end)
+	return &Resources{
+		UserCPU:    time.Duration(end.Utime.Nano() - u.start.Utime.Nano()),
+		SystemCPU:  time.Duration(end.Stime.Nano() - u.start.Stime.Nano()),
+		ScanTime:   u.scanTime,
+		LinkTime:   time.Duration(atomic.LoadInt64(&u.linkTime)),
+		BytesRead:  bytesRead,
+		PeakMemory: int64(end.Maxrss) * maxrssUnit,
+	}
+}
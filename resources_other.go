@@ -0,0 +1,8 @@
+//go:build !darwin
+// +build !darwin
+
+package linksame
+
+// maxrssUnit is the unit of the maximum resident set size reported by
+// getrusage, which is kilobytes other than on macOS.
+const maxrssUnit = 1024
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import "syscall"
+
+// stRdonly is the statfs flag for a file system mounted read-only.
+const stRdonly = 0x1
+
+// readOnlyFS reports whether the file system containing path is mounted
+// read-only.
+func readOnlyFS(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return fs.Flags&stRdonly != 0
+}
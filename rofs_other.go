@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// readOnlyFS returns false, since detecting read-only file systems is not
+// supported on this platform.  Files on them are skipped as read-only.
+func readOnlyFS(path string) bool {
+	return false
+}
@@ -0,0 +1,220 @@
+package linksame
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// scanCacheVersion is the version of the scan cache format.  A cache of
+// another version is ignored.
+const scanCacheVersion = 1
+
+// racyWindow is how long after a directory is modified that it is not
+// cached.  A directory modified again within the resolution of its
+// modification time would keep the same time, so its entries are only cached
+// once its time is safely in the past.
+const racyWindow = 2 * time.Second
+
+// scanCache holds the metadata of the entries of each directory walked, from
+// the last run and for the next run.
+//
+// A directory whose modification time and list of names are the same as when
+// it was cached is not stat'ed again; the cached metadata of its files is
+// used.  This only detects files added, removed, or renamed.  A file that is
+// modified in place, or has its ownership or mode changed, does not change its
+// directory, so its old size and mode are used until its directory changes.
+// A file whose size changed is not linked, since its size no longer matches
+// that of the files it was matched with, but a file with the same size and
+// different contents may be hashed again only if hashes are not cached.  Use
+// Verify when files may be modified in place.
+type scanCache struct {
+	old  map[string]*cachedDir
+	new  map[string]*cachedDir
+	scan time.Time
+}
+
+// cachedDir is the cached metadata of the entries of a directory.
+type cachedDir struct {
+	ModTime int64
+	Entries []cachedEntry
+}
+
+// cachedEntry is the cached metadata of one directory entry.
+type cachedEntry struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime int64
+	Stat    syscall.Stat_t
+}
+
+// scanCacheFile is the format of the scan cache file.
+type scanCacheFile struct {
+	Version int
+	Dirs    map[string]*cachedDir
+}
+
+// loadScanCache reads the scan cache from the named file.  A cache that does
+// not exist or cannot be read is treated as empty.
+func loadScanCache(name string) *scanCache {
+	c := &scanCache{new: map[string]*cachedDir{}, scan: time.Now()}
+	f, err := os.Open(name)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	var cf scanCacheFile
+	if err = gob.NewDecoder(f).Decode(&cf); err != nil || cf.Version != scanCacheVersion {
+		return c
+	}
+	c.old = cf.Dirs
+	return c
+}
+
+// save writes the directories walked in this run to the named file.  The
+// cache is written to a temporary file that is renamed over the old cache.
+func (c *scanCache) save(name string) error {
+	f, err := createTemp(filepath.Dir(name), tempCache, filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(scanCacheFile{scanCacheVersion, c.new})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		removeTemp(f.Name())
+		return fmt.Errorf("cannot save scan cache: %w", err)
+	}
+	forgetTemp(f.Name())
+	return nil
+}
+
+// walk walks the file tree rooted at root as walkTree does, using the cached
+// metadata of directories that are unchanged.
+func (c *scanCache) walk(root string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = c.walkDir(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkDir walks path, which is described by info.
+func (c *scanCache) walkDir(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	names, err := readDirNames(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	infos, errs := c.entries(path, info, names)
+	for i, n := range names {
+		p := filepath.Join(path, n)
+		fi := infos[i]
+		if errs[i] != nil {
+			if err := fn(p, nil, errs[i]); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err = c.walkDir(p, fi, fn); err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entries returns the metadata of the named entries of the directory at
+// path, from the cache if the directory is unchanged, or else by stat'ing
+// them, and the error stat'ing each entry.  Directories are always stat'ed,
+// since a change within a subdirectory does not change its parent.
+func (c *scanCache) entries(path string, info os.FileInfo, names []string) ([]os.FileInfo, []error) {
+	mtime := info.ModTime().UnixNano()
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+	old := c.old[path]
+	if old != nil && old.ModTime == mtime && len(old.Entries) == len(names) {
+		for i, e := range old.Entries {
+			if e.Name != names[i] {
+				old = nil
+				break
+			}
+		}
+	} else {
+		old = nil
+	}
+
+	dir := &cachedDir{ModTime: mtime, Entries: make([]cachedEntry, 0, len(names))}
+	for i, n := range names {
+		if old != nil && !old.Entries[i].Mode.IsDir() {
+			e := old.Entries[i]
+			infos[i] = &cachedInfo{e}
+			dir.Entries = append(dir.Entries, e)
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(path, n))
+		if err != nil {
+			errs[i] = err
+			dir = nil
+			continue
+		}
+		infos[i] = fi
+		if dir != nil {
+			st, _ := fi.Sys().(*syscall.Stat_t)
+			if st == nil {
+				dir = nil
+				continue
+			}
+			dir.Entries = append(dir.Entries, cachedEntry{n, fi.Size(), fi.Mode(), fi.ModTime().UnixNano(), *st})
+		}
+	}
+	// Do not cache a directory that failed to stat an entry, or that was
+	// modified so recently that a further change may not change its time.
+	if dir != nil && c.scan.Sub(info.ModTime()) > racyWindow {
+		c.new[path] = dir
+	}
+	return infos, errs
+}
+
+// readDirNames returns the sorted names of the entries of a directory.
+func readDirNames(path string) ([]string, error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	sort.Strings(names)
+	return names, err
+}
+
+// cachedInfo is an os.FileInfo from the scan cache.
+type cachedInfo struct {
+	e cachedEntry
+}
+
+func (fi *cachedInfo) Name() string       { return fi.e.Name }
+func (fi *cachedInfo) Size() int64        { return fi.e.Size }
+func (fi *cachedInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi *cachedInfo) ModTime() time.Time { return time.Unix(0, fi.e.ModTime) }
+func (fi *cachedInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi *cachedInfo) Sys() interface{}   { return &fi.e.Stat }
@@ -0,0 +1,134 @@
+package linksame
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Scope limits which sets of identical files are linked, by where the files
+// are.
+type Scope int
+
+const (
+	// ScopeAny links identical files wherever they are.
+	ScopeAny Scope = iota
+	// ScopeDirs only links sets of identical files that span more than one
+	// directory.  Duplicates that are all in one directory are often
+	// intentional, such as variants of sample data.
+	ScopeDirs
+	// ScopeRoots only links sets of identical files that span more than one
+	// root.  When there are no roots, as with LinkGroups, this is the same
+	// as ScopeDirs.
+	ScopeRoots
+	// ScopeVersioned only links files in the same directory whose names have
+	// the same stem, differing only by version numbers, such as
+	// libfoo.so.1.0, libfoo.so.1, and libfoo.so.  Other duplicates are left
+	// alone.
+	ScopeVersioned
+)
+
+var scopeNames = []string{"any", "dirs", "roots", "versioned"}
+
+func (s Scope) String() string {
+	if s < 0 || int(s) >= len(scopeNames) {
+		return fmt.Sprintf("Scope(%d)", int(s))
+	}
+	return scopeNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Scope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseScope returns the Scope with the given name: "any", "dirs", "roots",
+// or "versioned".
+func ParseScope(name string) (Scope, error) {
+	for i := range scopeNames {
+		if name == scopeNames[i] {
+			return Scope(i), nil
+		}
+	}
+	return ScopeAny, fmt.Errorf("unknown scope %q", name)
+}
+
+// inScope reports whether the set of identical files is linked under the
+// scope in opts.
+func inScope(files []string, opts *Options) bool {
+	var where func(string) string
+	switch opts.Scope {
+	case ScopeDirs:
+		where = filepath.Dir
+	case ScopeRoots:
+		if len(opts.roots) == 0 {
+			where = filepath.Dir
+			break
+		}
+		where = func(file string) string {
+			return rootOf(file, opts.roots)
+		}
+	default:
+		return true
+	}
+	first := where(files[0])
+	for _, f := range files[1:] {
+		if where(f) != first {
+			return true
+		}
+	}
+	return false
+}
+
+// versionedSets divides files into sets of files in the same directory with
+// names that have the same stem.
+func versionedSets(files []string) [][]string {
+	index := map[string]int{}
+	var sets [][]string
+	for _, f := range files {
+		key := filepath.Join(filepath.Dir(f), versionStem(filepath.Base(f)))
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], f)
+	}
+	return sets
+}
+
+// versionStem returns the name without any trailing numeric version parts,
+// so that libfoo.so.1.0 becomes libfoo.so.
+func versionStem(name string) string {
+	for {
+		i := strings.LastIndexByte(name, '.')
+		if i <= 0 || i == len(name)-1 {
+			return name
+		}
+		for _, c := range name[i+1:] {
+			if c < '0' || c > '9' {
+				return name
+			}
+		}
+		name = name[:i]
+	}
+}
+
+// rootOf returns the root that contains file, or the directory of the file if
+// it is not in any of the roots.
+func rootOf(file string, roots []string) string {
+	for _, root := range roots {
+		if root == "." && !filepath.IsAbs(file) {
+			return root
+		}
+		prefix := root
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(file, prefix) {
+			return root
+		}
+	}
+	return filepath.Dir(file)
+}
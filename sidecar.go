@@ -0,0 +1,90 @@
+package linksame
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SidecarExtensions are the extensions of sidecar files, which hold the edits
+// and metadata of a photo or video next to it, as IMG_1.xmp or IMG_1.CR2.xmp
+// does for IMG_1.CR2.
+var SidecarExtensions = []string{".xmp", ".aae"}
+
+// isSidecar reports whether the file name has one of SidecarExtensions.
+func isSidecar(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, sidecarExt := range SidecarExtensions {
+		if ext == sidecarExt {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecars returns the sidecar files of the file, keyed by their lower case
+// extensions.  A sidecar named for the whole file name, such as
+// IMG_1.CR2.xmp, is preferred over one named for the name without its
+// extension.
+func sidecars(file string) map[string]string {
+	if isSidecar(file) {
+		return nil
+	}
+	stem := strings.TrimSuffix(file, filepath.Ext(file))
+	var found map[string]string
+	for _, ext := range SidecarExtensions {
+		for _, name := range []string{
+			file + ext, file + strings.ToUpper(ext),
+			stem + ext, stem + strings.ToUpper(ext),
+		} {
+			if info, err := os.Lstat(name); err == nil && info.Mode().IsRegular() {
+				if found == nil {
+					found = map[string]string{}
+				}
+				found[ext] = name
+				break
+			}
+		}
+	}
+	return found
+}
+
+// splitsSidecars reports whether replacing f with a symlink to baseFile
+// would separate f from its sidecars, since it is in another directory.
+func (o *Options) splitsSidecars(f, baseFile string) bool {
+	if !o.Sidecars || canonicalPath(filepath.Dir(f)) == canonicalPath(filepath.Dir(baseFile)) {
+		return false
+	}
+	return len(sidecars(f)) != 0
+}
+
+// linkSidecars handles the sidecars of f, after it is replaced with a link
+// to baseFile.  With LinkSidecars, each sidecar of f that is identical to the
+// sidecar of baseFile with the same extension is linked to it.  The other
+// sidecars of f are listed, to be reported.
+func (o *Options) linkSidecars(f, baseFile string) stats {
+	var st stats
+	if !o.Sidecars {
+		return st
+	}
+	baseSidecars := sidecars(baseFile)
+	for ext, sidecar := range sidecars(f) {
+		baseSidecar, ok := baseSidecars[ext]
+		if !o.LinkSidecars || !ok {
+			st.sidecars = append(st.sidecars, sidecar)
+			continue
+		}
+		same, err := sameContent(baseSidecar, sidecar)
+		if err != nil || !same {
+			st.sidecars = append(st.sidecars, sidecar)
+			continue
+		}
+		g := newDuplicateGroup("", 0, []string{baseSidecar, sidecar}, o.errOut())
+		if len(g.Files) > 1 {
+			g.Size = g.Files[0].Info.Size()
+			st.addGroup(g)
+			st.add(linkGroup(g, o))
+		}
+	}
+	return st
+}
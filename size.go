@@ -0,0 +1,156 @@
+package linksame
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SizeUnits selects the units that sizes are written in.
+type SizeUnits int
+
+const (
+	// UnitsShort writes sizes in powers of 1024 with a one-letter suffix,
+	// such as 1.5M, and sizes under 1K in bytes.
+	UnitsShort SizeUnits = iota
+	// UnitsBinary writes sizes in IEC binary units, such as 1.5 MiB.
+	UnitsBinary
+	// UnitsSI writes sizes in SI decimal units, such as 1.6 MB.
+	UnitsSI
+	// UnitsBytes writes sizes as exact numbers of bytes.
+	UnitsBytes
+)
+
+var sizeUnitsNames = []string{"short", "binary", "si", "bytes"}
+
+func (u SizeUnits) String() string {
+	if u < 0 || int(u) >= len(sizeUnitsNames) {
+		return fmt.Sprintf("SizeUnits(%d)", int(u))
+	}
+	return sizeUnitsNames[u]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (u SizeUnits) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// ParseSizeUnits returns the SizeUnits with the given name: "short",
+// "binary", "si", or "bytes".
+func ParseSizeUnits(name string) (SizeUnits, error) {
+	for i := range sizeUnitsNames {
+		if name == sizeUnitsNames[i] {
+			return SizeUnits(i), nil
+		}
+	}
+	return UnitsShort, fmt.Errorf("unknown size units %q", name)
+}
+
+// SizeFormat selects how sizes are written in output.  The zero value writes
+// sizes in UnitsShort, without digit grouping.  Sizes in JSON output are
+// always numbers of bytes.
+type SizeFormat struct {
+	Units SizeUnits
+	// Locale, such as "de_DE.UTF-8", selects the digit grouping and decimal
+	// separator, as with the LC_NUMERIC environment variable.  If empty, or
+	// "C" or "POSIX", digits are not grouped and the decimal separator is a
+	// period.
+	Locale string
+}
+
+var (
+	shortSuffixes  = []string{"K", "M", "G", "T", "P", "E"}
+	binarySuffixes = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	siSuffixes     = []string{"kB", "MB", "GB", "TB", "PB", "EB"}
+)
+
+// Format returns the size, in bytes, written as selected by f.
+func (f SizeFormat) Format(size int64) string {
+	group, decimal := localeSeparators(f.Locale)
+	var base float64
+	var suffixes []string
+	sep := " "
+	switch f.Units {
+	case UnitsBinary:
+		base, suffixes = 1024, binarySuffixes
+	case UnitsSI:
+		base, suffixes = 1000, siSuffixes
+	case UnitsBytes:
+		return groupDigits(strconv.FormatInt(size, 10), group) + " bytes"
+	default:
+		base, suffixes, sep = 1024, shortSuffixes, ""
+	}
+
+	num := float64(size)
+	if num < 0 {
+		num = -num
+	}
+	i := -1
+	for i+1 < len(suffixes) && num > base {
+		num /= base
+		i++
+	}
+	if i < 0 {
+		return groupDigits(strconv.FormatInt(size, 10), group) + " bytes"
+	}
+	s := strconv.FormatFloat(num, 'f', 1, 64)
+	if size < 0 {
+		s = "-" + s
+	}
+	dot := strings.IndexByte(s, '.')
+	return groupDigits(s[:dot], group) + decimal + s[dot+1:] + sep + suffixes[i]
+}
+
+// sizeStr returns the size written in the default SizeFormat.
+func sizeStr(size int64) string {
+	return SizeFormat{}.Format(size)
+}
+
+// groupDigits separates groups of three digits of the integer in s with
+// group.
+func groupDigits(s, group string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if group == "" || len(s) <= 3 {
+		return sign + s
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	first := len(s) % 3
+	if first == 0 {
+		first = 3
+	}
+	b.WriteString(s[:first])
+	for i := first; i < len(s); i += 3 {
+		b.WriteString(group)
+		b.WriteString(s[i : i+3])
+	}
+	return b.String()
+}
+
+// localeSeparators returns the digit group separator and the decimal
+// separator for the locale, such as "fr_FR.UTF-8".  Locales that are not
+// known use no group separator and a period, as for the C locale.
+func localeSeparators(locale string) (string, string) {
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	lang, region := locale, ""
+	if i := strings.IndexByte(locale, '_'); i >= 0 {
+		lang, region = locale[:i], locale[i+1:]
+	}
+	if region == "CH" && (lang == "de" || lang == "it" || lang == "fr") {
+		return "'", "."
+	}
+	switch lang {
+	case "en", "ja", "zh", "ko", "he", "th", "hi":
+		return ",", "."
+	case "de", "es", "it", "nl", "pt", "da", "id", "tr", "el", "ro", "hr", "sl", "sr":
+		return ".", ","
+	case "fr", "ru", "pl", "cs", "sk", "sv", "nb", "nn", "no", "fi", "uk", "hu", "bg", "lt", "lv", "et":
+		return " ", ","
+	}
+	return "", "."
+}
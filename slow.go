@@ -0,0 +1,155 @@
+package linksame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultPrefixSize is the number of bytes at the start of each file that are
+// hashed with SlowStorage, if PrefixSize is not set.
+const defaultPrefixSize = 64 << 10
+
+// prefixXattr is the extended attribute used to cache the hash of the start
+// of a file.
+const prefixXattr = "user.linksame.prefix"
+
+// errProvisional is returned when links are to be written from the
+// provisional results of SlowStorage, without verifying them.
+var errProvisional = errors.New("files are only compared by prefix with slow storage, so writing links requires verifying them")
+
+// prefixSize returns the number of bytes hashed at the start of each file
+// with SlowStorage.
+func (o *Options) prefixSize() int64 {
+	if o.PrefixSize > 0 {
+		return o.PrefixSize
+	}
+	return defaultPrefixSize
+}
+
+// hashedLen returns the number of bytes read to hash a file of the given
+// size.
+func (o *Options) hashedLen(size int64) int64 {
+	if o.SlowStorage && size > o.prefixSize() {
+		return o.prefixSize()
+	}
+	return size
+}
+
+// fileHash returns the hash that identifies the contents of the file.  With
+// SlowStorage, this is the cached hash of the start of the file.  Otherwise,
+// it is the hash of the whole file, as returned by cachedHashFile.
+func (o *Options) fileHash(file string, network bool) (string, error) {
+	if o.SlowStorage {
+		return cachedPrefixHash(file, o.prefixSize())
+	}
+	return o.cachedHashFile(file, network)
+}
+
+// cachedPrefixHash returns the hash of the first n bytes of the file, reading
+// it from an extended attribute of the file if it was cached there.  The
+// cached hash is only used if the file size and modification time are the
+// same as when it was cached, and it was produced by the same hash of the
+// same number of bytes.  When the hash is calculated, it is cached.
+func cachedPrefixHash(file string, n int64) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	// Cached value is size (8 bytes), mtime (8 bytes), prefix length (8
+	// bytes), digest.
+	val, err := getXattr(file, prefixXattr)
+	if err == nil && len(val) > 24 {
+		size := int64(binary.BigEndian.Uint64(val))
+		mtime := int64(binary.BigEndian.Uint64(val[8:]))
+		length := int64(binary.BigEndian.Uint64(val[16:]))
+		digest := string(val[24:])
+		if size == info.Size() && mtime == info.ModTime().UnixNano() &&
+			length == n && len(digest) == newHash().Size() {
+			return digest, nil
+		}
+	}
+
+	h, err := hashPrefix(file, n)
+	if err != nil {
+		return "", err
+	}
+	val = make([]byte, 24, 24+len(h))
+	binary.BigEndian.PutUint64(val, uint64(info.Size()))
+	binary.BigEndian.PutUint64(val[8:], uint64(info.ModTime().UnixNano()))
+	binary.BigEndian.PutUint64(val[16:], uint64(n))
+	val = append(val, h...)
+	// Ignore error, since file system may not support extended attributes
+	// or may be read-only.
+	setXattr(file, prefixXattr, val)
+	return h, nil
+}
+
+// hashPrefix calculates a hash of the first n bytes of the file.  The file is
+// read as a file on a network file system, retrying after transient errors.
+func hashPrefix(file string, n int64) (string, error) {
+	delay := netRetryDelay
+	for i := 0; ; i++ {
+		h, err := hashPrefixOnce(file, n)
+		if err == nil || i == netRetries || !isTransient(err) {
+			return h, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// hashPrefixOnce calculates a hash of the first n bytes of the file.
+func hashPrefixOnce(file string, n int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bufSize := int64(netBufferSize)
+	if n < bufSize {
+		bufSize = n
+	}
+	h := newHash()
+	if _, err = io.CopyBuffer(h, io.LimitReader(f, n), make([]byte, bufSize)); err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// readBudget limits the number of bytes read to hash files.
+type readBudget struct {
+	mu   sync.Mutex
+	left int64
+}
+
+// prepareReads sets up the limit on bytes read to hash files.
+func (o *Options) prepareReads() {
+	o.reads = nil
+	if o.ReadBudget > 0 {
+		o.reads = &readBudget{left: o.ReadBudget}
+	}
+}
+
+// reserveRead reports whether a file of the given size can be hashed within
+// ReadBudget, and if so, counts the bytes to read against it.  Bytes are
+// counted before the file is read, even if its hash turns out to be cached,
+// so that the budget is never exceeded.
+func (o *Options) reserveRead(size int64) bool {
+	b := o.reads
+	if b == nil {
+		return true
+	}
+	n := o.hashedLen(size)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		return false
+	}
+	b.left -= n
+	return true
+}
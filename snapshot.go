@@ -0,0 +1,69 @@
+package linksame
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isSnapshotDir reports whether the directory at path holds file system
+// snapshots, or is a snapshot: the .zfs/snapshot directory of ZFS, the
+// .snapshot directory of NetApp and other NAS, the .snapshots directory of
+// snapper, or an @GMT- directory of Windows previous versions exported by
+// Samba.
+func isSnapshotDir(path string) bool {
+	name := filepath.Base(path)
+	switch {
+	case name == ".snapshot", name == ".snapshots":
+		return true
+	case name == "snapshot":
+		return filepath.Base(filepath.Dir(path)) == ".zfs"
+	case name == ".zfs":
+		// The snapshot directory of ZFS is normally hidden, but is visible
+		// with snapdir=visible.
+		return true
+	}
+	return strings.HasPrefix(name, "@GMT-")
+}
+
+// inSnapshot reports whether the file at path is in a snapshot directory.
+func inSnapshot(path string) bool {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if isSnapshotDir(dir) {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// skipSnapshot reports whether the walk of root is to skip the directory at
+// path, because it is a snapshot directory and IncludeSnapshots is not set.
+// A root is never skipped, since a snapshot given as a root was asked for.
+func (o *Options) skipSnapshot(path string, info os.FileInfo, root string) bool {
+	if o.IncludeSnapshots || !info.IsDir() || path == root || !isSnapshotDir(path) {
+		return false
+	}
+	if o.Verbose {
+		fmt.Fprintln(o.out(), "excluded snapshot directory:", path)
+	}
+	return true
+}
+
+// removeSnapshots removes the files in snapshot directories from files, and
+// returns the files that remain and the files removed.
+func removeSnapshots(files []string) ([]string, []string) {
+	var removed []string
+	for i := 0; i < len(files); {
+		if !inSnapshot(files[i]) {
+			i++
+			continue
+		}
+		removed = append(removed, files[i])
+		files[i] = files[len(files)-1]
+		files = files[:len(files)-1]
+	}
+	return files, removed
+}
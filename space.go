@@ -0,0 +1,98 @@
+package linksame
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// spacePollInterval is how often free space is checked while paused.
+const spacePollInterval = 5 * time.Second
+
+// spaceGuard stops a run from modifying files once a file system is full,
+// or its free space is below the minimum.
+type spaceGuard struct {
+	mu    sync.Mutex
+	min   int64
+	pause time.Duration
+	quiet bool
+	err   error
+}
+
+// prepareSpace sets up the check for free space.
+func (o *Options) prepareSpace() {
+	o.space = &spaceGuard{min: o.MinFreeSpace, pause: o.PauseLowSpace, quiet: o.Quiet}
+}
+
+// checkSpace returns an error if the run has stopped for lack of space, or
+// if the free space on the file system containing dir is below
+// MinFreeSpace, in which case the run stops.  If PauseLowSpace is set, the
+// run first waits up to that long for free space to recover.  All linking
+// waits while paused, since other linkers block on the guard.
+func (o *Options) checkSpace(dir string) error {
+	g := o.space
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err != nil || g.min <= 0 {
+		return g.err
+	}
+	free := freeSpace(dir)
+	if free < 0 || free >= g.min {
+		return nil
+	}
+	if g.pause > 0 {
+		if !g.quiet {
+			fmt.Fprintf(o.out(), "paused: free space in %s is %s, below the minimum of %s\n",
+				dir, o.SizeFormat.Format(free), o.SizeFormat.Format(g.min))
+		}
+		deadline := time.Now().Add(g.pause)
+		for free < g.min && time.Now().Before(deadline) {
+			wait := time.Until(deadline)
+			if wait > spacePollInterval {
+				wait = spacePollInterval
+			}
+			time.Sleep(wait)
+			free = freeSpace(dir)
+		}
+		if free >= g.min {
+			if !g.quiet {
+				fmt.Fprintln(o.out(), "resumed: free space in", dir, "is", o.SizeFormat.Format(free))
+			}
+			return nil
+		}
+	}
+	g.err = fmt.Errorf("stopped: free space in %s is %s, below the minimum of %s",
+		dir, o.SizeFormat.Format(free), o.SizeFormat.Format(g.min))
+	return g.err
+}
+
+// noteSpace stops the run if err is because a file system, or a disk quota,
+// is full.
+func (o *Options) noteSpace(err error) {
+	g := o.space
+	if g == nil || !(errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)) {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err == nil {
+		g.err = fmt.Errorf("stopped: %w", err)
+	}
+}
+
+// spaceFailed returns the error that stopped the run for lack of space, if
+// any.
+func (o *Options) spaceFailed() error {
+	g := o.space
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system containing path, or -1 if this cannot be found.
+func freeSpace(path string) int64 {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return -1
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+// freeSpace returns -1, since finding free space is not supported on this
+// platform.
+func freeSpace(path string) int64 {
+	return -1
+}
@@ -0,0 +1,12 @@
+package linksame
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocated returns the storage allocated to a file, counted in blocks.  This
+// is less than the size of a file with holes, or with compressed contents.
+func allocated(info os.FileInfo) int64 {
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
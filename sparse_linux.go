@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import (
+	"os"
+	"syscall"
+)
+
+// haveHoles is true where the holes in sparse files can be found.
+const haveHoles = true
+
+// seekHole is the lseek whence that seeks to the next hole in a file.
+const seekHole = 4
+
+// isSparse reports whether the file has holes.  Only files allocated fewer
+// blocks than their size are checked for holes, since those allocated fewer
+// blocks for being compressed have none.
+func isSparse(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil || allocated(info) >= info.Size() {
+		return false
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	// Every file has a hole at its end, so a file has holes if the first is
+	// before the end.
+	off, err := syscall.Seek(int(f.Fd()), 0, seekHole)
+	if err != nil {
+		// Without SEEK_HOLE support, go by the blocks allocated.
+		return true
+	}
+	return off < info.Size()
+}
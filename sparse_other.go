@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+import "os"
+
+// haveHoles is false, since holes cannot be found on this platform, and
+// sparse files are found by the storage allocated to them.
+const haveHoles = false
+
+// isSparse reports whether the file has holes, judging by whether it is
+// allocated fewer blocks than its size, since finding holes is not supported
+// on this platform.
+func isSparse(file string) bool {
+	info, err := os.Stat(file)
+	return err == nil && allocated(info) < info.Size()
+}
@@ -0,0 +1,98 @@
+package linksame
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// storeCheckBatch is the number of store paths whose validity is checked by
+// each run of nix-store, to stay within the limit on command line length.
+const storeCheckBatch = 1000
+
+// prepareStore sets the options that optimize a store as nix-store
+// --optimise does, and finds the paths in the store, within roots, that are
+// not registered as valid.
+func (o *Options) prepareStore(roots []string) error {
+	o.invalidStorePaths = nil
+	if o.Store == "" {
+		return nil
+	}
+	o.Symlink = false
+	o.NoFallback = true
+	o.Safe = true
+	o.Strategies = nil
+	o.NameStrategies = nil
+
+	store := filepath.Clean(o.Store)
+	entries, err := os.ReadDir(store)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, e := range entries {
+		// The .links directory holds the links made by nix-store
+		// --optimise, and is not a store path.
+		if e.Name() != ".links" {
+			paths = append(paths, filepath.Join(store, e.Name()))
+		}
+	}
+	invalid := map[string]bool{}
+	for len(paths) != 0 {
+		n := len(paths)
+		if n > storeCheckBatch {
+			n = storeCheckBatch
+		}
+		args := append([]string{"--check-validity", "--print-invalid"}, paths[:n]...)
+		out, err := exec.Command("nix-store", args...).Output()
+		if err != nil {
+			return fmt.Errorf("checking validity of store paths: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				invalid[filepath.Base(line)] = true
+			}
+		}
+		paths = paths[n:]
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	// Find the paths, as the scanner finds them within each root, of the
+	// invalid store paths.
+	canonStore := canonicalPath(store)
+	o.invalidStorePaths = map[string]bool{}
+	for _, root := range roots {
+		canonRoot := canonicalPath(root)
+		if withinRoots(canonStore, []string{canonRoot}) {
+			rel, err := filepath.Rel(canonRoot, canonStore)
+			if err != nil {
+				continue
+			}
+			for name := range invalid {
+				o.invalidStorePaths[filepath.Join(root, rel, name)] = true
+			}
+		} else if withinRoots(canonRoot, []string{canonStore}) {
+			rel, err := filepath.Rel(canonStore, canonRoot)
+			if err != nil {
+				continue
+			}
+			if invalid[strings.SplitN(rel, string(filepath.Separator), 2)[0]] {
+				o.invalidStorePaths[root] = true
+			}
+		}
+	}
+	return nil
+}
+
+// invalidStorePath reports whether the path, as found by the scanner, is a
+// store path that is not registered as valid, such as one being built.
+func (o *Options) invalidStorePath(path string) bool {
+	return o.invalidStorePaths[path]
+}
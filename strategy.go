@@ -0,0 +1,138 @@
+package linksame
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Strategy is how a duplicate file is replaced.
+type Strategy int
+
+const (
+	// StrategyDefault uses hardlinks, or symlinks if Options.Symlink is set.
+	StrategyDefault Strategy = iota
+	// StrategyHardlink replaces files with hardlinks, or with symlinks if
+	// hardlinks fail.
+	StrategyHardlink
+	// StrategySymlink replaces files with symlinks.
+	StrategySymlink
+	// StrategyReflink replaces files with reflinks, which are copies that
+	// share data blocks with the original until modified.  This requires a
+	// file system that supports reflinks, such as btrfs or XFS.
+	StrategyReflink
+	// StrategyReportOnly does not replace files, but reports them as if not
+	// writing links.
+	StrategyReportOnly
+)
+
+var strategyNames = []string{"default", "hardlink", "symlink", "reflink", "report"}
+
+func (s Strategy) String() string {
+	if s < 0 || int(s) >= len(strategyNames) {
+		return fmt.Sprintf("Strategy(%d)", int(s))
+	}
+	return strategyNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Strategy) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseStrategy returns the Strategy with the given name: "hardlink",
+// "symlink", "reflink", or "report".
+func ParseStrategy(name string) (Strategy, error) {
+	for i := range strategyNames {
+		if name == strategyNames[i] {
+			return Strategy(i), nil
+		}
+	}
+	return StrategyDefault, fmt.Errorf("unknown strategy %q", name)
+}
+
+// strategyDir is a directory, or for NameStrategies a pattern, and the
+// strategy for files in it or matching it.
+type strategyDir struct {
+	dir      string
+	strategy Strategy
+}
+
+// prepareStrategies resolves the directories in Strategies to canonical
+// paths, ordered so that the most specific directory is found first, and
+// orders the patterns in NameStrategies so that the longest is tried first.
+func (o *Options) prepareStrategies() {
+	o.strategyDirs = o.strategyDirs[:0]
+	for dir, strategy := range o.Strategies {
+		o.strategyDirs = append(o.strategyDirs, strategyDir{canonicalPath(dir), strategy})
+	}
+	sort.Slice(o.strategyDirs, func(i, j int) bool {
+		return len(o.strategyDirs[i].dir) > len(o.strategyDirs[j].dir)
+	})
+	o.strategyPatterns = o.strategyPatterns[:0]
+	for pattern, strategy := range o.NameStrategies {
+		o.strategyPatterns = append(o.strategyPatterns, strategyDir{pattern, strategy})
+	}
+	sort.Slice(o.strategyPatterns, func(i, j int) bool {
+		pi, pj := o.strategyPatterns[i].dir, o.strategyPatterns[j].dir
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return pi < pj
+	})
+}
+
+// prepareReadOnly finds the roots that are on read-only file systems, where
+// duplicates are only reported, when writing links.
+func (o *Options) prepareReadOnly(roots []string) {
+	o.readOnlyRoots = nil
+	if !o.WriteLinks {
+		return
+	}
+	for _, root := range roots {
+		if !readOnlyFS(root) {
+			continue
+		}
+		if !o.Quiet {
+			fmt.Fprintln(o.out(), "Only reporting duplicates in", root+",",
+				"since it is on a read-only file system")
+		}
+		o.readOnlyRoots = append(o.readOnlyRoots, canonicalPath(root))
+	}
+}
+
+// strategyFor returns the strategy for replacing the file.  Files on
+// read-only file systems are only reported.  Otherwise, a pattern in
+// NameStrategies that the file matches takes precedence over the directories
+// in Strategies.  The canonical path of the file is only found, once, when
+// there are read-only roots or directories in Strategies.
+func (o *Options) strategyFor(file string) Strategy {
+	var canon string
+	if len(o.readOnlyRoots) != 0 || len(o.strategyDirs) != 0 {
+		canon = canonicalPath(file)
+	}
+	strategy := StrategyDefault
+	if len(o.readOnlyRoots) != 0 && withinRoots(canon, o.readOnlyRoots) {
+		return StrategyReportOnly
+	}
+	for _, sp := range o.strategyPatterns {
+		if matchPattern(sp.dir, file) {
+			strategy = sp.strategy
+			break
+		}
+	}
+	if strategy == StrategyDefault && len(o.strategyDirs) != 0 {
+		for _, sd := range o.strategyDirs {
+			if withinDir(canon, sd.dir) {
+				strategy = sd.strategy
+				break
+			}
+		}
+	}
+	if strategy == StrategyDefault {
+		if o.Symlink {
+			return StrategySymlink
+		}
+		return StrategyHardlink
+	}
+	return strategy
+}
@@ -0,0 +1,49 @@
+package linksame
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrStrict is returned, wrapped with what went wrong, by a run with Strict
+// that skipped files, fell back to symlinks, or had errors.
+var ErrStrict = errors.New("strict mode")
+
+// strictError returns an error describing the files that the run summarized
+// did not link as asked, or nil if there are none.
+func (s *Summary) strictError() error {
+	var problems []string
+	var skipped int
+	reasons := make([]string, 0, len(s.Skipped)+len(s.PermissionDenied))
+	for reason, n := range s.Skipped {
+		skipped += n
+		reasons = append(reasons, fmt.Sprint(reason, " ", n))
+	}
+	for reason, n := range s.PermissionDenied {
+		skipped += n
+		reasons = append(reasons, fmt.Sprint("permission denied (", reason, ") ", n))
+	}
+	if s.TooLarge.Files != 0 {
+		skipped += s.TooLarge.Files
+		reasons = append(reasons, fmt.Sprint("too large ", s.TooLarge.Files))
+	}
+	if skipped != 0 {
+		sort.Strings(reasons)
+		problems = append(problems, fmt.Sprintf("%d files skipped (%s)", skipped, strings.Join(reasons, ", ")))
+	}
+	if s.SymlinkFallback.Files != 0 {
+		problems = append(problems, fmt.Sprint(s.SymlinkFallback.Files, " files symlinked instead of hardlinked"))
+	}
+	if s.RolledBack != 0 {
+		problems = append(problems, fmt.Sprint(s.RolledBack, " sets of files rolled back"))
+	}
+	if s.Errors != 0 {
+		problems = append(problems, fmt.Sprint(s.Errors, " errors"))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrStrict, strings.Join(problems, ", "))
+}
@@ -0,0 +1,474 @@
+package linksame
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Reasons that files are skipped, used as keys of Summary.Skipped.
+const (
+	SkipImmutable       = "immutable"
+	SkipPrivileged      = "privileged"
+	SkipReadOnly        = "read-only"
+	SkipNotHardlinkable = "not-hardlinkable"
+	SkipForbidden       = "forbidden"
+	SkipOverBudget      = "over-budget"
+	SkipOutOfScope      = "out-of-scope"
+	SkipCrossOwner      = "cross-owner"
+	SkipOverReadBudget  = "over-read-budget"
+	SkipSnapshot        = "snapshot"
+	SkipSparse          = "sparse"
+	SkipRecent          = "recent"
+	SkipOverMaxChanges  = "over-max-changes"
+	SkipInvalidStore    = "invalid-store-path"
+	SkipMaildirFlags    = "maildir-flags"
+	SkipSidecarBound    = "sidecar-bound"
+	SkipUnsafe          = "metadata-differs"
+)
+
+// Reasons that links would fail for lack of permission, used as keys of
+// Summary.PermissionDenied.
+const (
+	// DenyStickyDir is a file in a directory with the sticky bit set, which
+	// is owned by another user, as is the directory.
+	DenyStickyDir = "sticky-directory"
+	// DenyUnreadable is a file that must be read, to verify its contents or
+	// to create a reflink to it, and that is not readable.
+	DenyUnreadable = "unreadable"
+)
+
+// FileCount is a number of files and their total size.
+type FileCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// GroupReport describes a set of identical files in a Summary.
+type GroupReport struct {
+	// ID is the ID of the group, as returned by DuplicateGroup.ID.
+	ID string `json:"id"`
+	// Size is the size of each file.
+	Size int64 `json:"size"`
+	// Hash is the hash of the files, in hex, or empty if they were not
+	// hashed.  A hash taken from a manifest starts with "manifest:".
+	Hash string `json:"hash,omitempty"`
+	// Paths are the paths of the files, sorted.
+	Paths []string `json:"paths"`
+}
+
+// addGroup counts the group of identical files, and adds it to the groups
+// reported.
+func (s *stats) addGroup(g *DuplicateGroup) {
+	s.groups++
+	r := GroupReport{ID: g.ID(), Size: g.Size, Paths: g.Paths()}
+	if strings.HasPrefix(g.Hash, manifestPrefix) {
+		r.Hash = manifestPrefix + hex.EncodeToString([]byte(g.Hash[len(manifestPrefix):]))
+	} else if g.Hash != "" {
+		r.Hash = hex.EncodeToString([]byte(g.Hash))
+	}
+	sort.Strings(r.Paths)
+	s.groupList = append(s.groupList, r)
+}
+
+// Summary describes the results of linking identical files.  When links are
+// not written, it describes what would have been done.
+type Summary struct {
+	// DryRun is true if links were not written.
+	DryRun bool `json:"dry_run"`
+	// Provisional is true if files were only compared by the start of their
+	// contents, so that the files found to be identical may differ.
+	Provisional bool `json:"provisional"`
+	// Candidates is the number of files considered.
+	Candidates int `json:"candidates"`
+	// Groups is the number of sets of identical files found.
+	Groups int `json:"groups"`
+	// DuplicateGroups describes each set of identical files found, sorted by
+	// ID, so that the groups of a report or plan can be picked out by their
+	// IDs.  It is left out when the summary is encoded as JSON, as it is in
+	// the journal, since it may be large.
+	DuplicateGroups []GroupReport `json:"-"`
+	// Hashed is the files read to calculate their hashes.
+	Hashed FileCount `json:"hashed"`
+	// FromManifests is the number of files whose hashes were taken from
+	// trusted manifests, without reading them.
+	FromManifests int `json:"from_manifests"`
+	// Reused is the number of files whose hashes were kept by an Engine
+	// from an earlier call, without reading them again.
+	Reused int `json:"reused,omitempty"`
+	// Linked is the files replaced with links, and the storage saved, less
+	// SymlinkOverhead.
+	Linked FileCount `json:"linked"`
+	// SymlinkOverhead is the estimated storage used by the symlinks that
+	// replaced files.
+	SymlinkOverhead int64 `json:"symlink_overhead_bytes"`
+	// InodesFreed is the number of inodes freed by creating hardlinks.
+	InodesFreed int `json:"inodes_freed"`
+	// StorageFreed is the storage allocated to the freed inodes, counted in
+	// blocks.  This differs from their size when files are sparse or
+	// compressed.
+	StorageFreed int64 `json:"storage_freed_bytes"`
+	// SymlinkFallback is the files replaced with symlinks because hardlinks
+	// could not be created.
+	SymlinkFallback FileCount `json:"symlink_fallback"`
+	// CrossDevice is the duplicate files on a different file system than
+	// the file they are linked to.
+	CrossDevice FileCount `json:"cross_device"`
+	// AlreadySymlinked is the files that are already symlinks to identical
+	// files.
+	AlreadySymlinked FileCount `json:"already_symlinked"`
+	// AlreadyReflinked is the files not linked because they already share
+	// all of their data with the file they would be linked to.
+	AlreadyReflinked FileCount `json:"already_reflinked"`
+	// SymlinksRewritten is the number of existing symlinks rewritten between
+	// absolute and relative.
+	SymlinksRewritten int `json:"symlinks_rewritten"`
+	// ReportOnly is the duplicate files not replaced because they are in
+	// report-only locations.
+	ReportOnly FileCount `json:"report_only"`
+	// SavedByOwner maps the user ID of each owner of replaced files, on file
+	// systems with disk quotas, to the files replaced and the storage saved
+	// from their quota.
+	SavedByOwner map[uint32]FileCount `json:"saved_by_owner,omitempty"`
+	// Reclaimed advises, for each file system that already deduplicates or
+	// compresses data, how much storage replacing files is likely to free.
+	Reclaimed []FSReclaim `json:"fs_reclaim,omitempty"`
+	// Escalated is the files that need privileges to replace, which are
+	// written to Options.Escalate.  These are not counted as replaced.
+	Escalated FileCount `json:"escalated"`
+	// TooLarge is the duplicate files not replaced, and the storage that
+	// replacing them would save, because they are in sets of identical files
+	// over MaxLinkSize or MaxGroupSize.
+	TooLarge FileCount `json:"too_large"`
+	// SnapshotDirs is the number of snapshot directories that were not
+	// scanned.
+	SnapshotDirs int `json:"snapshot_dirs_excluded"`
+	// SnapshotOnly is the number of sets of identical files that only have
+	// duplicates in snapshot directories, with IncludeSnapshots.
+	SnapshotOnly int `json:"snapshot_only_groups"`
+	// RolledBack is the number of sets of identical files restored after
+	// failing to link.
+	RolledBack int `json:"rolled_back"`
+	// Skipped maps each reason that files were skipped to the number of
+	// files skipped.
+	Skipped map[string]int `json:"skipped,omitempty"`
+	// SkippedFiles maps each reason that files were skipped to the files
+	// skipped, for reasons that list files.
+	SkippedFiles map[string][]string `json:"skipped_files,omitempty"`
+	// PermissionDenied maps each reason that replacing files would fail for
+	// lack of permission to the number of files, when links are not written.
+	// These files are not counted as replaced.
+	PermissionDenied map[string]int `json:"permission_denied,omitempty"`
+	// Errors is the number of errors that kept a file from being hashed or
+	// linked.
+	Errors int `json:"errors"`
+	// Duration is how long the run took.
+	Duration time.Duration `json:"duration_ns"`
+	// Throughput is the number of bytes hashed per second.
+	Throughput float64 `json:"throughput_bytes_per_sec"`
+	// Resources is the resources used by the run, if reported.
+	Resources *Resources `json:"resources,omitempty"`
+}
+
+// WriteTable writes the summary as an aligned table.  Rows for things that
+// did not happen are omitted.
+func (s *Summary) WriteTable(w io.Writer) error {
+	return s.WriteTableFormat(w, SizeFormat{})
+}
+
+// WriteTableFormat writes the summary as WriteTable does, with sizes written
+// as selected by f.
+func (s *Summary) WriteTableFormat(w io.Writer, f SizeFormat) error {
+	if s.DryRun {
+		fmt.Fprintln(w, "If writing links (-w), would have...")
+	}
+	if s.Provisional {
+		fmt.Fprintln(w, "Provisional: files were only compared by their first bytes")
+	}
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	count := func(label string, c FileCount) {
+		fmt.Fprintf(tw, "%s\t%d files\t%s\t\t\n", label, c.Files, f.Format(c.Bytes))
+	}
+	fmt.Fprintf(tw, "Candidate files\t%d\t\t\n", s.Candidates)
+	fmt.Fprintf(tw, "Duplicate groups\t%d\t\t\n", s.Groups)
+	count("Hashed", s.Hashed)
+	if s.FromManifests != 0 {
+		fmt.Fprintf(tw, "Hashes from manifests\t%d files\t\t\n", s.FromManifests)
+	}
+	if s.Reused != 0 {
+		fmt.Fprintf(tw, "Hashes reused\t%d files\t\t\n", s.Reused)
+	}
+	count("Replaced with links", s.Linked)
+	if s.SymlinkOverhead != 0 {
+		fmt.Fprintf(tw, "Symlink overhead\t\t%s\t\n", f.Format(s.SymlinkOverhead))
+	}
+	fmt.Fprintf(tw, "Inodes freed\t%d\t\t\n", s.InodesFreed)
+	if s.StorageFreed != 0 {
+		fmt.Fprintf(tw, "Storage freed\t\t%s\t\n", f.Format(s.StorageFreed))
+	}
+	uids := make([]uint32, 0, len(s.SavedByOwner))
+	for uid := range s.SavedByOwner {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	for _, uid := range uids {
+		count("Saved for "+userName(uid), s.SavedByOwner[uid])
+	}
+	if s.SymlinkFallback.Files != 0 {
+		count("Symlink fallbacks", s.SymlinkFallback)
+	}
+	if s.CrossDevice.Files != 0 {
+		count("Across file systems", s.CrossDevice)
+	}
+	if s.AlreadySymlinked.Files != 0 {
+		count("Already symlinked", s.AlreadySymlinked)
+	}
+	if s.AlreadyReflinked.Files != 0 {
+		count("Already reflinked", s.AlreadyReflinked)
+	}
+	if s.SymlinksRewritten != 0 {
+		fmt.Fprintf(tw, "Symlinks rewritten\t%d\t\t\n", s.SymlinksRewritten)
+	}
+	if s.ReportOnly.Files != 0 {
+		count("Report-only duplicates", s.ReportOnly)
+	}
+	if s.Escalated.Files != 0 {
+		count("Need privileges", s.Escalated)
+	}
+	if s.TooLarge.Files != 0 {
+		count("Over size limit", s.TooLarge)
+	}
+	if s.SnapshotDirs != 0 {
+		fmt.Fprintf(tw, "Snapshot dirs excluded\t%d\t\t\n", s.SnapshotDirs)
+	}
+	if s.SnapshotOnly != 0 {
+		fmt.Fprintf(tw, "Only in snapshots\t%d sets\t\t\n", s.SnapshotOnly)
+	}
+	if s.RolledBack != 0 {
+		fmt.Fprintf(tw, "Rolled back\t%d sets\t\t\n", s.RolledBack)
+	}
+	reasons := make([]string, 0, len(s.Skipped))
+	for reason := range s.Skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(tw, "Skipped (%s)\t%d files\t\t\n", reason, s.Skipped[reason])
+	}
+	reasons = reasons[:0]
+	for reason := range s.PermissionDenied {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(tw, "Permission denied (%s)\t%d files\t\t\n", reason, s.PermissionDenied[reason])
+	}
+	fmt.Fprintf(tw, "Errors\t%d\t\t\n", s.Errors)
+	fmt.Fprintf(tw, "Duration\t%s\t\t\n", s.Duration.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Throughput\t%s/s\t\t\n", f.Format(int64(s.Throughput)))
+	if r := s.Resources; r != nil {
+		fmt.Fprintf(tw, "CPU time\t%s user\t%s system\t\n",
+			r.UserCPU.Round(time.Millisecond), r.SystemCPU.Round(time.Millisecond))
+		fmt.Fprintf(tw, "Scan time\t%s\t\t\n", r.ScanTime.Round(time.Millisecond))
+		fmt.Fprintf(tw, "Link time\t%s\t\t\n", r.LinkTime.Round(time.Millisecond))
+		fmt.Fprintf(tw, "Data read\t\t%s\t\n", f.Format(r.BytesRead))
+		fmt.Fprintf(tw, "Peak memory\t\t%s\t\n", f.Format(r.PeakMemory))
+	}
+	tw.Flush()
+
+	// Remove the padding after the last column of each row.
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summary returns the summary of the results, for a run that took duration.
+func (s *stats) summary(writeLinks bool, duration time.Duration) Summary {
+	sum := Summary{
+		DryRun:            !writeLinks,
+		Candidates:        s.candidates,
+		Groups:            s.groups,
+		DuplicateGroups:   s.groupList,
+		Hashed:            FileCount{s.hashedFiles, s.hashedBytes},
+		FromManifests:     s.fromManifest,
+		Reused:            s.reused,
+		Linked:            FileCount{s.links, s.saved},
+		SymlinkOverhead:   s.symlinkOverhead,
+		InodesFreed:       s.inodes,
+		StorageFreed:      s.freed,
+		SymlinkFallback:   FileCount{s.fallback, s.fallbackSize},
+		CrossDevice:       FileCount{s.crossDevice, s.crossDeviceSize},
+		AlreadySymlinked:  FileCount{s.symlinked, s.symlinkedSize},
+		AlreadyReflinked:  FileCount{s.reflinked, s.reflinkedSize},
+		SymlinksRewritten: s.rewritten,
+		ReportOnly:        FileCount{s.reportOnly, s.reportOnlySize},
+		SavedByOwner:      s.ownerSaved,
+		Reclaimed:         reclaimAdvice(s.reclaimSaved),
+		Escalated:         FileCount{len(s.escalations), s.escalatedSize},
+		SnapshotDirs:      s.snapshotDirs,
+		SnapshotOnly:      s.snapshotOnly,
+		RolledBack:        s.rolledBack,
+		Errors:            s.errors,
+		Duration:          duration,
+	}
+	sort.Slice(sum.DuplicateGroups, func(i, j int) bool {
+		return sum.DuplicateGroups[i].ID < sum.DuplicateGroups[j].ID
+	})
+	for _, g := range s.tooLarge {
+		sum.TooLarge.Files += len(g.Files) - 1
+		sum.TooLarge.Bytes += g.Size * int64(len(g.Files)-1)
+	}
+	if secs := duration.Seconds(); secs > 0 {
+		sum.Throughput = float64(s.hashedBytes) / secs
+	}
+	for _, skip := range []struct {
+		reason string
+		files  []string
+	}{
+		{SkipImmutable, s.immutable},
+		{SkipPrivileged, s.privileged},
+		{SkipReadOnly, s.readOnly},
+		{SkipNotHardlinkable, s.noFallback},
+		{SkipForbidden, s.forbidden},
+		{SkipCrossOwner, s.crossOwner},
+		{SkipSnapshot, s.inSnapshot},
+		{SkipSparse, s.sparse},
+		{SkipSidecarBound, s.sidecarBound},
+		{SkipUnsafe, s.unsafe},
+	} {
+		if len(skip.files) == 0 {
+			continue
+		}
+		if sum.Skipped == nil {
+			sum.Skipped = map[string]int{}
+			sum.SkippedFiles = map[string][]string{}
+		}
+		sort.Strings(skip.files)
+		sum.Skipped[skip.reason] = len(skip.files)
+		sum.SkippedFiles[skip.reason] = skip.files
+	}
+	for _, skip := range []struct {
+		reason string
+		count  int
+	}{
+		{SkipOverBudget, s.overBudget},
+		{SkipOutOfScope, s.outOfScope},
+		{SkipOverReadBudget, s.overReadBudget},
+		{SkipRecent, s.recent},
+		{SkipOverMaxChanges, s.overChanges},
+		{SkipInvalidStore, s.invalidStorePaths},
+		{SkipMaildirFlags, s.maildirFlagged},
+	} {
+		if skip.count == 0 {
+			continue
+		}
+		if sum.Skipped == nil {
+			sum.Skipped = map[string]int{}
+		}
+		sum.Skipped[skip.reason] = skip.count
+	}
+	for reason, files := range s.denied {
+		if sum.PermissionDenied == nil {
+			sum.PermissionDenied = map[string]int{}
+		}
+		sum.PermissionDenied[reason] = len(files)
+	}
+	return sum
+}
+
+// finish prints the files skipped and the summary of the results, or gives
+// the summary to the caller if requested, records the end of the run in the
+// journal, and writes the mapping of duplicate files to kept files if
+// requested.
+func (s *stats) finish(start time.Time, opts *Options) error {
+	opts.vlog.finish(opts.out())
+	if !opts.Quiet {
+		fmt.Fprintln(opts.out())
+		printSkipped(opts.out(), s.immutable, "immutable or append-only")
+		printSkipped(opts.out(), s.privileged, "setuid, setgid, or capability-bearing")
+		printSkipped(opts.out(), s.readOnly, "read-only")
+		printSkipped(opts.out(), s.noFallback, "not hardlinkable")
+		printSkipped(opts.out(), s.forbidden, "policy-forbidden")
+		printSkipped(opts.out(), s.crossOwner, "cross-owner")
+		printSkipped(opts.out(), s.sparse, "sparse")
+		printSkipped(opts.out(), s.sidecarBound, "sidecar-bound")
+		printSkipped(opts.out(), s.unsafe, "differing permission or ownership")
+		if len(s.sidecars) != 0 {
+			fmt.Fprintln(opts.out(), "Sidecars of replaced files, left as they are:")
+			sort.Strings(s.sidecars)
+			for _, f := range s.sidecars {
+				fmt.Fprintln(opts.out(), " ", f)
+			}
+		}
+		printTooLarge(opts.out(), s.tooLarge, opts.SizeFormat)
+		if s.snapshotOnly != 0 {
+			fmt.Fprintln(opts.out(), s.snapshotOnly, "sets of identical files only have duplicates in snapshots, and are not real duplicates")
+		}
+		printDenied(opts.out(), s.denied[DenyStickyDir], "files in sticky directories of other users")
+		printDenied(opts.out(), s.denied[DenyUnreadable], "unreadable files")
+		if s.overChanges != 0 {
+			fmt.Fprintln(opts.out(), "Limit of", opts.MaxChanges, "files replaced reached:", s.overChanges,
+				"files,", opts.SizeFormat.Format(s.overChangesSize)+",", "not replaced")
+		}
+		if s.overBudget != 0 {
+			fmt.Fprintln(opts.out(), "Policy limit on data replaced reached:", s.overBudget,
+				"files,", opts.SizeFormat.Format(s.overBudgetSize)+",", "not replaced")
+		}
+	}
+	sum := s.summary(opts.WriteLinks, time.Since(start))
+	sum.Provisional = opts.SlowStorage
+	sum.Resources = opts.usage.resources(s.hashedBytes + s.verifiedBytes)
+	if !opts.Quiet {
+		printReclaimAdvice(opts.out(), sum.Reclaimed, opts.SizeFormat)
+	}
+	if opts.Summary != nil {
+		*opts.Summary = sum
+	} else if !opts.Quiet {
+		sum.WriteTableFormat(opts.out(), opts.SizeFormat)
+	}
+	opts.Journal.end(&sum)
+	if opts.Mapping != nil {
+		if err := s.writeMapping(opts.Mapping); err != nil {
+			return err
+		}
+	}
+	if opts.Escalate != nil {
+		if err := s.writeEscalations(opts.Escalate); err != nil {
+			return err
+		}
+	}
+	if err := opts.Journal.failed(); err != nil {
+		return err
+	}
+	if err := opts.spaceFailed(); err != nil {
+		return err
+	}
+	if opts.Strict {
+		return sum.strictError()
+	}
+	return nil
+}
+
+// userName returns the name of the user with the given ID, or the ID if the
+// user cannot be found.
+func userName(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
@@ -0,0 +1,382 @@
+package linksame
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errTargetTooLong is returned when a symlink target is longer than the
+// limit.
+var errTargetTooLong = errors.New("symlink target too long")
+
+// symlinkSource returns the source for a symlink at f that links to
+// baseFile, in the form given by o.TargetStyle.  If the source is longer than
+// the limit on symlink targets, errTargetTooLong is returned.
+func (o *Options) symlinkSource(f, baseFile string) (string, error) {
+	var source string
+	var err error
+	switch o.TargetStyle {
+	case TargetRelative:
+		source, err = o.relativeSource(f, baseFile)
+	case TargetAbsolute:
+		source, err = absoluteSource(baseFile)
+	case TargetBasename:
+		if sameDir(f, baseFile) {
+			source = filepath.Base(baseFile)
+		} else {
+			source, err = absoluteSource(baseFile)
+		}
+	default:
+		return o.autoSource(f, baseFile)
+	}
+	if max := o.symlinkTargetMax(); len(source) > max {
+		return source, fmt.Errorf("%s: %w (more than %d bytes)", f, errTargetTooLong, max)
+	}
+	return source, err
+}
+
+// autoSource returns the source for a symlink at f that links to baseFile,
+// for TargetAuto.  If o.Absolute is false, the source is relative to the
+// directory containing f.  If a relative source cannot be made, then
+// baseFile is returned along with the error.  If the source is longer than
+// the limit on symlink targets, the other form is returned if it is within
+// the limit, and otherwise errTargetTooLong is returned.
+func (o *Options) autoSource(f, baseFile string) (string, error) {
+	source, err := baseFile, error(nil)
+	if !o.Absolute {
+		source, err = o.relativeSource(f, baseFile)
+	}
+	max := o.symlinkTargetMax()
+	if len(source) <= max {
+		return source, err
+	}
+	var other string
+	if o.Absolute {
+		other, err = o.relativeSource(f, baseFile)
+	} else {
+		other, err = filepath.Abs(baseFile)
+	}
+	if err == nil && len(other) <= max {
+		return other, nil
+	}
+	return source, fmt.Errorf("%s: %w (more than %d bytes)", f, errTargetTooLong, max)
+}
+
+// absoluteSource returns the absolute path of baseFile, as the source for a
+// symlink.  If the path cannot be made absolute, baseFile is returned along
+// with the error.
+func absoluteSource(baseFile string) (string, error) {
+	abs, err := filepath.Abs(baseFile)
+	if err != nil {
+		return baseFile, err
+	}
+	return abs, nil
+}
+
+// sameDir reports whether files f and g are in the same directory.
+func sameDir(f, g string) bool {
+	return filepath.Dir(filepath.Clean(f)) == filepath.Dir(filepath.Clean(g))
+}
+
+// symlinkTargetMax returns the length of the longest symlink target to
+// create.
+func (o *Options) symlinkTargetMax() int {
+	if o.MaxSymlinkTarget > 0 {
+		return o.MaxSymlinkTarget
+	}
+	return pathMax - 1
+}
+
+// relativeSource returns the source for a symlink at f that links to
+// baseFile, relative to the directory containing f.  If there is an anchor,
+// SymlinkAnchor or the root containing f if AnchorAtRoot is set, and both
+// files are within it, the source climbs from the directory containing f up
+// to the anchor, and then descends to baseFile.  The symlink then still works
+// after the directory containing f is moved elsewhere at the same depth
+// within the anchor.
+func (o *Options) relativeSource(f, baseFile string) (string, error) {
+	if o.SymlinkAnchor == "" && !o.AnchorAtRoot {
+		return relativeSource(f, baseFile)
+	}
+	absFile, err1 := filepath.Abs(f)
+	absBase, err2 := filepath.Abs(baseFile)
+	if err1 != nil || err2 != nil {
+		return relativeSource(f, baseFile)
+	}
+	var anchor string
+	if o.AnchorAtRoot {
+		for _, root := range o.roots {
+			absRoot, err := filepath.Abs(root)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(absRoot, absFile); err == nil && !isOutside(rel) {
+				anchor = absRoot
+				break
+			}
+		}
+	} else {
+		var err error
+		if anchor, err = filepath.Abs(o.SymlinkAnchor); err != nil {
+			anchor = ""
+		}
+	}
+	if anchor == "" {
+		return relativeSource(f, baseFile)
+	}
+	up, err1 := filepath.Rel(anchor, filepath.Dir(absFile))
+	down, err2 := filepath.Rel(anchor, absBase)
+	if err1 != nil || err2 != nil || isOutside(up) || isOutside(down) {
+		return relativeSource(f, baseFile)
+	}
+	if up == "." {
+		return down, nil
+	}
+	parts := strings.Split(up, string(filepath.Separator))
+	for i := range parts {
+		parts[i] = ".."
+	}
+	return filepath.Join(append(parts, down)...), nil
+}
+
+// isOutside reports whether the relative path rel leads outside of the
+// directory it is relative to.
+func isOutside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// relativeSource returns the source for a symlink at f that links to
+// baseFile, relative to the directory containing f.  If a relative source
+// cannot be made, then baseFile is returned along with the error.
+func relativeSource(f, baseFile string) (string, error) {
+	rp, err := filepath.Rel(path.Dir(f), path.Dir(baseFile))
+	if err != nil {
+		// Cannot make relative symlink.
+		return baseFile, err
+	}
+	if rp == "." {
+		return path.Base(baseFile), nil
+	}
+	return path.Join(rp, path.Base(baseFile)), nil
+}
+
+// fastSymlinkMax is the longest symlink target that file systems such as ext4
+// store in the inode itself, rather than in a data block.
+const fastSymlinkMax = 59
+
+// symlinkOverhead estimates the storage used by a symlink to source that
+// replaces the file described by info.  The symlink uses the inode freed by
+// the file, and uses a block, of the size used by the file system, if the
+// target is too long to be stored in the inode.
+func symlinkOverhead(source string, info os.FileInfo) int64 {
+	if len(source) <= fastSymlinkMax {
+		return 0
+	}
+	return int64(info.Sys().(*syscall.Stat_t).Blksize)
+}
+
+// Relink rewrites the symlinks in the specified directory trees, that link to
+// files within the trees, to be absolute or relative as specified by
+// opts.Absolute.  The files linked to are not changed.  This is useful for
+// preparing trees to be moved to a different mount point.
+//
+// Only opts.Pattern, WriteLinks, Absolute, Quiet, Verbose, Journal,
+// Policies, MaxSymlinkTarget, SymlinkAnchor, and AnchorAtRoot are used.
+func Relink(roots []string, opts Options) error {
+	start := time.Now()
+	roots, err := normalizeRoots(roots, opts.Quiet, opts.errOut())
+	if err != nil {
+		return err
+	}
+	if err = opts.preparePolicies(roots); err != nil {
+		return err
+	}
+	form := "relative"
+	if opts.Absolute {
+		form = "absolute"
+	}
+	if !opts.Quiet {
+		fmt.Fprintln(opts.out(), "Rewriting symlinks as", form, "in", strings.Join(roots, ", "))
+	}
+
+	var symlinks []string
+	var tempErrors int
+	for _, rootDir := range roots {
+		err = walkTree(rootDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(opts.errOut(), err)
+				return nil
+			}
+			if opts.leftoverTemp(path, &tempErrors) {
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				symlinks = append(symlinks, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Symlink = true
+	opts.RewriteSymlinks = true
+	opts.roots = roots
+	opts.Journal.start(roots, &opts)
+	st := checkSymlinks(symlinks, roots, &opts)
+	st.errors += tempErrors
+	if !opts.Quiet {
+		fmt.Fprintln(opts.out())
+		if !opts.WriteLinks {
+			fmt.Fprintln(opts.out(), "If writing links (-w), would have...")
+		}
+		fmt.Fprintln(opts.out(), "Rewrote", st.rewritten, "of", st.symlinked, "symlinks")
+	}
+	sum := st.summary(opts.WriteLinks, time.Since(start))
+	opts.Journal.end(&sum)
+	return opts.Journal.failed()
+}
+
+// checkSymlinks counts the symlinks that link to regular files within the
+// roots, since these are files that are already linked.  If rewriting
+// symlinks, these are also rewritten to be absolute or relative as specified
+// by opts.Absolute.
+func checkSymlinks(symlinks, roots []string, opts *Options) stats {
+	var st stats
+	canonRoots := make([]string, len(roots))
+	for i := range roots {
+		canonRoots[i] = canonicalPath(roots[i])
+	}
+	for _, link := range symlinks {
+		info, err := os.Stat(link)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+		if opts.Pattern != "" {
+			if ok, _ := filepath.Match(opts.Pattern, filepath.Base(link)); !ok {
+				continue
+			}
+		}
+		target := canonicalPath(link)
+		if !withinRoots(target, canonRoots) {
+			continue
+		}
+		st.symlinked++
+		st.symlinkedSize += info.Size()
+
+		if !opts.RewriteSymlinks || !opts.Symlink || opts.policyForbids(link) {
+			continue
+		}
+		source, err := os.Readlink(link)
+		if err != nil || filepath.IsAbs(source) == opts.Absolute {
+			continue
+		}
+		oldSource := source
+		targetPath := source
+		if !filepath.IsAbs(source) {
+			targetPath = filepath.Join(filepath.Dir(link), source)
+		}
+		if opts.Absolute {
+			if source, err = filepath.Abs(targetPath); err != nil {
+				continue
+			}
+		} else {
+			absLink, err := filepath.Abs(link)
+			if err != nil {
+				continue
+			}
+			if source, err = opts.relativeSource(absLink, targetPath); err != nil {
+				continue
+			}
+		}
+		if len(source) > opts.symlinkTargetMax() {
+			// Leave the symlink as it is, rather than create one that is too
+			// long to resolve.
+			if opts.Verbose {
+				fmt.Fprintf(opts.errOut(), "not rewriting symlink %s: %s\n", link, errTargetTooLong)
+			}
+			continue
+		}
+		if !opts.WriteLinks {
+			st.rewritten++
+			if opts.Verbose {
+				fmt.Fprintln(opts.out(), "rewrite symlink:", link, "--->", source)
+			}
+			continue
+		}
+		var before *fileState
+		if opts.Journal != nil {
+			if linkInfo, err := os.Lstat(link); err == nil {
+				before = stateOf(linkInfo, "")
+				before.Link = oldSource
+			}
+		}
+		intent := opts.Journal.intend(journalRewrite, "", link, source, before)
+		if opts.Journal.failed() != nil {
+			// Do not modify files when the modification cannot be recorded.
+			break
+		}
+		err = replaceSymlink(link, source)
+		opts.Journal.done(intent, journalRewrite, "", link, source, err)
+		if err != nil {
+			fmt.Fprintln(opts.errOut(), "cannot rewrite symlink:", err)
+			continue
+		}
+		st.rewritten++
+		if opts.Verbose {
+			fmt.Fprintln(opts.out(), "rewrite symlink:", link, "--->", source)
+		}
+	}
+	return st
+}
+
+// withinRoots reports whether the canonical path p is in one of the
+// canonical roots.
+func withinRoots(p string, canonRoots []string) bool {
+	for _, root := range canonRoots {
+		if withinDir(p, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinDir reports whether the path p is the directory dir or is below it.
+// A dir that ends in a separator, such as the root directory, is handled as
+// filepath.Rel does.
+func withinDir(p, dir string) bool {
+	if p == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, dir)
+}
+
+// replaceSymlink atomically replaces the symlink at link with a symlink to
+// source.
+func replaceSymlink(link, source string) error {
+	dir, name := filepath.Split(link)
+	tmp, err := tempName(dir, tempLink, name)
+	if err != nil {
+		return err
+	}
+	if err = os.Symlink(source, tmp); err != nil {
+		forgetTemp(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, link); err != nil {
+		removeTemp(tmp)
+		return err
+	}
+	forgetTemp(tmp)
+	return nil
+}
@@ -0,0 +1,93 @@
+package linksame
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// tailHashSize is the number of bytes at the end of a file that are
+	// compared before hashing the whole file, for files selected by
+	// TailFirst, and the size of each chunk compared with SampleFirst.
+	tailHashSize = 64 * 1024
+	// sampleChunks is the number of chunks, spread from the start to the
+	// end of a file, that are compared for files selected by SampleFirst.
+	sampleChunks = 8
+)
+
+// checkTailFirst returns an error if any TailFirst pattern is malformed.
+func (o *Options) checkTailFirst() error {
+	for _, pattern := range o.TailFirst {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("tail-first pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// tailFirst reports whether the file at path, of the given size, is compared
+// by its tail, or by a sample of chunks, before it is hashed whole.  Files no
+// larger than the tail are hashed whole at once, and with SlowStorage only the
+// start of files is hashed, so neither is compared by its tail.
+func (o *Options) tailFirst(path string, size int64) bool {
+	if o.SlowStorage || size <= tailHashSize {
+		return false
+	}
+	if o.sampled(size) {
+		return true
+	}
+	name := filepath.Base(path)
+	for _, pattern := range o.TailFirst {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled reports whether files of the given size are compared by a sample
+// of chunks, as selected by SampleFirst.  Smaller files are compared by their
+// tails, if at all, since a sample would read most of them.
+func (o *Options) sampled(size int64) bool {
+	return o.SampleFirst > 0 && size >= o.SampleFirst && size > 2*sampleChunks*tailHashSize
+}
+
+// tailLen returns the number of bytes read to compare a file of the given
+// size by its tail or by a sample.
+func (o *Options) tailLen(size int64) int64 {
+	if o.sampled(size) {
+		return sampleChunks * tailHashSize
+	}
+	return tailHashSize
+}
+
+// hashTail calculates a hash of the last tailHashSize bytes of the file,
+// which is of the given size, or of a sample of chunks spread through it if
+// files of its size are sampled.
+func (o *Options) hashTail(file string, size int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	offsets := []int64{size - tailHashSize}
+	if o.sampled(size) {
+		offsets = make([]int64, sampleChunks)
+		for i := range offsets {
+			offsets[i] = int64(i) * ((size - tailHashSize) / (sampleChunks - 1))
+		}
+		offsets[sampleChunks-1] = size - tailHashSize
+	}
+	h := newHash()
+	buf := make([]byte, 32*1024)
+	for _, off := range offsets {
+		r := io.NewSectionReader(f, off, tailHashSize)
+		if _, err = io.CopyBuffer(h, r, buf); err != nil {
+			return "", err
+		}
+	}
+	return string(h.Sum(nil)), nil
+}
@@ -0,0 +1,47 @@
+package linksame
+
+import "fmt"
+
+// TargetStyle selects the form of the targets of symlinks that are created.
+type TargetStyle int
+
+const (
+	// TargetAuto uses targets relative to the symlink's directory, or
+	// absolute targets if Options.Absolute is set.  If a target is longer
+	// than Options.MaxSymlinkTarget, the other form is used instead.
+	TargetAuto TargetStyle = iota
+	// TargetRelative always uses targets relative to the symlink's
+	// directory, which are the name of the file linked to when it is in the
+	// same directory.
+	TargetRelative
+	// TargetAbsolute always uses absolute targets.
+	TargetAbsolute
+	// TargetBasename uses the name of the file linked to when it is in the
+	// same directory as the symlink, and absolute targets otherwise.
+	TargetBasename
+)
+
+var targetStyleNames = []string{"auto", "relative", "absolute", "basename"}
+
+func (t TargetStyle) String() string {
+	if t < 0 || int(t) >= len(targetStyleNames) {
+		return fmt.Sprintf("TargetStyle(%d)", int(t))
+	}
+	return targetStyleNames[t]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t TargetStyle) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// ParseTargetStyle returns the TargetStyle with the given name: "auto",
+// "relative", "absolute", or "basename".
+func ParseTargetStyle(name string) (TargetStyle, error) {
+	for i := range targetStyleNames {
+		if name == targetStyleNames[i] {
+			return TargetStyle(i), nil
+		}
+	}
+	return TargetAuto, fmt.Errorf("unknown target style %q", name)
+}
@@ -0,0 +1,217 @@
+package linksame
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// tempPrefix starts the name of every temporary file created while linking.
+// The full name is tempPrefix followed by the ID of the process that created
+// it, the kind of temporary file, the name of the file it is for, and a
+// random suffix:
+//
+//	.linksame-tmp-<pid>-<kind>-<name>.<random>
+//
+// This identifies the files left behind by a run that crashed, and what to do
+// with them.  A name too long to fit within nameMax is cut short, and the kind
+// is followed by truncMark to show that the name is not whole.
+const tempPrefix = ".linksame-tmp-"
+
+const (
+	// nameMax is the length of the longest file name that file systems
+	// commonly allow.
+	nameMax = 255
+	// truncMark follows the kind in the name of a temporary file for a file
+	// whose name was cut short.
+	truncMark = "~"
+	// randomLen is the most that os.CreateTemp adds for the random part of a
+	// name, including the dot before it.
+	randomLen = 11
+)
+
+// Kinds of temporary files.
+const (
+	// tempBackup is a file moved aside, which is restored to its name if
+	// nothing replaced it.
+	tempBackup = "backup"
+	// tempLink is a link that was to be renamed over a file.
+	tempLink = "link"
+	// tempProbe is a file used to check that links can be created.
+	tempProbe = "probe"
+	// tempCache is a scan cache being written.
+	tempCache = "cache"
+)
+
+// temps maps the temporary files of this process that currently exist to
+// the paths of the files they are for, if any.
+var temps = struct {
+	sync.Mutex
+	files map[string]string
+}{files: map[string]string{}}
+
+// createTemp creates a new temporary file of the given kind in dir, for the
+// file with the given name, and registers it.
+func createTemp(dir, kind, name string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, tempPattern(kind, name))
+	if err != nil {
+		return nil, err
+	}
+	var orig string
+	if name != "" {
+		orig = filepath.Join(dir, name)
+	}
+	temps.Lock()
+	temps.files[f.Name()] = orig
+	temps.Unlock()
+	return f, nil
+}
+
+// tempPattern returns the pattern, for os.CreateTemp, of the name of a
+// temporary file of the given kind for the file with the given name.  The
+// name is cut short, at the start of a character, if the temporary name
+// would otherwise be longer than nameMax.
+func tempPattern(kind, name string) string {
+	head := fmt.Sprintf("%s%d-%s", tempPrefix, os.Getpid(), kind)
+	if len(head)+1+len(name)+randomLen > nameMax {
+		head += truncMark
+		n := nameMax - len(head) - 1 - randomLen
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+	return head + "-" + name + ".*"
+}
+
+// tempName reserves a new temporary name of the given kind in dir, for the
+// file with the given name, and registers it.  Nothing exists at the name, so
+// that a link can be created there.
+func tempName(dir, kind, name string) (string, error) {
+	f, err := createTemp(dir, kind, name)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return f.Name(), nil
+}
+
+// removeTemp removes a temporary file and unregisters it.
+func removeTemp(name string) error {
+	forgetTemp(name)
+	return os.Remove(name)
+}
+
+// forgetTemp unregisters a temporary file that was renamed or removed.
+func forgetTemp(name string) {
+	temps.Lock()
+	delete(temps.files, name)
+	temps.Unlock()
+}
+
+// RemoveTempFiles cleans up the temporary files that this process has
+// created and not yet removed, as is done for those left by a previous run
+// that crashed.  This is intended for use when a run is interrupted.
+func RemoveTempFiles() {
+	temps.Lock()
+	files := temps.files
+	temps.files = map[string]string{}
+	temps.Unlock()
+	for name, orig := range files {
+		if _, err := cleanupTemp(name, orig); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// parseTemp returns the process ID, kind, and name of the file it is for,
+// from the name of a temporary file.  The name of the file is empty if it was
+// cut short.  It returns false if name is not the name of a temporary file.
+func parseTemp(name string) (int, string, string, bool) {
+	if !strings.HasPrefix(name, tempPrefix) {
+		return 0, "", "", false
+	}
+	parts := strings.SplitN(name[len(tempPrefix):], "-", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", "", false
+	}
+	kind, orig := parts[1], parts[2]
+	if strings.HasSuffix(kind, truncMark) {
+		return pid, strings.TrimSuffix(kind, truncMark), "", true
+	}
+	if i := strings.LastIndexByte(orig, '.'); i >= 0 {
+		orig = orig[:i]
+	}
+	return pid, kind, orig, true
+}
+
+// leftoverTemp reports whether the file at path is a temporary file, which is
+// not to be linked.  If it was left by a run that is no longer running, and
+// links are being written, it is cleaned up.  Errors cleaning up are printed
+// and counted in errCount.
+func (o *Options) leftoverTemp(path string, errCount *int) bool {
+	pid, _, orig, ok := parseTemp(filepath.Base(path))
+	if !ok {
+		return false
+	}
+	if !o.WriteLinks || processRunning(pid) {
+		if o.Verbose {
+			fmt.Fprintln(o.out(), "temporary file:", path)
+		}
+		return true
+	}
+	if orig != "" {
+		orig = filepath.Join(filepath.Dir(path), orig)
+	}
+	action, err := cleanupTemp(path, orig)
+	if err != nil {
+		fmt.Fprintln(o.errOut(), err)
+		*errCount++
+	} else if !o.Quiet {
+		fmt.Fprintln(o.out(), action, "leftover temporary file:", path)
+	}
+	return true
+}
+
+// cleanupTemp removes a temporary file, except for a backup of a file that
+// is missing, which is restored to orig, the path of the file it is for.  A
+// backup whose orig is not known, since its name was cut short, is left in
+// place.  It returns what was done.
+func cleanupTemp(path, orig string) (string, error) {
+	_, kind, _, _ := parseTemp(filepath.Base(path))
+	if kind == tempBackup {
+		if orig == "" {
+			return "", fmt.Errorf("cannot restore backup of a file with a long name, left at %s", path)
+		}
+		if _, err := os.Lstat(orig); errors.Is(err, os.ErrNotExist) {
+			if err = os.Rename(path, orig); err != nil {
+				return "", fmt.Errorf("cannot restore backup: %w", err)
+			}
+			return "restored " + orig + " from", nil
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return "", fmt.Errorf("cannot remove temporary file: %w", err)
+	}
+	return "removed", nil
+}
+
+// processRunning reports whether a process with the ID is running.
+func processRunning(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
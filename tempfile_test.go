@@ -0,0 +1,135 @@
+package linksame
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// deadPID is a process ID that no process has, since it is above the largest
+// process ID Linux allows.
+const deadPID = "999999999"
+
+func TestParseTemp(t *testing.T) {
+	tests := []struct {
+		name      string
+		pid       int
+		kind      string
+		orig      string
+		temporary bool
+	}{
+		{".linksame-tmp-123-link-file.txt.4567", 123, tempLink, "file.txt", true},
+		{".linksame-tmp-123-backup-a-b-c.4567", 123, tempBackup, "a-b-c", true},
+		{".linksame-tmp-123-probe-.4567", 123, tempProbe, "", true},
+		{".linksame-tmp-123-backup~-cut-sho.4567", 123, tempBackup, "", true},
+		{".linksame-tmp-x-link-file.4567", 0, "", "", false},
+		{".linksame-tmp-123", 0, "", "", false},
+		{"file.txt", 0, "", "", false},
+	}
+	for _, tc := range tests {
+		pid, kind, orig, ok := parseTemp(tc.name)
+		if ok != tc.temporary || pid != tc.pid || kind != tc.kind || orig != tc.orig {
+			t.Errorf("parseTemp(%q) = %d, %q, %q, %t; want %d, %q, %q, %t", tc.name,
+				pid, kind, orig, ok, tc.pid, tc.kind, tc.orig, tc.temporary)
+		}
+	}
+}
+
+func TestTempPatternRoundTrip(t *testing.T) {
+	for _, name := range []string{"file.txt", strings.Repeat("é", 200)} {
+		f, err := createTemp(t.TempDir(), tempBackup, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		removeTemp(f.Name())
+		base := filepath.Base(f.Name())
+		if len(base) > nameMax {
+			t.Errorf("temporary name is %d bytes, more than %d", len(base), nameMax)
+		}
+		pid, kind, orig, ok := parseTemp(base)
+		if !ok || pid != os.Getpid() || kind != tempBackup {
+			t.Errorf("parseTemp(%q) = %d, %q, %t", base, pid, kind, ok)
+		}
+		// A name that does not fit is cut short, and then not known.
+		want := name
+		if strings.Contains(base, tempBackup+truncMark+"-") {
+			want = ""
+		}
+		if orig != want {
+			t.Errorf("parseTemp(%q) gave file %q, want %q", base, orig, want)
+		}
+	}
+}
+
+func TestLeftoverTemp(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	exists := func(path string) bool {
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+
+	opts := Options{WriteLinks: true, Quiet: true, stderr: io.Discard}
+	var errCount int
+
+	plain := write("plain")
+	if opts.leftoverTemp(plain, &errCount) {
+		t.Error("plain file reported as temporary")
+	}
+
+	// A link left by a run that is not running is removed.
+	link := write(".linksame-tmp-" + deadPID + "-link-a.123")
+	if !opts.leftoverTemp(link, &errCount) || exists(link) {
+		t.Error("leftover link not removed")
+	}
+
+	// A backup of a missing file is restored.
+	backup := write(".linksame-tmp-" + deadPID + "-backup-b.123")
+	if !opts.leftoverTemp(backup, &errCount) || exists(backup) {
+		t.Error("leftover backup not moved")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "b")); err != nil || string(data) != filepath.Base(backup) {
+		t.Error("backup not restored to its file:", err)
+	}
+
+	// A backup of a file that was replaced is removed.
+	write("c")
+	backup = write(".linksame-tmp-" + deadPID + "-backup-c.123")
+	if !opts.leftoverTemp(backup, &errCount) || exists(backup) {
+		t.Error("leftover backup of replaced file not removed")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "c")); err != nil || string(data) != "c" {
+		t.Error("replaced file changed:", err)
+	}
+
+	// A backup whose name was cut short is left, with an error.
+	backup = write(".linksame-tmp-" + deadPID + "-backup~-d.123")
+	if !opts.leftoverTemp(backup, &errCount) || !exists(backup) {
+		t.Error("backup with name cut short not left in place")
+	}
+	if errCount != 1 {
+		t.Errorf("error count %d, want 1", errCount)
+	}
+
+	// Files of running processes, and files found when links are not
+	// written, are left alone.
+	own := write(".linksame-tmp-" + strconv.Itoa(os.Getpid()) + "-link-e.123")
+	if !opts.leftoverTemp(own, &errCount) || !exists(own) {
+		t.Error("temporary file of running process not left in place")
+	}
+	link = write(".linksame-tmp-" + deadPID + "-link-f.123")
+	opts.WriteLinks = false
+	if !opts.leftoverTemp(link, &errCount) || !exists(link) {
+		t.Error("leftover link removed without writing links")
+	}
+}
@@ -0,0 +1,164 @@
+package linksame
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// tuneInterval is how often the tuner measures throughput and adjusts
+	// the number of hashers.
+	tuneInterval = 500 * time.Millisecond
+	// tuneGain is the fractional change in throughput that is considered a
+	// real improvement or loss, rather than noise.
+	tuneGain = 0.05
+)
+
+// tuner limits the number of hashers that run at once, and adjusts the
+// limit based on observed throughput and latency.  It starts with moderate
+// parallelism and climbs in the direction that improves throughput,
+// reversing when throughput falls or when latency grows without more
+// throughput.  This suits fast disks that benefit from many parallel reads,
+// and spinning disks and network file systems that do not.
+//
+// All methods may be called on a nil tuner, which does not limit hashers.
+type tuner struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	max     int
+	running int
+
+	// Work done since the last adjustment.
+	bytes   int64
+	files   int64
+	latency time.Duration
+	// waited is set if a hasher waited for the limit.
+	waited bool
+
+	lastRate float64
+	step     int
+	// out, if not nil, is where changes to the limit are printed.
+	out  io.Writer
+	done chan struct{}
+}
+
+// newTuner creates a tuner that allows between 1 and max hashers to run, and
+// starts adjusting the limit.  Changes to the limit are printed to out, if not
+// nil.
+func newTuner(max int, out io.Writer) *tuner {
+	limit := max / 4
+	if limit < 1 {
+		limit = 1
+	}
+	t := &tuner{
+		limit: limit,
+		max:   max,
+		step:  1,
+		out:   out,
+		done:  make(chan struct{}),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	go t.run()
+	return t
+}
+
+// acquire waits until another hasher may run.
+func (t *tuner) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	for t.running >= t.limit {
+		t.waited = true
+		t.cond.Wait()
+	}
+	t.running++
+	t.mu.Unlock()
+}
+
+// release records that a hasher, started at start, finished hashing the
+// given number of files and bytes.
+func (t *tuner) release(start time.Time, files int, bytes int64) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	t.mu.Lock()
+	t.running--
+	t.files += int64(files)
+	t.bytes += bytes
+	t.latency += elapsed
+	t.mu.Unlock()
+	t.cond.Signal()
+}
+
+// stop stops adjusting the limit.
+func (t *tuner) stop() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+}
+
+func (t *tuner) run() {
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	var lastLatency time.Duration
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+
+		t.mu.Lock()
+		bytes, files, latency, waited := t.bytes, t.files, t.latency, t.waited
+		t.bytes, t.files, t.latency, t.waited = 0, 0, 0, false
+		if files == 0 || (!waited && t.step > 0) {
+			// Nothing finished, so there is nothing to measure, or the
+			// hashers are not limited by the number running, so more would
+			// not help.
+			t.mu.Unlock()
+			continue
+		}
+		rate := float64(bytes) / tuneInterval.Seconds()
+		avgLatency := latency / time.Duration(files)
+
+		switch {
+		case t.lastRate == 0:
+		case rate < t.lastRate*(1-tuneGain):
+			// Last change made things worse; go back the other way.
+			t.step = -t.step
+		case rate < t.lastRate*(1+tuneGain) && avgLatency > lastLatency*2:
+			// No more throughput, only more waiting; use fewer hashers.
+			t.step = -1
+		case rate < t.lastRate*(1+tuneGain):
+			// No real change; keep the current limit.
+			t.lastRate = rate
+			lastLatency = avgLatency
+			t.mu.Unlock()
+			continue
+		}
+		t.lastRate = rate
+		lastLatency = avgLatency
+
+		limit := t.limit + t.step
+		if limit < 1 {
+			limit = 1
+			t.step = 1
+		} else if limit > t.max {
+			limit = t.max
+			t.step = -1
+		}
+		if limit != t.limit && t.out != nil {
+			fmt.Fprintf(t.out, "hashers: %d -> %d (%s/s, %s per file)\n", t.limit, limit,
+				sizeStr(int64(rate)), avgLatency.Round(time.Microsecond))
+		}
+		t.limit = limit
+		t.mu.Unlock()
+		t.cond.Broadcast()
+	}
+}
@@ -0,0 +1,207 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package linksame
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIoUringSetup = 425
+	sysIoUringEnter = 426
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringOpRead         = 22
+	ioringEnterGetevents = 1
+
+	sqeSize = 64
+	cqeSize = 16
+)
+
+// ioUringParams is struct io_uring_params.
+type ioUringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct{ head, tail, ringMask, ringEntries, flags, dropped, array, resv1, userAddrLo, userAddrHi uint32 }
+	cqOff        struct{ head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1, userAddrLo, userAddrHi uint32 }
+}
+
+// ioUringSqe is struct io_uring_sqe, for read operations.
+type ioUringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// ioUringCqe is struct io_uring_cqe.
+type ioUringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringReader reads many files with one system call using io_uring.  It is
+// not safe for concurrent use.
+type uringReader struct {
+	fd      int
+	entries uint32
+	sqRing  []byte
+	cqRing  []byte
+	sqes    []byte
+
+	sqTail  *uint32
+	sqMask  *uint32
+	sqArray unsafe.Pointer
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  *uint32
+	cqes    unsafe.Pointer
+
+	// broken holds the buffers of a batch that failed, which reads still in
+	// the ring may write to, and keeps the ring from being used again.
+	broken [][]byte
+}
+
+// errBatchTooLarge is returned for a batch of more files than the ring holds.
+var errBatchTooLarge = errors.New("too many files for io_uring batch")
+
+// newBatchReader creates an io_uring reader, or returns nil if io_uring is
+// not available.
+func newBatchReader() batchReader {
+	var p ioUringParams
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, batchSize, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil
+	}
+	r := &uringReader{fd: int(fd), entries: p.sqEntries}
+
+	var err error
+	r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, int(p.sqOff.array+p.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil
+	}
+	r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, int(p.cqOff.cqes+p.cqEntries*cqeSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil
+	}
+	r.sqes, err = syscall.Mmap(r.fd, ioringOffSqes, int(p.sqEntries*sqeSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.sqOff.array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[p.cqOff.cqes])
+	return r
+}
+
+// readFiles reads each file into the corresponding buffer, and returns the
+// number of bytes read into each, or -1 if the file could not be read.  If
+// io_uring_enter fails, which reads completed cannot be known, so an error is
+// returned and the ring is not used again.
+func (r *uringReader) readFiles(files []*os.File, bufs [][]byte) ([]int, error) {
+	if r.broken != nil {
+		return nil, errors.New("io_uring reader failed earlier")
+	}
+	if uint32(len(files)) > r.entries {
+		return nil, errBatchTooLarge
+	}
+	n := make([]int, len(files))
+
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := atomic.LoadUint32(r.sqMask)
+	for i, f := range files {
+		idx := tail & mask
+		sqe := (*ioUringSqe)(unsafe.Pointer(&r.sqes[idx*sqeSize]))
+		*sqe = ioUringSqe{
+			opcode:   ioringOpRead,
+			fd:       int32(f.Fd()),
+			addr:     uint64(uintptr(unsafe.Pointer(&bufs[i][0]))),
+			len:      uint32(len(bufs[i])),
+			userData: uint64(i),
+		}
+		*(*uint32)(unsafe.Pointer(uintptr(r.sqArray) + uintptr(idx*4))) = idx
+		tail++
+	}
+	atomic.StoreUint32(r.sqTail, tail)
+
+	toSubmit := len(files)
+	for done := 0; done < len(files); {
+		submitted, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), uintptr(toSubmit),
+			uintptr(len(files)-done), ioringEnterGetevents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR {
+			r.broken = bufs
+			return nil, os.NewSyscallError("io_uring_enter", errno)
+		}
+		if errno == 0 {
+			// The kernel may submit fewer entries than asked.
+			toSubmit -= int(submitted)
+		}
+		head := atomic.LoadUint32(r.cqHead)
+		cqTail := atomic.LoadUint32(r.cqTail)
+		cqMask := atomic.LoadUint32(r.cqMask)
+		for ; head != cqTail; head++ {
+			cqe := (*ioUringCqe)(unsafe.Pointer(uintptr(r.cqes) + uintptr((head&cqMask)*cqeSize)))
+			if cqe.res < 0 {
+				n[cqe.userData] = -1
+			} else {
+				n[cqe.userData] = int(cqe.res)
+			}
+			done++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	runtime.KeepAlive(bufs)
+	runtime.KeepAlive(files)
+	return n, nil
+}
+
+func (r *uringReader) close() {
+	if r.sqes != nil {
+		syscall.Munmap(r.sqes)
+	}
+	if r.cqRing != nil {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+	syscall.Close(r.fd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package linksame
+
+// newBatchReader returns nil, since batch reading is not supported on this
+// platform.
+func newBatchReader() batchReader {
+	return nil
+}
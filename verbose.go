@@ -0,0 +1,100 @@
+package linksame
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// verboseInterval is how often a summary of the links created is
+	// printed, after VerboseLimit links are printed individually.
+	verboseInterval = 10 * time.Second
+	// verboseTopDirs is the number of directories with the most links that
+	// are listed at the end of a run, after VerboseLimit is reached.
+	verboseTopDirs = 20
+)
+
+// verboseLog prints the links created with Verbose, switching to periodic
+// summaries and counts per directory after VerboseLimit links.
+type verboseLog struct {
+	mu    sync.Mutex
+	limit int
+	count int
+	// dirs counts the links in each directory, once over the limit.
+	dirs map[string]int
+	// last is when the last summary was printed, and lastCount is the count
+	// at that time.
+	last      time.Time
+	lastCount int
+}
+
+// prepareVerbose sets up printing of links with Verbose.
+func (o *Options) prepareVerbose() {
+	o.vlog = nil
+	if o.Verbose {
+		o.vlog = &verboseLog{limit: o.VerboseLimit}
+	}
+}
+
+// logLink prints a link of the given kind, from file to target, unless
+// VerboseLimit links are already printed.  Then it counts the link for its
+// directory and prints a summary every verboseInterval.
+func (o *Options) logLink(kind, file, arrow, target string) {
+	l := o.vlog
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if l.limit == 0 || l.count <= l.limit {
+		fmt.Fprintln(o.out(), kind+":", file, arrow, target)
+		return
+	}
+	if l.dirs == nil {
+		l.dirs = map[string]int{}
+		l.last, l.lastCount = time.Now(), l.limit
+		fmt.Fprintln(o.out(), "Printed", l.limit, "links, now summarizing every", verboseInterval)
+	}
+	l.dirs[filepath.Dir(file)]++
+	if now := time.Now(); now.Sub(l.last) >= verboseInterval {
+		fmt.Fprintln(o.out(), l.count, "links,", l.count-l.lastCount, "in the last",
+			now.Sub(l.last).Round(time.Second))
+		l.last, l.lastCount = now, l.count
+	}
+}
+
+// finish prints the directories with the most links that were not printed
+// individually to w.
+func (l *verboseLog) finish(w io.Writer) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.dirs) == 0 {
+		return
+	}
+	dirs := make([]string, 0, len(l.dirs))
+	for dir := range l.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if l.dirs[dirs[i]] != l.dirs[dirs[j]] {
+			return l.dirs[dirs[i]] > l.dirs[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	fmt.Fprintln(w, l.count-l.limit, "links not printed, in", len(dirs), "directories:")
+	for i, dir := range dirs {
+		if i == verboseTopDirs {
+			fmt.Fprintln(w, "  ...", len(dirs)-i, "more directories")
+			break
+		}
+		fmt.Fprintf(w, "  %8d  %s\n", l.dirs[dir], dir)
+	}
+}
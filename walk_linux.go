@@ -0,0 +1,139 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package linksame
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atFdCwd           = -100  // AT_FDCWD
+	atSymlinkNoFollow = 0x100 // AT_SYMLINK_NOFOLLOW
+)
+
+// walkTree walks the file tree rooted at root, calling fn for each file or
+// directory in the same order as filepath.Walk.  Directories are opened
+// relative to their parent, and the files in each directory are stat'ed
+// relative to the open directory, so that each path is not resolved from
+// the root for every file.  This speeds up scanning directories that
+// contain very many small files.
+func walkTree(root string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirAt(atFdCwd, root, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkDirAt walks path, whose name relative to the open directory dirfd is
+// name.
+func walkDirAt(dirfd int, name, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		err = &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	var names []string
+	var dir *os.File
+	if err == nil {
+		dir = os.NewFile(uintptr(fd), path)
+		defer dir.Close()
+		names, err = dir.Readdirnames(-1)
+		sort.Strings(names)
+	}
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		// The caller decides whether to continue after an error reading the
+		// directory, as with filepath.Walk.
+		return err1
+	}
+
+	for _, n := range names {
+		p := filepath.Join(path, n)
+		fi, err := lstatAt(fd, n)
+		if err != nil {
+			if err := fn(p, fi, &os.PathError{Op: "lstat", Path: p, Err: err}); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = walkDirAt(fd, n, p, fi, fn)
+		if err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lstatAt returns information about the file name in the open directory
+// dirfd, without following symlinks.
+func lstatAt(dirfd int, name string) (os.FileInfo, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	_, _, errno := syscall.Syscall6(sysFstatat, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&st)), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &statInfo{name: name, st: st}, nil
+}
+
+// statInfo is an os.FileInfo made from a syscall.Stat_t.
+type statInfo struct {
+	name string
+	st   syscall.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.st }
+
+func (fi *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.st.Mode & 0777)
+	switch fi.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if fi.st.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.st.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.st.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
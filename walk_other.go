@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package linksame
+
+import "path/filepath"
+
+// walkTree walks the file tree rooted at root using filepath.Walk.
+func walkTree(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
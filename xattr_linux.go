@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package linksame
+
+import "syscall"
+
+// haveXattr is true where extended attributes can be used, given a file
+// system that supports them.
+const haveXattr = true
+
+// getXattr reads the value of the named extended attribute of a file.
+func getXattr(file, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(file, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(file, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// setXattr sets the value of the named extended attribute of a file.
+func setXattr(file, name string, value []byte) error {
+	return syscall.Setxattr(file, name, value, 0)
+}
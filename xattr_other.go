@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package linksame
+
+import "errors"
+
+// haveXattr is false, since extended attributes are not supported on this
+// platform.
+const haveXattr = false
+
+var errNoXattr = errors.New("extended attributes not supported")
+
+// getXattr reads the value of the named extended attribute of a file.
+func getXattr(file, name string) ([]byte, error) {
+	return nil, errNoXattr
+}
+
+// setXattr sets the value of the named extended attribute of a file.
+func setXattr(file, name string, value []byte) error {
+	return errNoXattr
+}